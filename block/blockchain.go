@@ -1,15 +1,14 @@
 package block
 
 import (
-	"bytes"
 	"crypto/ecdsa"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"goblockchain/utils"
 	"log"
-	"net/http"
 	"strings"
 	"sync"
 	"time"
@@ -25,6 +24,9 @@ const (
 	NEIGHBOR_IP_RANGE_START           = 0
 	NEIGHBOR_IP_RANGE_END             = 1
 	BLOCKCHAIN_NEIGHBOR_SYNC_TIME_SEC = 10
+
+	// Lock times below this value are block heights, above it unix timestamps (sec).
+	LOCKTIME_THRESHOLD = 500000000
 )
 
 type Block struct {
@@ -34,9 +36,9 @@ type Block struct {
 	transactions []*Transaction
 }
 
-func NewBlock(nonce int, previousHash [32]byte, transactions []*Transaction) *Block {
+func NewBlock(timestamp int64, nonce int, previousHash [32]byte, transactions []*Transaction) *Block {
 	b := new(Block)
-	b.timestamp = time.Now().UnixNano()
+	b.timestamp = timestamp
 	b.nonce = nonce
 	b.previousHash = previousHash
 	b.transactions = transactions
@@ -55,6 +57,17 @@ func (b *Block) Transactions() []*Transaction {
 	return b.transactions
 }
 
+// minerAddress is the recipient of the mining reward, who also collects
+// the gas fees of the block.
+func (b *Block) minerAddress() string {
+	for _, t := range b.transactions {
+		if t.IsCoinbase() {
+			return t.recipientBlockchainAddress
+		}
+	}
+	return ""
+}
+
 func (b *Block) Print() {
 	fmt.Printf("timestamp        %d\n", b.timestamp)
 	fmt.Printf("nonce            %d\n", b.nonce)
@@ -65,32 +78,61 @@ func (b *Block) Print() {
 }
 
 type Blockchain struct {
-	transactionPool   []*Transaction
-	chain             []*Block
-	blockchainAddress string
-	port              uint16
-	mux               sync.Mutex
-	neighbors         []string
-	muxNeighbors      sync.Mutex
+	transactionPool       []*Transaction
+	chain                 []*Block
+	blockchainAddress     string
+	spec                  *ChainSpec
+	clock                 Clock
+	host                  string
+	port                  uint16
+	mux                   sync.Mutex
+	neighbors             []string
+	seeds                 []string
+	addressBook           *AddressBook
+	muxNeighbors          sync.Mutex
+	nodeID                string
+	identityKey           *ecdsa.PrivateKey
+	trustedNodes          map[string]string // Public keys by node ID, of the nodes whose signed requests are served
+	adminKeys             map[string]string // Same, for the keys admin endpoints are served to
+	seenRequests          *inventorySet     // Signed requests already served
+	orphans               *orphanPool
+	peerInfo              map[string]*PeerInfo // By address, from handshakes
+	muxPeers              sync.Mutex
+	peerManager           *PeerManager
+	p2pPeers              map[string]*Peer // Open connections by node ID
+	dials                 map[string]*dialState
+	muxP2P                sync.Mutex
+	seenTransactions      *inventorySet                    // Recently pooled or mined, to drop duplicates
+	relayTransactions     map[[32]byte]*TransactionRequest // Pool transactions we can send to peers
+	requestedTransactions map[[32]byte]time.Time           // Asked for with getdata
+	muxRelay              sync.Mutex
+	tlsConfig             *tls.Config // Client side of peer connections, nil for plain HTTP
+	dialFunc              DialFunc    // Nil for net.DialTimeout
+	contracts             map[string]*Contract
+	receipts              [][]*Receipt // Per block, per transaction
+	blooms                []*Bloom     // Per block, over the logs of its receipts
+	muxState              sync.RWMutex
+	syncProgress          SyncProgress
+	muxSync               sync.Mutex
 }
 
-func (bc *Blockchain) CreateBlock(nonce int, previousHash [32]byte) *Block {
-	b := NewBlock(nonce, previousHash, bc.transactionPool)
+// CreateBlock assembles our coinbase and the final transactions of the
+// pool into the next block.
+func (bc *Blockchain) CreateBlock(timestamp int64, nonce int, previousHash [32]byte) *Block {
+	transactions, pending := bc.splitTransactionPool()
+	transactions = append([]*Transaction{bc.coinbase()}, transactions...)
+	b := NewBlock(timestamp, nonce, previousHash, transactions)
 	bc.chain = append(bc.chain, b)
-	bc.transactionPool = []*Transaction{}
-	for _, n := range bc.neighbors {
-		endPoint := fmt.Sprintf("http://%s/transactions", n)
-		client := &http.Client{}
-		req, _ := http.NewRequest("DELETE", endPoint, nil)
-		resp, _ := client.Do(req)
-		log.Printf("%v", resp)
-	}
+	bc.transactionPool = pending
+	bc.connectBlock(b)
+	bc.pruneRelay()
 	return b
 }
 
+// Hash is the hash of the block header, which commits to the
+// transactions through their merkle root.
 func (b *Block) Hash() [32]byte {
-	m, _ := json.Marshal(b)         // struct -> json
-	return sha256.Sum256([]byte(m)) // json -> struct
+	return b.Header().Hash()
 }
 
 // MarshalJSON converts Block to json
@@ -125,28 +167,64 @@ func (b *Block) UnmarshalJSON(data []byte) error {
 	if err := json.Unmarshal(data, &v); err != nil {
 		return err
 	}
-	ph, _ := hex.DecodeString(*v.PreviousHash)
-	copy(b.previousHash[:], ph[:32])
+	ph, err := hex.DecodeString(previousHash)
+	if err != nil || len(ph) != 32 {
+		return fmt.Errorf("invalid previous_hash")
+	}
+	for _, t := range b.transactions {
+		if t == nil {
+			return fmt.Errorf("null transaction")
+		}
+	}
+	copy(b.previousHash[:], ph)
 	return nil
 }
 
 func NewBlockchain(blockchainAddress string, port uint16) *Blockchain {
-	b := &Block{}
+	return NewBlockchainWithSpec(blockchainAddress, port, DefaultChainSpec())
+}
+
+// NewBlockchainWithSpec starts a chain of the network described by spec.
+func NewBlockchainWithSpec(blockchainAddress string, port uint16, spec *ChainSpec) *Blockchain {
 	bc := new(Blockchain)
 	bc.blockchainAddress = blockchainAddress
-	bc.CreateBlock(0, b.Hash())
+	bc.spec = spec
+	bc.clock = time.Now
+	bc.contracts = make(map[string]*Contract)
+	bc.seenTransactions = newInventorySet(MAX_SEEN_TRANSACTIONS)
+	bc.relayTransactions = make(map[[32]byte]*TransactionRequest)
+	bc.requestedTransactions = make(map[[32]byte]time.Time)
+	bc.orphans = newOrphanPool(MAX_ORPHAN_BLOCKS)
+	genesis := spec.Genesis.Block()
+	bc.chain = []*Block{genesis}
+	bc.connectBlock(genesis)
+	bc.host = utils.GetHost()
 	bc.port = port
+	bc.addressBook = NewAddressBook("")
+	bc.SetIdentityKey(NewIdentityKey())
+	bc.trustedNodes = make(map[string]string)
+	bc.adminKeys = make(map[string]string)
+	bc.seenRequests = newInventorySet(MAX_SEEN_REQUESTS)
+	bc.peerInfo = make(map[string]*PeerInfo)
+	bc.peerManager = NewPeerManager()
+	bc.p2pPeers = make(map[string]*Peer)
+	bc.dials = make(map[string]*dialState)
 	return bc
 }
 
+// SetNeighbors picks the peers to talk to from the seeds and the address
+// book, falling back to scanning the local port range when neither
+// knows of any peer.
 func (bc *Blockchain) SetNeighbors() {
-	bc.neighbors = utils.FindNeighbors(
-		// utils.GetHost(), bc.port,
-		"127.0.0.1", bc.port,
-		NEIGHBOR_IP_RANGE_START, NEIGHBOR_IP_RANGE_END,
-		BLOCKCHAIN_PORT_RANGE_START, BLOCKCHAIN_PORT_RANGE_END,
-	)
-	log.Printf("%s", utils.GetHost())
+	if len(bc.seeds) == 0 && len(bc.addressBook.Addresses()) == 0 {
+		bc.neighbors = bc.scanNeighbors()
+		for _, n := range bc.neighbors {
+			bc.addressBook.MarkGood(n)
+		}
+	} else {
+		bc.neighbors = bc.discoverNeighbors()
+	}
+	log.Printf("%s", bc.Address())
 	log.Printf("%v", bc.neighbors)
 }
 
@@ -154,7 +232,7 @@ func (bc *Blockchain) MarshalJSON() ([]byte, error) {
 	return json.Marshal(struct {
 		Blocks []*Block `json:"chain"`
 	}{
-		Blocks: bc.chain,
+		Blocks: bc.Chain(),
 	})
 }
 
@@ -184,7 +262,8 @@ func (bc *Blockchain) Print() {
 
 func (bc *Blockchain) Run() {
 	bc.StartSyncNeighbors()
-	bc.ResolveConflicts()
+	bc.StartP2P()
+	bc.resolveConflicts(true)
 	bc.StartMining()
 }
 
@@ -203,32 +282,171 @@ type Transaction struct {
 	senderBlockchainAddress    string
 	recipientBlockchainAddress string
 	value                      float32
+	lockTime                   int64
+	script                     []byte   // Locking script of a script address sender
+	witness                    [][]byte // Data the script is run on
+	data                       []byte   // Contract code for deploys, call input for calls
+	gasLimit                   uint64
+	gasPrice                   float32
 }
 
-func NewTransaction(sender string, recipient string, value float32) *Transaction {
+func NewTransaction(sender string, recipient string, value float32, lockTime int64) *Transaction {
 	t := new(Transaction)
 	t.senderBlockchainAddress = sender
 	t.recipientBlockchainAddress = recipient
 	t.value = value
+	t.lockTime = lockTime
+	return t
+}
+
+// NewScriptTransaction spends from the script address of script.
+func NewScriptTransaction(recipient string, value float32, lockTime int64, script []byte, witness [][]byte) *Transaction {
+	t := NewTransaction(ScriptAddress(script), recipient, value, lockTime)
+	t.script = script
+	t.witness = witness
 	return t
 }
 
+// NewContractTransaction deploys data as a contract when recipient is
+// empty and calls the contract at recipient with input data otherwise.
+func NewContractTransaction(sender string, recipient string, value float32, data []byte, gasLimit uint64, gasPrice float32) *Transaction {
+	t := NewTransaction(sender, recipient, value, 0)
+	t.data = data
+	t.gasLimit = gasLimit
+	t.gasPrice = gasPrice
+	return t
+}
+
+func (t *Transaction) SenderBlockchainAddress() string {
+	return t.senderBlockchainAddress
+}
+
+func (t *Transaction) RecipientBlockchainAddress() string {
+	return t.recipientBlockchainAddress
+}
+
+func (t *Transaction) Value() float32 {
+	return t.value
+}
+
+func (t *Transaction) LockTime() int64 {
+	return t.lockTime
+}
+
+func (t *Transaction) Script() []byte {
+	return t.script
+}
+
+func (t *Transaction) Witness() [][]byte {
+	return t.witness
+}
+
+func (t *Transaction) Data() []byte {
+	return t.data
+}
+
+func (t *Transaction) GasLimit() uint64 {
+	return t.gasLimit
+}
+
+func (t *Transaction) GasPrice() float32 {
+	return t.gasPrice
+}
+
+// MaxFee is the most t can pay for gas.
+func (t *Transaction) MaxFee() float32 {
+	return float32(t.gasLimit) * t.gasPrice
+}
+
+func (t *Transaction) Hash() [32]byte {
+	m, _ := json.Marshal(t)
+	return sha256.Sum256(m)
+}
+
+// SigHash is the digest signatures commit to. It covers the same fields
+// wallet.Transaction signs, so script witnesses and plain signatures are
+// produced the same way.
+func (t *Transaction) SigHash() [32]byte {
+	m, _ := json.Marshal(struct {
+		Sender    string  `json:"sender_blockchain_address"`
+		Recipient string  `json:"recipient_blockchain_address"`
+		Value     float32 `json:"value"`
+		LockTime  int64   `json:"lock_time"`
+		Data      string  `json:"data,omitempty"`
+		GasLimit  uint64  `json:"gas_limit,omitempty"`
+		GasPrice  float32 `json:"gas_price,omitempty"`
+	}{
+		Sender:    t.senderBlockchainAddress,
+		Recipient: t.recipientBlockchainAddress,
+		Value:     t.value,
+		LockTime:  t.lockTime,
+		Data:      hex.EncodeToString(t.data),
+		GasLimit:  t.gasLimit,
+		GasPrice:  t.gasPrice,
+	})
+	return sha256.Sum256(m)
+}
+
+func (t *Transaction) copy() *Transaction {
+	c := NewTransaction(t.senderBlockchainAddress, t.recipientBlockchainAddress, t.value, t.lockTime)
+	c.script = t.script
+	c.witness = t.witness
+	c.data = t.data
+	c.gasLimit = t.gasLimit
+	c.gasPrice = t.gasPrice
+	return c
+}
+
+// IsFinal reports whether t may be mined in the block at blockHeight.
+// Time locks are compared against the timestamp of the previous block
+// (blockTime, in nanoseconds) so that every node reaches the same answer.
+func (t *Transaction) IsFinal(blockHeight int, blockTime int64) bool {
+	if t.lockTime == 0 {
+		return true
+	}
+	if t.lockTime < LOCKTIME_THRESHOLD {
+		return t.lockTime <= int64(blockHeight)
+	}
+	return t.lockTime <= blockTime/int64(time.Second)
+}
+
 func (t *Transaction) Print() {
 	fmt.Printf("%s\n", strings.Repeat("-", 40))
 	fmt.Printf("sender_blockchain_address                %s\n", t.senderBlockchainAddress)
 	fmt.Printf("recipient_blockchain_address             %s\n", t.recipientBlockchainAddress)
 	fmt.Printf("value                                    %.1f\n", t.value)
+	fmt.Printf("lock_time                                %d\n", t.lockTime)
+	if t.script != nil {
+		fmt.Printf("script                                   %s\n", DisassembleScript(t.script))
+	}
+	if t.gasLimit > 0 {
+		fmt.Printf("data                                     %x\n", t.data)
+		fmt.Printf("gas_limit                                %d\n", t.gasLimit)
+		fmt.Printf("gas_price                                %.6f\n", t.gasPrice)
+	}
 }
 
 func (t *Transaction) MarshalJSON() ([]byte, error) {
 	return json.Marshal(struct {
-		Sender    string  `json:"sender_blockchain_address"`    // Covert to capital
-		Recipient string  `json:"recipient_blockchain_address"` // Covert to capital
-		Value     float32 `json:"value"`                        // Covert to capital
+		Sender    string   `json:"sender_blockchain_address"`    // Covert to capital
+		Recipient string   `json:"recipient_blockchain_address"` // Covert to capital
+		Value     float32  `json:"value"`                        // Covert to capital
+		LockTime  int64    `json:"lock_time"`                    // Covert to capital
+		Script    string   `json:"script,omitempty"`             // Covert to capital
+		Witness   []string `json:"witness,omitempty"`            // Covert to capital
+		Data      string   `json:"data,omitempty"`               // Covert to capital
+		GasLimit  uint64   `json:"gas_limit,omitempty"`          // Covert to capital
+		GasPrice  float32  `json:"gas_price,omitempty"`          // Covert to capital
 	}{
 		Sender:    t.senderBlockchainAddress,
 		Recipient: t.recipientBlockchainAddress,
 		Value:     t.value,
+		LockTime:  t.lockTime,
+		Script:    hex.EncodeToString(t.script),
+		Witness:   encodeWitness(t.witness),
+		Data:      hex.EncodeToString(t.data),
+		GasLimit:  t.gasLimit,
+		GasPrice:  t.gasPrice,
 	})
 }
 
@@ -237,98 +455,364 @@ func (t *Transaction) UnmarshalJSON(data []byte) error {
 		Sender    *string  `json:"sender_blockchain_address"`
 		Recipient *string  `json:"recipient_blockchain_address"`
 		Value     *float32 `json:"value"`
+		LockTime  *int64   `json:"lock_time"`
+		Script    string   `json:"script"`
+		Witness   []string `json:"witness"`
+		Data      string   `json:"data"`
+		GasLimit  *uint64  `json:"gas_limit"`
+		GasPrice  *float32 `json:"gas_price"`
 	}{
 		Sender:    &t.senderBlockchainAddress,
 		Recipient: &t.recipientBlockchainAddress,
 		Value:     &t.value,
+		LockTime:  &t.lockTime,
+		GasLimit:  &t.gasLimit,
+		GasPrice:  &t.gasPrice,
 	}
 	if err := json.Unmarshal(data, &v); err != nil {
 		return err
 	}
+	if v.Script != "" {
+		script, err := hex.DecodeString(v.Script)
+		if err != nil {
+			return err
+		}
+		t.script = script
+	}
+	witness, err := decodeWitness(v.Witness)
+	if err != nil {
+		return err
+	}
+	t.witness = witness
+	if v.Data != "" {
+		d, err := hex.DecodeString(v.Data)
+		if err != nil {
+			return err
+		}
+		t.data = d
+	}
 	return nil
 }
 
-func (bc *Blockchain) CreateTransaction(sender string, recipient string, value float32, senderPublicKey *ecdsa.PublicKey, s *utils.Signature) bool {
-	isTransacted := bc.AddTransaction(sender, recipient, value, senderPublicKey, s)
-	if isTransacted {
-		for _, n := range bc.neighbors {
-			publicKeyStr := fmt.Sprintf("%064x%064x", senderPublicKey.X.Bytes(), senderPublicKey.Y.Bytes())
-			signatureStr := s.String()
-			bt := &TransactionRequest{&sender, &recipient, &publicKeyStr, &value, &signatureStr}
-			m, _ := json.Marshal(bt)
-			buf := bytes.NewBuffer(m)
-			endPoint := fmt.Sprintf("http://%s/transactions", n)
-			client := &http.Client{}
-			req, _ := http.NewRequest("PUT", endPoint, buf)
-			resp, _ := client.Do(req)
-			log.Printf("%v", resp)
+func encodeWitness(witness [][]byte) []string {
+	if witness == nil {
+		return nil
+	}
+	s := make([]string, len(witness))
+	for i, w := range witness {
+		s[i] = hex.EncodeToString(w)
+	}
+	return s
+}
+
+func decodeWitness(s []string) ([][]byte, error) {
+	if s == nil {
+		return nil, nil
+	}
+	witness := make([][]byte, len(s))
+	for i, w := range s {
+		b, err := hex.DecodeString(w)
+		if err != nil {
+			return nil, err
 		}
+		witness[i] = b
+	}
+	return witness, nil
+}
+
+func (bc *Blockchain) CreateTransaction(sender string, recipient string, value float32, lockTime int64, senderPublicKey *ecdsa.PublicKey, s *utils.Signature) bool {
+	isTransacted := bc.AddTransaction(sender, recipient, value, lockTime, senderPublicKey, s)
+	if isTransacted {
+		publicKeyStr := fmt.Sprintf("%064x%064x", senderPublicKey.X.Bytes(), senderPublicKey.Y.Bytes())
+		signatureStr := s.String()
+		bc.broadcastTransaction(&TransactionRequest{
+			SenderBlockchainAddress:    &sender,
+			RecipientBlockchainAddress: &recipient,
+			SenderPublicKey:            &publicKeyStr,
+			Value:                      &value,
+			Signature:                  &signatureStr,
+			LockTime:                   &lockTime,
+		})
+	}
+
+	return isTransacted
+}
+
+// CreateScriptTransaction adds a spend from a script address to the pool
+// and forwards it to the neighbors.
+func (bc *Blockchain) CreateScriptTransaction(recipient string, value float32, lockTime int64, script []byte, witness [][]byte) bool {
+	isTransacted := bc.AddScriptTransaction(recipient, value, lockTime, script, witness)
+	if isTransacted {
+		sender := ScriptAddress(script)
+		scriptStr := hex.EncodeToString(script)
+		witnessStr := encodeWitness(witness)
+		bc.broadcastTransaction(&TransactionRequest{
+			SenderBlockchainAddress:    &sender,
+			RecipientBlockchainAddress: &recipient,
+			Value:                      &value,
+			LockTime:                   &lockTime,
+			Script:                     &scriptStr,
+			Witness:                    &witnessStr,
+		})
+	}
+
+	return isTransacted
+}
+
+// CreateContractTransaction adds a contract deploy or call to the pool
+// and forwards it to the neighbors.
+func (bc *Blockchain) CreateContractTransaction(sender string, recipient string, value float32, data []byte, gasLimit uint64, gasPrice float32, senderPublicKey *ecdsa.PublicKey, s *utils.Signature) bool {
+	isTransacted := bc.AddContractTransaction(sender, recipient, value, data, gasLimit, gasPrice, senderPublicKey, s)
+	if isTransacted {
+		publicKeyStr := fmt.Sprintf("%064x%064x", senderPublicKey.X.Bytes(), senderPublicKey.Y.Bytes())
+		signatureStr := s.String()
+		dataStr := hex.EncodeToString(data)
+		bc.broadcastTransaction(&TransactionRequest{
+			SenderBlockchainAddress:    &sender,
+			RecipientBlockchainAddress: &recipient,
+			SenderPublicKey:            &publicKeyStr,
+			Value:                      &value,
+			Signature:                  &signatureStr,
+			Data:                       &dataStr,
+			GasLimit:                   &gasLimit,
+			GasPrice:                   &gasPrice,
+		})
 	}
 
 	return isTransacted
 }
 
+func (bc *Blockchain) broadcastTransaction(bt *TransactionRequest) {
+	bc.relayTransaction(bt)
+}
+
+// AddTransactionRequest adds a transaction received from a neighbor to
+// the pool, whichever kind it is, and relays it to the other peers.
+func (bc *Blockchain) AddTransactionRequest(t *TransactionRequest) bool {
+	if !t.Validate() {
+		log.Println("ERROR: missing field(s)")
+		return false
+	}
+	var isAdded bool
+	if t.IsScriptSpend() {
+		script, witness, err := t.ScriptAndWitness()
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			return false
+		}
+		isAdded = bc.AddScriptTransaction(*t.RecipientBlockchainAddress, *t.Value, t.LockTimeValue(), script, witness)
+	} else if t.IsContractTransaction() {
+		data, err := t.ContractData()
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			return false
+		}
+		publicKey := utils.PublicKeyFromString(*t.SenderPublicKey)
+		signature := utils.SignatureFromString(*t.Signature)
+		isAdded = bc.AddContractTransaction(*t.SenderBlockchainAddress, *t.RecipientBlockchainAddress, *t.Value, data, *t.GasLimit, t.GasPriceValue(), publicKey, signature)
+	} else {
+		publicKey := utils.PublicKeyFromString(*t.SenderPublicKey)
+		signature := utils.SignatureFromString(*t.Signature)
+		isAdded = bc.AddTransaction(*t.SenderBlockchainAddress, *t.RecipientBlockchainAddress, *t.Value, t.LockTimeValue(), publicKey, signature)
+	}
+	if isAdded {
+		bc.relayTransaction(t)
+	}
+	return isAdded
+}
+
+// VerifyTransactionRequest checks what does not depend on the chain:
+// the request describes a transaction signed by its sender, or whose
+// script accepts its witness. AddTransactionRequest also refuses
+// duplicates and spends this node cannot cover yet, which honest peers
+// send when they race each other; only requests failing this are
+// misbehavior.
+func (bc *Blockchain) VerifyTransactionRequest(tr *TransactionRequest) bool {
+	t, err := tr.Transaction()
+	if err != nil || t.IsCoinbase() {
+		return false
+	}
+	if tr.IsScriptSpend() {
+		return bc.VerifyTransactionScript(t)
+	}
+	if IsScriptAddress(t.senderBlockchainAddress) {
+		return false
+	}
+	publicKey := utils.PublicKeyFromString(*tr.SenderPublicKey)
+	signature := utils.SignatureFromString(*tr.Signature)
+	return bc.VerifyTransactionSignature(publicKey, signature, t)
+}
+
 func (bc *Blockchain) TransactionPool() []*Transaction {
-	return bc.transactionPool
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	return append([]*Transaction{}, bc.transactionPool...)
 }
 
 func (bc *Blockchain) ClearTransactionPool() {
-	bc.transactionPool = bc.transactionPool[:0]
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	bc.transactionPool = nil
+	bc.pruneRelay()
 }
-func (bc *Blockchain) AddTransaction(sender string, recipient string, value float32, senderPublicKey *ecdsa.PublicKey, s *utils.Signature) bool {
-	t := NewTransaction(sender, recipient, value)
 
-	if sender == MINING_SENDER {
-		bc.transactionPool = append(bc.transactionPool, t)
-		return true
+// AddTransaction puts a verified transaction into the pool. Transactions
+// whose lock time has not been reached yet are held there until they
+// become final; see splitTransactionPool.
+func (bc *Blockchain) AddTransaction(sender string, recipient string, value float32, lockTime int64, senderPublicKey *ecdsa.PublicKey, s *utils.Signature) bool {
+	t := NewTransaction(sender, recipient, value, lockTime)
+	return bc.addSignedTransaction(t, senderPublicKey, s)
+}
+
+// AddContractTransaction puts a verified contract deploy or call into the pool.
+func (bc *Blockchain) AddContractTransaction(sender string, recipient string, value float32, data []byte, gasLimit uint64, gasPrice float32, senderPublicKey *ecdsa.PublicKey, s *utils.Signature) bool {
+	t := NewContractTransaction(sender, recipient, value, data, gasLimit, gasPrice)
+	if !t.IsContractTransaction() {
+		log.Println("ERROR: Not a contract transaction")
+		return false
+	}
+	if gasLimit < CONTRACT_BASE_GAS || gasLimit > BLOCK_GAS_LIMIT || gasPrice < 0 {
+		log.Println("ERROR: Invalid gas limit or price")
+		return false
+	}
+	if t.IsContractDeploy() && len(data) > VM_MAX_CODE_SIZE {
+		log.Println("ERROR: Contract code too large")
+		return false
+	}
+	return bc.addSignedTransaction(t, senderPublicKey, s)
+}
+
+func (bc *Blockchain) addSignedTransaction(t *Transaction, senderPublicKey *ecdsa.PublicKey, s *utils.Signature) bool {
+	sender := t.senderBlockchainAddress
+
+	if t.IsCoinbase() {
+		log.Println("ERROR: Coinbase transaction outside of a block")
+		return false
+	}
+
+	if IsScriptAddress(sender) {
+		log.Println("ERROR: Script address requires a script spend")
+		return false
+	}
+
+	if t.gasLimit == 0 && IsContractAddress(t.recipientBlockchainAddress) {
+		log.Println("ERROR: Contract call without gas")
+		return false
 	}
 
 	if bc.VerifyTransactionSignature(senderPublicKey, s, t) {
-		if bc.CalculateTotalAmount(sender) < value {
+		if spendable, _ := bc.CalculateAmounts(sender); spendable < t.value+t.MaxFee() {
 			log.Println("ERROR: Not enough balance in a wallet")
 			return false
 		}
-		bc.transactionPool = append(bc.transactionPool, t)
-		return true
+		return bc.addToPool(t)
 	} else {
 		log.Println("ERROR: Verify Transaction")
 	}
 	return false
 }
 
+// AddScriptTransaction puts a spend from the script address of script
+// into the pool once the script accepts witness.
+func (bc *Blockchain) AddScriptTransaction(recipient string, value float32, lockTime int64, script []byte, witness [][]byte) bool {
+	t := NewScriptTransaction(recipient, value, lockTime, script, witness)
+
+	if IsContractAddress(recipient) {
+		log.Println("ERROR: Contract call without gas")
+		return false
+	}
+	if !bc.VerifyTransactionScript(t) {
+		log.Println("ERROR: Verify Transaction Script")
+		return false
+	}
+	if spendable, _ := bc.CalculateAmounts(t.senderBlockchainAddress); spendable < value {
+		log.Println("ERROR: Not enough balance in a wallet")
+		return false
+	}
+	return bc.addToPool(t)
+}
+
 func (bc *Blockchain) VerifyTransactionSignature(senderPublicKey *ecdsa.PublicKey, s *utils.Signature, t *Transaction) bool {
-	m, _ := json.Marshal(t)
-	h := sha256.Sum256([]byte(m))
+	h := t.SigHash()
 	return ecdsa.Verify(senderPublicKey, h[:], s.R, s.S)
 }
 
+// VerifyTransactionScript checks that t carries the script its sender
+// address was derived from and that the script accepts its witness.
+func (bc *Blockchain) VerifyTransactionScript(t *Transaction) bool {
+	if !IsScriptAddress(t.senderBlockchainAddress) || ScriptAddress(t.script) != t.senderBlockchainAddress {
+		return false
+	}
+	ctx := &ScriptContext{SigHash: t.SigHash(), LockTime: t.lockTime}
+	if err := RunScript(t.script, t.witness, ctx); err != nil {
+		log.Printf("ERROR: script: %v", err)
+		return false
+	}
+	return true
+}
+
+// CopyTransactionPool copies the transactions that can go into the next block.
 func (bc *Blockchain) CopyTransactionPool() []*Transaction {
 	transactions := make([]*Transaction, 0)
-	for _, t := range bc.transactionPool {
-		transactions = append(transactions,
-			NewTransaction(t.senderBlockchainAddress,
-				t.recipientBlockchainAddress,
-				t.value))
+	final, _ := bc.splitTransactionPool()
+	for _, t := range final {
+		transactions = append(transactions, t.copy())
 	}
 	return transactions
 }
 
-func (bc *Blockchain) ValidProof(nonce int, previousHash [32]byte, transactions []*Transaction, difficulty int) bool {
+// splitTransactionPool separates the pool into transactions that are final
+// for the next block and those whose lock time is still in the future or
+// that no longer fit under BLOCK_GAS_LIMIT. Transactions their sender
+// cannot cover along with the earlier ones are in neither.
+func (bc *Blockchain) splitTransactionPool() (final []*Transaction, pending []*Transaction) {
+	final = []*Transaction{}
+	pending = []*Transaction{}
+	height := len(bc.chain)
+	var blockTime int64
+	if height > 0 {
+		blockTime = bc.LastBlock().timestamp
+	}
+	bs := bc.newBalanceSheet(bc.chain)
+	spent := make(map[string]float32)
+	var gas uint64
+	for _, t := range bc.transactionPool {
+		if !t.IsFinal(height, blockTime) || gas+t.gasLimit > BLOCK_GAS_LIMIT {
+			pending = append(pending, t)
+			continue
+		}
+		sender := t.senderBlockchainAddress
+		cost := t.value + t.MaxFee()
+		if spendable, _ := bs.amounts(sender, height); spendable < spent[sender]+cost {
+			log.Printf("ERROR: %s cannot cover a pooled transaction", sender)
+			continue
+		}
+		spent[sender] += cost
+		final = append(final, t)
+		gas += t.gasLimit
+	}
+	return final, pending
+}
+
+// ValidProof checks the proof of work of a header, so that headers can
+// be verified before their transactions are downloaded.
+func (bc *Blockchain) ValidProof(h *BlockHeader, difficulty int) bool {
 	zeros := strings.Repeat("0", difficulty)
-	guessBlock := Block{0, nonce, previousHash, transactions}
-	guessHashStr := fmt.Sprintf("%x", guessBlock.Hash())
+	guessHashStr := fmt.Sprintf("%x", h.Hash())
 	return guessHashStr[:difficulty] == zeros
 }
 
-func (bc *Blockchain) ProofOfWork() int {
-	transactions := bc.CopyTransactionPool()
-	previousHash := bc.LastBlock().Hash()
-	nonce := 0
+func (bc *Blockchain) ProofOfWork(timestamp int64) int {
+	h := &BlockHeader{
+		timestamp:        timestamp,
+		previousHash:     bc.LastBlock().Hash(),
+		transactionsRoot: TransactionsRoot(append([]*Transaction{bc.coinbase()}, bc.CopyTransactionPool()...)),
+	}
 	// Repeat until ValidProof returns true(find answer)
-	for !bc.ValidProof(nonce, previousHash, transactions, MINING_DIFFICULTY) {
-		nonce += 1
+	for !bc.ValidProof(h, bc.spec.Difficulty) {
+		h.nonce += 1
 	}
-	return nonce
+	return h.nonce
 }
 
 func (bc *Blockchain) Mining() bool {
@@ -341,99 +825,294 @@ func (bc *Blockchain) Mining() bool {
 		}
 	*/
 
-	bc.AddTransaction(MINING_SENDER, bc.blockchainAddress, MINING_REWARD, nil, nil)
-	nonce := bc.ProofOfWork()
+	timestamp := bc.nextTimestamp()
+	nonce := bc.ProofOfWork(timestamp)
 	previousHash := bc.LastBlock().Hash()
-	bc.CreateBlock(nonce, previousHash)
+	b := bc.CreateBlock(timestamp, nonce, previousHash)
 	log.Println("action=mining, status=success")
 
-	for _, n := range bc.neighbors {
-		endPoint := fmt.Sprintf("http://%s/consensus", n)
-		client := &http.Client{}
-		req, _ := http.NewRequest("PUT", endPoint, nil)
-		resp, _ := client.Do(req)
-		log.Printf("%v", resp)
-	}
+	bc.broadcastBlock(b, "")
 	return true
 }
 
 func (bc *Blockchain) StartMining() {
 	bc.Mining()
-	_ = time.AfterFunc(time.Second*MINING_TIMER_SEC, bc.StartMining)
-}
-func (bc *Blockchain) CalculateTotalAmount(blockchainAddress string) (totalAmount float32) {
-	for _, b := range bc.chain {
-		for _, t := range b.transactions {
-			value := t.value
-			if blockchainAddress == t.recipientBlockchainAddress {
-				totalAmount += value
+	_ = time.AfterFunc(time.Second*time.Duration(bc.spec.BlockIntervalSec), bc.StartMining)
+}
+
+// CalculateTotalAmount sums the transfers of blockchainAddress, mining
+// rewards still immature included.
+func (bc *Blockchain) CalculateTotalAmount(blockchainAddress string) float32 {
+	spendable, immature := bc.CalculateAmounts(blockchainAddress)
+	return spendable + immature
+}
+
+// CalculateAmounts splits the balance of blockchainAddress into what the
+// next block can spend and the mining rewards that are not mature yet.
+func (bc *Blockchain) CalculateAmounts(blockchainAddress string) (spendable float32, immature float32) {
+	bc.muxState.RLock()
+	defer bc.muxState.RUnlock()
+	return bc.amounts(bc.chain, blockchainAddress, len(bc.chain))
+}
+
+// amounts sums the transfers of blockchainAddress over chain, splitting
+// off the mining rewards that blocks from height next on cannot spend
+// yet. Contract transactions only move their value when they succeeded,
+// and always pay their gas fee to the miner of the block. Blocks of
+// chain we have not connected have no receipts; their transactions
+// count as successful and free.
+func (bc *Blockchain) amounts(chain []*Block, blockchainAddress string, next int) (spendable float32, immature float32) {
+	for height, b := range chain {
+		bc.transfers(height, b, func(address string, value float32, reward bool) {
+			if address != blockchainAddress {
+				return
+			}
+			if reward && !bc.mature(height, next) {
+				immature += value
+			} else {
+				spendable += value
+			}
+		})
+	}
+	return spendable, immature
+}
+
+// transfers calls credit with each amount b, the block at height, moves;
+// debits are negative. Rewards are the values of coinbases.
+func (bc *Blockchain) transfers(height int, b *Block, credit func(address string, value float32, reward bool)) {
+	connected := height < len(bc.chain) && bc.chain[height] == b
+	miner := b.minerAddress()
+	for i, t := range b.transactions {
+		value := t.value
+		recipient := t.recipientBlockchainAddress
+		var fee float32
+		if r := bc.receipt(height, i); connected && r != nil {
+			if !r.success {
+				value = 0
 			}
-			if blockchainAddress == t.senderBlockchainAddress {
-				totalAmount -= value
+			if r.contractAddress != "" {
+				recipient = r.contractAddress
 			}
+			fee = r.fee
+		}
+		credit(recipient, value, t.IsCoinbase())
+		credit(t.senderBlockchainAddress, -(value + fee), false)
+		credit(miner, fee, false)
+	}
+}
+
+// balanceSheet carries the balances of a chain forward block by block,
+// so that validating a chain does not sum it again for every sender.
+type balanceSheet struct {
+	bc      *Blockchain
+	totals  map[string]float32   // Transfers, mining rewards included
+	rewards []map[string]float32 // Mining rewards of the block at each height
+}
+
+func (bc *Blockchain) newBalanceSheet(chain []*Block) *balanceSheet {
+	bs := &balanceSheet{bc: bc, totals: make(map[string]float32)}
+	for _, b := range chain {
+		bs.add(b)
+	}
+	return bs
+}
+
+// add carries bs over b, the block following its chain.
+func (bs *balanceSheet) add(b *Block) {
+	bs.bc.muxState.RLock()
+	defer bs.bc.muxState.RUnlock()
+	rewards := make(map[string]float32)
+	bs.bc.transfers(len(bs.rewards), b, func(address string, value float32, reward bool) {
+		bs.totals[address] += value
+		if reward {
+			rewards[address] += value
+		}
+	})
+	bs.rewards = append(bs.rewards, rewards)
+}
+
+// amounts is what Blockchain.amounts returns over the chain of bs.
+func (bs *balanceSheet) amounts(blockchainAddress string, next int) (spendable float32, immature float32) {
+	for height := len(bs.rewards) - 1; height > 0 && !bs.bc.mature(height, next); height-- {
+		immature += bs.rewards[height][blockchainAddress]
+	}
+	return bs.totals[blockchainAddress] - immature, immature
+}
+
+// mature tells whether the mining reward of the block at height can be
+// spent by the block at next. Genesis allocations always can.
+func (bc *Blockchain) mature(height int, next int) bool {
+	return height == 0 || next-height >= bc.spec.CoinbaseMaturity
+}
+
+// validSpends checks that the senders of b, the block following the
+// chain of bs, can cover what they spend without the mining rewards that
+// are immature at its height. Fees count in full, as when transactions
+// enter the pool.
+func (bc *Blockchain) validSpends(bs *balanceSheet, b *Block) bool {
+	spent := make(map[string]float32)
+	for _, t := range b.transactions {
+		if !t.IsCoinbase() {
+			spent[t.senderBlockchainAddress] += t.value + t.MaxFee()
+		}
+	}
+	for sender, value := range spent {
+		if spendable, _ := bs.amounts(sender, len(bs.rewards)); spendable < value {
+			log.Printf("ERROR: %s spends more than its balance", sender)
+			return false
 		}
 	}
-	return totalAmount
+	return true
 }
 
+// ValidChain checks the blocks of chain after genesis.
 func (bc *Blockchain) ValidChain(chain []*Block) bool {
-	preBlock := chain[0]
+	return bc.validChain(chain, false)
+}
+
+// validChain checks the blocks of chain after genesis. With assumeValid,
+// which only the initial sync sets, scripts are not run up to the
+// assume-valid block when chain holds it.
+func (bc *Blockchain) validChain(chain []*Block, assumeValid bool) bool {
+	assumed := -1
+	if assumeValid {
+		assumed = bc.assumeValidHeight(chain)
+	}
+	if assumed > 0 {
+		log.Printf("action=validate_chain, status=assume_valid, height=%d", assumed)
+	}
+	bs := bc.newBalanceSheet(chain[:1])
 	currentIndex := 1
 	for currentIndex < len(chain) {
 		b := chain[currentIndex]
-		if b.previousHash != preBlock.Hash() {
+		if !bc.validAfter(chain[:currentIndex], b, currentIndex > assumed, bs) {
+			return false
+		}
+		bs.add(b)
+		currentIndex += 1
+	}
+	return true
+}
+
+// validAfter checks b as the block following chain, whose blocks are
+// valid and carried by bs.
+func (bc *Blockchain) validAfter(chain []*Block, b *Block, checkScripts bool, bs *balanceSheet) bool {
+	height := len(chain)
+	return bc.matchesCheckpoint(height, b.Hash()) &&
+		bc.validBlock(b, chain[height-1], height, checkScripts) &&
+		bc.validTimestamp(chain, b) &&
+		bc.validSpends(bs, b)
+}
+
+func (bc *Blockchain) validBlock(b *Block, preBlock *Block, height int, checkScripts bool) bool {
+	if b.previousHash != preBlock.Hash() {
+		return false
+	}
+	if !bc.ValidProof(b.Header(), bc.spec.Difficulty) {
+		return false
+	}
+	if !b.validCoinbase() || b.coinbaseValue() > float64(bc.spec.BlockReward(height)) {
+		return false
+	}
+	var gas uint64
+	seen := make(map[[32]byte]bool)
+	for _, t := range b.transactions {
+		h := t.Hash()
+		if seen[h] {
 			return false
 		}
-		if !bc.ValidProof(b.Nonce(), b.PreviousHash(), b.Transactions(), MINING_DIFFICULTY) {
+		seen[h] = true
+		gas += t.gasLimit
+		if gas > BLOCK_GAS_LIMIT {
+			return false
+		}
+		if !t.IsFinal(height, preBlock.timestamp) {
+			return false
+		}
+		if checkScripts && IsScriptAddress(t.senderBlockchainAddress) && !bc.VerifyTransactionScript(t) {
 			return false
 		}
-		preBlock = b
-		currentIndex += 1
 	}
 	return true
 }
 
+// ResolveConflicts syncs to the longest valid chain among the neighbors.
+// Headers are fetched first and checked for proof of work; only then are
+// the missing blocks downloaded.
 func (bc *Blockchain) ResolveConflicts() bool {
-	var longestChain []*Block = nil
-	maxLength := len(bc.chain)
-
-	for _, n := range bc.neighbors {
-		endPoint := fmt.Sprintf("http://%s/chain", n)
-		resp, _ := http.Get(endPoint)
-		if resp.StatusCode == 200 {
-			var bcResp Blockchain
-			decoder := json.NewDecoder(resp.Body)
-			_ = decoder.Decode(&bcResp)
-
-			chain := bcResp.Chain()
-			if len(chain) > maxLength && bc.ValidChain(chain) {
-				maxLength = len(chain)
-				longestChain = chain
-			}
+	return bc.resolveConflicts(false)
+}
+
+// resolveConflicts is ResolveConflicts; assumeValid is set by the initial
+// sync only, see validChain.
+func (bc *Blockchain) resolveConflicts(assumeValid bool) bool {
+	bc.muxSync.Lock()
+	if bc.syncProgress.Syncing {
+		bc.muxSync.Unlock()
+		return false
+	}
+	bc.syncProgress = SyncProgress{Syncing: true, Height: bc.Height()}
+	bc.muxSync.Unlock()
+	defer bc.updateSync(func(p *SyncProgress) {
+		p.Syncing = false
+		p.Height = bc.Height()
+	})
+
+	neighbors := append([]string{}, bc.neighbors...)
+	var best *headerChain = nil
+	maxLength := bc.Height() + 1
+	for _, n := range neighbors {
+		bc.updateSync(func(p *SyncProgress) {
+			p.Peer = n
+		})
+		hc, ok := bc.fetchHeaders(n)
+		if ok && hc.length() > maxLength {
+			maxLength = hc.length()
+			best = hc
 		}
 	}
-	if longestChain != nil {
-		bc.chain = longestChain
-		log.Printf("Resolve conflicts replaced")
-		return true
+	if best != nil {
+		bc.updateSync(func(p *SyncProgress) {
+			p.Peer = best.peer
+			p.HeadersReceived = len(best.headers)
+			p.TargetHeight = best.length() - 1
+		})
+		if bc.syncTo(best, neighbors, assumeValid) {
+			log.Printf("Resolve conflicts replaced")
+			return true
+		}
 	}
 	log.Printf("Resolve conflicts not replaced")
 	return false
 }
 
 func (bc *Blockchain) Chain() []*Block {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
 	return bc.chain
 }
 
 type TransactionRequest struct {
-	SenderBlockchainAddress    *string  `json:"sender_blockchian_address"`
-	RecipientBlockchainAddress *string  `json:"recipient_blockchain_address"`
-	SenderPublicKey            *string  `json:"sender_public_key"`
-	Value                      *float32 `json:"value"`
-	Signature                  *string  `json:"signature"`
+	SenderBlockchainAddress    *string   `json:"sender_blockchian_address"`
+	RecipientBlockchainAddress *string   `json:"recipient_blockchain_address"`
+	SenderPublicKey            *string   `json:"sender_public_key"`
+	Value                      *float32  `json:"value"`
+	Signature                  *string   `json:"signature"`
+	LockTime                   *int64    `json:"lock_time"`
+	Script                     *string   `json:"script"`
+	Witness                    *[]string `json:"witness"`
+	Data                       *string   `json:"data"`
+	GasLimit                   *uint64   `json:"gas_limit"`
+	GasPrice                   *float32  `json:"gas_price"`
 }
 
 func (tr *TransactionRequest) Validate() bool {
+	if tr.Script != nil {
+		return tr.SenderBlockchainAddress != nil &&
+			tr.RecipientBlockchainAddress != nil &&
+			tr.Value != nil &&
+			tr.Witness != nil
+	}
 	if tr.SenderBlockchainAddress == nil ||
 		tr.RecipientBlockchainAddress == nil ||
 		tr.SenderPublicKey == nil ||
@@ -441,17 +1120,71 @@ func (tr *TransactionRequest) Validate() bool {
 		tr.Signature == nil {
 		return false
 	}
-	return true
+	// Keys and signatures are two hex encoded 32 byte numbers.
+	return len(*tr.SenderPublicKey) == 128 && len(*tr.Signature) == 128
+}
+
+// LockTimeValue returns the requested lock time, 0 when it was omitted.
+func (tr *TransactionRequest) LockTimeValue() int64 {
+	if tr.LockTime == nil {
+		return 0
+	}
+	return *tr.LockTime
+}
+
+// IsContractTransaction reports whether the request deploys or calls a contract.
+func (tr *TransactionRequest) IsContractTransaction() bool {
+	return tr.GasLimit != nil
+}
+
+// ContractData decodes the hex encoded contract code or call input.
+func (tr *TransactionRequest) ContractData() ([]byte, error) {
+	if tr.Data == nil {
+		return nil, nil
+	}
+	return hex.DecodeString(*tr.Data)
+}
+
+// GasPriceValue returns the requested gas price, 0 when it was omitted.
+func (tr *TransactionRequest) GasPriceValue() float32 {
+	if tr.GasPrice == nil {
+		return 0
+	}
+	return *tr.GasPrice
+}
+
+// IsScriptSpend reports whether the request spends from a script address.
+func (tr *TransactionRequest) IsScriptSpend() bool {
+	return tr.Script != nil
+}
+
+// ScriptAndWitness decodes the hex encoded script and witness.
+func (tr *TransactionRequest) ScriptAndWitness() ([]byte, [][]byte, error) {
+	script, err := hex.DecodeString(*tr.Script)
+	if err != nil {
+		return nil, nil, err
+	}
+	witness, err := decodeWitness(*tr.Witness)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ScriptAddress(script) != *tr.SenderBlockchainAddress {
+		return nil, nil, fmt.Errorf("script does not match sender address")
+	}
+	return script, witness, nil
 }
 
 type AmountResponse struct {
-	Amount float32 `json:"amount"`
+	Amount   float32 `json:"amount"`          // Spendable
+	Immature float32 `json:"immature_amount"` // Mining rewards not spendable yet
 }
 
 func (ar *AmountResponse) MarshalJSON() ([]byte, error) {
 	return json.Marshal(struct {
-		Amount float32 `json:"amount"`
+		Amount   float32 `json:"amount"`
+		Immature float32 `json:"immature_amount"`
 	}{
-		Amount: ar.Amount,
+		Amount:   ar.Amount,
+		Immature: ar.Immature,
 	})
 }
@@ -0,0 +1,147 @@
+package block
+
+import (
+	"testing"
+	"time"
+)
+
+// The balance sheet carried over a chain sums it as amounts does, and
+// keeps mining rewards immature for CoinbaseMaturity blocks.
+func TestBalanceSheet(t *testing.T) {
+	spec := DefaultChainSpec()
+	spec.Genesis.Allocations = map[string]float32{"alice": 10}
+	spec.CoinbaseMaturity = 3
+	bc := NewBlockchainWithSpec("miner", 0, spec)
+	chain := []*Block{bc.LastBlock()}
+	blocks := [][]*Transaction{
+		{newCoinbase("miner", 5), NewTransaction("alice", "bob", 2, 0)},
+		{newCoinbase("miner", 5), NewTransaction("bob", "carol", 1, 0)},
+		{newCoinbase("other", 5)},
+		{newCoinbase("miner", 5), NewTransaction("miner", "alice", 4, 0)},
+		{newCoinbase("other", 5)},
+	}
+	for i, txs := range blocks {
+		chain = append(chain, NewBlock(int64(i+1), 0, chain[len(chain)-1].Hash(), txs))
+	}
+
+	bs := bc.newBalanceSheet(chain)
+	for _, address := range []string{"alice", "bob", "carol", "miner", "other"} {
+		for next := len(chain); next < len(chain)+spec.CoinbaseMaturity+1; next++ {
+			wantSpendable, wantImmature := bc.amounts(chain, address, next)
+			spendable, immature := bs.amounts(address, next)
+			if spendable != wantSpendable || immature != wantImmature {
+				t.Errorf("%s at %d: %v spendable and %v immature, want %v and %v", address, next, spendable, immature, wantSpendable, wantImmature)
+			}
+		}
+	}
+
+	// miner has 6 mature and 5 immature coins.
+	spend := func(value float32) *Block {
+		return NewBlock(9, 0, chain[len(chain)-1].Hash(), []*Transaction{newCoinbase("other", 5), NewTransaction("miner", "bob", value, 0)})
+	}
+	if !bc.validSpends(bs, spend(6)) {
+		t.Fatal("spend of mature rewards refused")
+	}
+	if bc.validSpends(bs, spend(7)) {
+		t.Fatal("spend of immature rewards accepted")
+	}
+}
+
+// Repeating the last transactions of a block changes its merkle root, and
+// blocks with a transaction twice are invalid whatever their root.
+func TestDuplicateTransactions(t *testing.T) {
+	spec := DefaultChainSpec()
+	spec.Difficulty = 1
+	spec.Genesis.Allocations = map[string]float32{"alice": 10, "bob": 10}
+	bc := NewBlockchainWithSpec("miner", 0, spec)
+	a := NewTransaction("alice", "carol", 1, 0)
+	b := NewTransaction("bob", "carol", 1, 0)
+
+	honest := mineTestBlock(bc, bc.LastBlock(), a, b)
+	mutated := NewBlock(honest.timestamp, honest.nonce, honest.previousHash, append(honest.transactions, b))
+	if mutated.Hash() == honest.Hash() {
+		t.Fatal("block with a repeated transaction has the same hash")
+	}
+	for !bc.ValidProof(mutated.Header(), spec.Difficulty) {
+		mutated.nonce++
+	}
+	if bc.ValidChain([]*Block{bc.LastBlock(), mutated}) {
+		t.Fatal("block with a repeated transaction accepted")
+	}
+	if !bc.ValidChain([]*Block{bc.LastBlock(), honest}) {
+		t.Fatal("honest block refused")
+	}
+}
+
+// Blocks cannot overdraw an account, mining rewards or not, and miners
+// leave out what the pool holds beyond a balance.
+func TestOverdraw(t *testing.T) {
+	spec := DefaultChainSpec()
+	spec.Difficulty = 1
+	spec.Genesis.Allocations = map[string]float32{"alice": 10}
+	bc := NewBlockchainWithSpec("miner", 0, spec)
+	genesis := bc.LastBlock()
+
+	tests := []struct {
+		name         string
+		transactions []*Transaction
+		valid        bool
+	}{
+		{"whole balance", []*Transaction{NewTransaction("alice", "bob", 10, 0)}, true},
+		{"over the balance", []*Transaction{NewTransaction("alice", "bob", 11, 0)}, false},
+		{"over the balance in two", []*Transaction{NewTransaction("alice", "bob", 6, 0), NewTransaction("alice", "carol", 6, 0)}, false},
+		{"empty account", []*Transaction{NewTransaction("bob", "carol", 1, 0)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := mineTestBlock(bc, genesis, tt.transactions...)
+			if valid := bc.ValidChain([]*Block{genesis, b}); valid != tt.valid {
+				t.Fatalf("valid %v, want %v", valid, tt.valid)
+			}
+		})
+	}
+
+	bc.transactionPool = []*Transaction{NewTransaction("alice", "bob", 6, 0), NewTransaction("alice", "carol", 6, 0)}
+	if final := bc.CopyTransactionPool(); len(final) != 1 {
+		t.Fatalf("%d transactions for the next block, want 1", len(final))
+	}
+}
+
+// A transaction locked past the next block stays out of it, both when the
+// block is assembled from the pool and when a peer's block is checked.
+func TestLockTime(t *testing.T) {
+	spec := DefaultChainSpec()
+	spec.Difficulty = 1
+	spec.Genesis.Allocations = map[string]float32{"alice": 10}
+	bc := NewBlockchainWithSpec("miner", 0, spec)
+	genesis := bc.LastBlock()
+	now := genesis.timestamp / int64(time.Second)
+
+	tests := []struct {
+		name     string
+		lockTime int64
+		final    bool
+	}{
+		{"no lock", 0, true},
+		{"next height", 1, true},
+		{"future height", 2, false},
+		{"last block time", now, true},
+		{"future time", now + 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := NewTransaction("alice", "bob", 1, tt.lockTime)
+
+			bc.transactionPool = []*Transaction{tx}
+			final, pending := bc.splitTransactionPool()
+			if (len(final) == 1) != tt.final || (len(pending) == 1) == tt.final {
+				t.Errorf("%d final and %d pending, want final %v", len(final), len(pending), tt.final)
+			}
+
+			b := mineTestBlock(bc, genesis, tx)
+			if valid := bc.ValidChain([]*Block{genesis, b}); valid != tt.final {
+				t.Errorf("block valid %v, want %v", valid, tt.final)
+			}
+		})
+	}
+}
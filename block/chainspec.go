@@ -0,0 +1,129 @@
+package block
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+const (
+	GENESIS_TIMESTAMP = 1609459200000000000 // 2021-01-01 UTC, in unix nanoseconds
+	MAX_DIFFICULTY    = 64                  // Hex digits of a block hash
+	COINBASE_MATURITY = 10
+)
+
+// ChainSpec holds the parameters every node of a network has to agree on.
+// It is read from the file given with -chain_spec; fields the file leaves
+// out keep the values of DefaultChainSpec.
+//
+//	{
+//	  "network_id": "goblockchain-test",
+//	  "genesis": {
+//	    "timestamp": 1700000000000000000,
+//	    "allocations": {"1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2": 100}
+//	  },
+//	  "reward": {"initial": 50, "halving_interval": 210000, "max_supply": 21000000},
+//	  "difficulty": 3,
+//	  "coinbase_maturity": 10,
+//	  "max_future_drift_sec": 7200,
+//	  "block_interval_sec": 20,
+//	  "checkpoints": {"1000": "000a3f...", "2000": "0007c1..."},
+//	  "assume_valid": "0007c1..."
+//	}
+type ChainSpec struct {
+	NetworkID         string         `json:"network_id"`
+	Genesis           Genesis        `json:"genesis"`
+	Reward            RewardSchedule `json:"reward"`
+	Difficulty        int            `json:"difficulty"`           // Leading zero hex digits of block hashes
+	CoinbaseMaturity  int            `json:"coinbase_maturity"`    // Blocks before a mining reward can be spent
+	MaxFutureDriftSec int            `json:"max_future_drift_sec"` // How far ahead of a node's clock blocks may be
+	BlockIntervalSec  int            `json:"block_interval_sec"`   // Between two blocks mined by a node
+	Checkpoints       map[int]string `json:"checkpoints"`          // Hash (hex) of the block at each height
+	AssumeValid       string         `json:"assume_valid"`         // Hash of a block whose ancestors' scripts are not run on the initial sync
+}
+
+// RewardSchedule says what miners are paid per block; see
+// ChainSpec.BlockReward.
+type RewardSchedule struct {
+	Initial         float32 `json:"initial"`
+	HalvingInterval int     `json:"halving_interval"` // Blocks between halvings, 0 for none
+	TailEmission    float32 `json:"tail_emission"`    // Least reward once halved, 0 for none
+	MaxSupply       float32 `json:"max_supply"`       // Genesis allocations included, 0 for no cap
+}
+
+// DefaultChainSpec is the main network.
+func DefaultChainSpec() *ChainSpec {
+	return &ChainSpec{
+		NetworkID:         NETWORK_ID,
+		Genesis:           Genesis{Timestamp: GENESIS_TIMESTAMP, Allocations: map[string]float32{}},
+		Reward:            RewardSchedule{Initial: MINING_REWARD, HalvingInterval: REWARD_HALVING_INTERVAL},
+		Difficulty:        MINING_DIFFICULTY,
+		CoinbaseMaturity:  COINBASE_MATURITY,
+		MaxFutureDriftSec: MAX_FUTURE_DRIFT_SEC,
+		BlockIntervalSec:  MINING_TIMER_SEC,
+		Checkpoints:       map[int]string{},
+	}
+}
+
+func LoadChainSpec(path string) (*ChainSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cs := DefaultChainSpec()
+	if err := json.Unmarshal(data, cs); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := cs.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cs, nil
+}
+
+func (cs *ChainSpec) Save(path string) error {
+	data, err := json.MarshalIndent(cs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// Validate returns what makes cs unusable, nil if nothing does.
+func (cs *ChainSpec) Validate() error {
+	switch {
+	case cs.NetworkID == "":
+		return fmt.Errorf("network_id is empty")
+	case cs.Difficulty < 1 || cs.Difficulty > MAX_DIFFICULTY:
+		return fmt.Errorf("difficulty %d out of 1..%d", cs.Difficulty, MAX_DIFFICULTY)
+	case cs.CoinbaseMaturity < 0:
+		return fmt.Errorf("coinbase_maturity %d is negative", cs.CoinbaseMaturity)
+	case cs.MaxFutureDriftSec < 0:
+		return fmt.Errorf("max_future_drift_sec %d is negative", cs.MaxFutureDriftSec)
+	case cs.BlockIntervalSec < 1:
+		return fmt.Errorf("block_interval_sec %d is not positive", cs.BlockIntervalSec)
+	case cs.Reward.Initial < 0 || cs.Reward.TailEmission < 0:
+		return fmt.Errorf("reward is negative")
+	case cs.Reward.HalvingInterval < 0:
+		return fmt.Errorf("halving_interval %d is negative", cs.Reward.HalvingInterval)
+	case cs.Reward.MaxSupply < 0:
+		return fmt.Errorf("max_supply %v is negative", cs.Reward.MaxSupply)
+	}
+	for address, value := range cs.Genesis.Allocations {
+		if value <= 0 {
+			return fmt.Errorf("allocation of %s is not positive", address)
+		}
+	}
+	if cs.Reward.MaxSupply > 0 && cs.GenesisSupply() > float64(cs.Reward.MaxSupply) {
+		return fmt.Errorf("genesis allocations exceed max_supply %v", cs.Reward.MaxSupply)
+	}
+	return cs.validateCheckpoints()
+}
+
+// GenesisHash is the hash of the genesis block of the network.
+func (cs *ChainSpec) GenesisHash() [32]byte {
+	return cs.Genesis.Block().Hash()
+}
+
+func (bc *Blockchain) ChainSpec() *ChainSpec {
+	return bc.spec
+}
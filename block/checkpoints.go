@@ -0,0 +1,74 @@
+package block
+
+import (
+	"fmt"
+	"log"
+)
+
+// Checkpoints pin blocks of the network at some heights: a chain with a
+// different block there is invalid however long it is, so peers cannot
+// offer another history below the last checkpoint. The assume-valid
+// block speeds up the initial sync: the scripts of its ancestors, which
+// hold the signatures of a block, were run by the network long ago and
+// are not run again. Branches switched to later are checked in full.
+
+// checkpoint is the hash the block at height must have, false when the
+// height has no checkpoint.
+func (cs *ChainSpec) checkpoint(height int) ([32]byte, bool) {
+	s, ok := cs.Checkpoints[height]
+	if !ok {
+		return [32]byte{}, false
+	}
+	return decodeHash(s)
+}
+
+// lastCheckpoint is the highest height with a checkpoint, -1 for none.
+func (cs *ChainSpec) lastCheckpoint() int {
+	last := -1
+	for height := range cs.Checkpoints {
+		if height > last {
+			last = height
+		}
+	}
+	return last
+}
+
+func (cs *ChainSpec) validateCheckpoints() error {
+	for height, s := range cs.Checkpoints {
+		hash, ok := decodeHash(s)
+		switch {
+		case height < 0 || !ok:
+			return fmt.Errorf("invalid checkpoint %d: %q", height, s)
+		case height == 0 && hash != cs.GenesisHash():
+			return fmt.Errorf("checkpoint 0 is not the genesis block %x", cs.GenesisHash())
+		}
+	}
+	if _, ok := decodeHash(cs.AssumeValid); cs.AssumeValid != "" && !ok {
+		return fmt.Errorf("invalid assume_valid %q", cs.AssumeValid)
+	}
+	return nil
+}
+
+// matchesCheckpoint tells whether a block with hash may be at height.
+func (bc *Blockchain) matchesCheckpoint(height int, hash [32]byte) bool {
+	if want, ok := bc.spec.checkpoint(height); ok && hash != want {
+		log.Printf("ERROR: Block %x at height %d conflicts with checkpoint %x", hash, height, want)
+		return false
+	}
+	return true
+}
+
+// assumeValidHeight is the height of the assume-valid block in chain, -1
+// when chain does not hold it.
+func (bc *Blockchain) assumeValidHeight(chain []*Block) int {
+	hash, ok := decodeHash(bc.spec.AssumeValid)
+	if !ok {
+		return -1
+	}
+	for height := len(chain) - 1; height >= 0; height-- {
+		if chain[height].Hash() == hash {
+			return height
+		}
+	}
+	return -1
+}
@@ -0,0 +1,118 @@
+package block
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func mineTestBlock(bc *Blockchain, prev *Block, transactions ...*Transaction) *Block {
+	return mineTestBlockBy(bc, prev, "miner", transactions...)
+}
+
+// mineTestBlockBy builds the block following prev, rewarding miner, with
+// a valid proof of work.
+func mineTestBlockBy(bc *Blockchain, prev *Block, miner string, transactions ...*Transaction) *Block {
+	timestamp := prev.timestamp + int64(time.Second)
+	b := NewBlock(timestamp, 0, prev.Hash(), append([]*Transaction{newCoinbase(miner, 1)}, transactions...))
+	for !bc.ValidProof(b.Header(), bc.spec.Difficulty) {
+		b.nonce++
+	}
+	return b
+}
+
+// Scripts below the assume-valid block are skipped on the initial sync
+// only; a branch switched to later is checked in full.
+func TestAssumeValidOnInitialSyncOnly(t *testing.T) {
+	spec := DefaultChainSpec()
+	spec.Difficulty = 1
+	bc := NewBlockchainWithSpec("miner", 0, spec)
+	script, _ := ParseScript("OP_0")
+	invalid := mineTestBlock(bc, bc.LastBlock(), NewScriptTransaction("bob", 0, 0, script, nil))
+	assumed := mineTestBlock(bc, invalid)
+	chain := []*Block{bc.LastBlock(), invalid, assumed}
+	spec.AssumeValid = fmt.Sprintf("%x", assumed.Hash())
+
+	if !bc.validChain(chain, true) {
+		t.Fatal("chain refused on the initial sync")
+	}
+	if bc.ValidChain(chain) {
+		t.Fatal("invalid script accepted outside of the initial sync")
+	}
+}
+
+// newTestChain starts a chain at difficulty 1 and connects blocks to it.
+func newTestChain(t *testing.T, blocks int) *Blockchain {
+	spec := DefaultChainSpec()
+	spec.Difficulty = 1
+	bc := NewBlockchainWithSpec("miner", 0, spec)
+	for i := 0; i < blocks; i++ {
+		if !bc.ReceiveBlock(mineTestBlock(bc, bc.LastBlock()), "203.0.113.9:5000") {
+			t.Fatal("block refused")
+		}
+	}
+	return bc
+}
+
+// forkAt builds a branch of blocks following the block at forkIndex.
+func forkAt(bc *Blockchain, forkIndex int, blocks int, transactions ...*Transaction) []*orphanBlock {
+	branch := []*orphanBlock{}
+	prev := bc.chain[forkIndex]
+	for i := 0; i < blocks; i++ {
+		prev = mineTestBlockBy(bc, prev, "other", transactions...)
+		transactions = nil
+		branch = append(branch, &orphanBlock{block: prev, sender: "198.51.100.4:5000"})
+	}
+	return branch
+}
+
+// Peers cannot rewrite the chain below the last checkpoint, only above.
+func TestSwitchBranchAtCheckpoint(t *testing.T) {
+	tests := []struct {
+		name      string
+		forkIndex int
+		switched  bool
+	}{
+		{"below the checkpoint", 1, false},
+		{"at the checkpoint", 2, true},
+		{"above the checkpoint", 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bc := newTestChain(t, 4)
+			bc.spec.Checkpoints = map[int]string{2: fmt.Sprintf("%x", bc.chain[2].Hash())}
+			tip := bc.LastBlock()
+			branch := forkAt(bc, tt.forkIndex, len(bc.chain)-tt.forkIndex)
+
+			if switched := bc.switchBranch(branch, tt.forkIndex, branch[0].sender); switched != tt.switched {
+				t.Fatalf("switched %v, want %v", switched, tt.switched)
+			}
+			if tt.switched && bc.LastBlock() != branch[len(branch)-1].block {
+				t.Fatal("tip is not the branch's")
+			}
+			if !tt.switched && (bc.LastBlock() != tip || len(bc.peerManager.Peers()) == 0) {
+				t.Fatal("chain changed or sender not penalized")
+			}
+		})
+	}
+}
+
+// Branches switched to after the initial sync have all their scripts run,
+// below the assume-valid block too.
+func TestSwitchBranchRunsScripts(t *testing.T) {
+	bc := newTestChain(t, 2)
+	script, _ := ParseScript("OP_0")
+	branch := forkAt(bc, 0, 3, NewScriptTransaction("bob", 0, 0, script, nil))
+	bc.spec.AssumeValid = fmt.Sprintf("%x", branch[2].block.Hash())
+
+	chain := []*Block{bc.chain[0]}
+	for _, o := range branch {
+		chain = append(chain, o.block)
+	}
+	if !bc.validChain(chain, true) {
+		t.Fatal("branch refused on the initial sync")
+	}
+	if bc.switchBranch(branch, 0, branch[0].sender) {
+		t.Fatal("branch with an invalid script accepted")
+	}
+}
@@ -0,0 +1,39 @@
+package block
+
+// A coinbase is the transaction paying the mining reward. It has no
+// signature: its sender is MINING_SENDER, which only block assembly and
+// the genesis block may use. The pool refuses coinbases, and every block
+// after genesis has exactly one, as its first transaction.
+
+// newCoinbase pays value to recipient.
+func newCoinbase(recipient string, value float32) *Transaction {
+	return &Transaction{
+		senderBlockchainAddress:    MINING_SENDER,
+		recipientBlockchainAddress: recipient,
+		value:                      value,
+	}
+}
+
+func (t *Transaction) IsCoinbase() bool {
+	return t.senderBlockchainAddress == MINING_SENDER
+}
+
+// coinbase is the coinbase of the next block we mine.
+func (bc *Blockchain) coinbase() *Transaction {
+	return newCoinbase(bc.blockchainAddress, bc.spec.BlockReward(len(bc.chain)))
+}
+
+// validCoinbase checks that the first transaction of b, and only that one,
+// is a plain coinbase. A negative one would destroy coins.
+func (b *Block) validCoinbase() bool {
+	if len(b.transactions) == 0 {
+		return false
+	}
+	for i, t := range b.transactions {
+		if t.IsCoinbase() != (i == 0) {
+			return false
+		}
+	}
+	t := b.transactions[0]
+	return t.value >= 0 && t.lockTime == 0 && t.script == nil && t.witness == nil && t.data == nil && t.gasLimit == 0 && t.gasPrice == 0
+}
@@ -0,0 +1,28 @@
+package block
+
+import "testing"
+
+func TestValidCoinbase(t *testing.T) {
+	locked := newCoinbase("miner", 1)
+	locked.lockTime = 1
+	tests := []struct {
+		name         string
+		transactions []*Transaction
+		valid        bool
+	}{
+		{"coinbase", []*Transaction{newCoinbase("miner", 1)}, true},
+		{"zero value", []*Transaction{newCoinbase("miner", 0)}, true},
+		{"negative value", []*Transaction{newCoinbase("miner", -1)}, false},
+		{"no coinbase", []*Transaction{NewTransaction("alice", "bob", 1, 0)}, false},
+		{"coinbase not first", []*Transaction{NewTransaction("alice", "bob", 1, 0), newCoinbase("miner", 1)}, false},
+		{"two coinbases", []*Transaction{newCoinbase("miner", 1), newCoinbase("other", 1)}, false},
+		{"lock time", []*Transaction{locked}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if valid := NewBlock(1, 0, [32]byte{}, tt.transactions).validCoinbase(); valid != tt.valid {
+				t.Fatalf("valid %v, want %v", valid, tt.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package block
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math/rand"
+)
+
+const (
+	FEATURE_COMPACT_BLOCKS = "compact_blocks"
+	MAX_PARTIAL_BLOCKS     = 8 // Compact blocks waiting for missing transactions, per peer
+)
+
+// CompactBlock announces a block by its header and short IDs of its
+// transactions, which the receiver looks up in its pool. Transactions
+// peers cannot have, such as the mining reward, are sent in full.
+type CompactBlock struct {
+	Header    *BlockHeader            `json:"header"`
+	Salt      uint64                  `json:"salt"`
+	ShortIDs  []uint64                `json:"short_ids"` // Zero where the transaction is prefilled
+	Prefilled []*PrefilledTransaction `json:"prefilled"`
+}
+
+// Validate reports whether cb has a header and its prefilled entries
+// carry transactions.
+func (cb *CompactBlock) Validate() bool {
+	if cb.Header == nil {
+		return false
+	}
+	for _, pt := range cb.Prefilled {
+		if pt == nil || pt.Transaction == nil {
+			return false
+		}
+	}
+	return true
+}
+
+type PrefilledTransaction struct {
+	Index       int          `json:"index"`
+	Transaction *Transaction `json:"transaction"`
+}
+
+// BlockTransactionsRequest asks for the transactions of a compact block
+// that could not be found in the pool (getblocktxn).
+type BlockTransactionsRequest struct {
+	BlockHash string `json:"block_hash"`
+	Indexes   []int  `json:"indexes"`
+}
+
+// BlockTransactions answers a BlockTransactionsRequest (blocktxn).
+type BlockTransactions struct {
+	BlockHash    string         `json:"block_hash"`
+	Transactions []*Transaction `json:"transactions"`
+}
+
+func (bt *BlockTransactions) Validate() bool {
+	for _, t := range bt.Transactions {
+		if t == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// partialBlock is a compact block being reconstructed.
+type partialBlock struct {
+	header       *BlockHeader
+	transactions []*Transaction // nil where still missing
+	missing      []int
+}
+
+// shortID is a 6 byte ID of the transaction with hash h. The salt differs
+// per compact block, so collisions cannot be arranged in advance.
+func shortID(salt uint64, h [32]byte) uint64 {
+	s := sha256.Sum256(append(binary.BigEndian.AppendUint64(nil, salt), h[:]...))
+	return binary.BigEndian.Uint64(s[:8]) >> 16
+}
+
+func NewCompactBlock(b *Block) *CompactBlock {
+	cb := &CompactBlock{
+		Header:    b.Header(),
+		Salt:      rand.Uint64(),
+		ShortIDs:  make([]uint64, len(b.transactions)),
+		Prefilled: []*PrefilledTransaction{},
+	}
+	for i, t := range b.transactions {
+		if t.IsCoinbase() {
+			cb.Prefilled = append(cb.Prefilled, &PrefilledTransaction{i, t})
+			continue
+		}
+		cb.ShortIDs[i] = shortID(cb.Salt, t.Hash())
+	}
+	return cb
+}
+
+// reconstruct fills what it can of cb from the pool. Short IDs matching
+// several pool transactions are treated as missing.
+func (bc *Blockchain) reconstruct(cb *CompactBlock) (*partialBlock, bool) {
+	pb := &partialBlock{header: cb.Header, transactions: make([]*Transaction, len(cb.ShortIDs))}
+	for _, pt := range cb.Prefilled {
+		if pt.Index < 0 || pt.Index >= len(pb.transactions) {
+			return nil, false
+		}
+		pb.transactions[pt.Index] = pt.Transaction
+	}
+	pool := bc.poolShortIDs(cb.Salt)
+	for i, id := range cb.ShortIDs {
+		if pb.transactions[i] != nil {
+			continue
+		}
+		if t := pool[id]; t != nil {
+			pb.transactions[i] = t.copy()
+		} else {
+			pb.missing = append(pb.missing, i)
+		}
+	}
+	return pb, true
+}
+
+// poolShortIDs maps the short IDs of the pool transactions to them, or
+// to nil when several share one.
+func (bc *Blockchain) poolShortIDs(salt uint64) map[uint64]*Transaction {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	pool := make(map[uint64]*Transaction)
+	for _, t := range bc.transactionPool {
+		id := shortID(salt, t.Hash())
+		if _, ok := pool[id]; ok {
+			pool[id] = nil
+			continue
+		}
+		pool[id] = t
+	}
+	return pool
+}
+
+// block returns the reconstructed block, or nil when its transactions
+// do not match the header, e.g. after a short ID collision.
+func (pb *partialBlock) block() *Block {
+	if TransactionsRoot(pb.transactions) != pb.header.transactionsRoot {
+		return nil
+	}
+	return NewBlock(pb.header.timestamp, pb.header.nonce, pb.header.previousHash, pb.transactions)
+}
+
+// receiveCompactBlock rebuilds the block p announced from the pool, asks
+// p for the transactions we lack, or falls back to the full block.
+func (bc *Blockchain) receiveCompactBlock(p *Peer, cb *CompactBlock) {
+	hash := cb.Header.Hash()
+	item := &InvItem{INV_BLOCK, fmt.Sprintf("%x", hash)}
+	if bc.BlockByHash(hash) != nil || bc.orphans.Has(hash) {
+		return
+	}
+	if !bc.ValidProof(cb.Header, bc.spec.Difficulty) {
+		bc.peerManager.Misbehaving(p.address, PENALTY_INVALID_BLOCK, "invalid compact block")
+		return
+	}
+	pb, ok := bc.reconstruct(cb)
+	if !ok {
+		bc.peerManager.Misbehaving(p.address, PENALTY_INVALID_BLOCK, "malformed compact block")
+		return
+	}
+	if len(pb.missing) > 0 {
+		log.Printf("action=compact_block, status=missing_transactions, missing=%d, total=%d", len(pb.missing), len(pb.transactions))
+		p.addPartialBlock(hash, pb)
+		p.Send(NewMessage(MSG_GETBLOCKTXN, &BlockTransactionsRequest{item.Hash, pb.missing}))
+		return
+	}
+	b := pb.block()
+	if b == nil {
+		log.Println("action=compact_block, status=fallback_full_block")
+		p.Send(NewMessage(MSG_GETDATA, []*InvItem{item}))
+		return
+	}
+	log.Printf("action=compact_block, status=reconstructed, transactions=%d", len(pb.transactions))
+	bc.ReceiveBlock(b, p.address)
+}
+
+// receiveBlockTransactions completes a partial block with the
+// transactions p sent, falling back to the full block if they do not
+// fit.
+func (bc *Blockchain) receiveBlockTransactions(p *Peer, bt *BlockTransactions) {
+	hash, ok := decodeHash(bt.BlockHash)
+	if !ok {
+		return
+	}
+	pb := p.takePartialBlock(hash)
+	if pb == nil {
+		return
+	}
+	if len(bt.Transactions) == len(pb.missing) {
+		for i, index := range pb.missing {
+			pb.transactions[index] = bt.Transactions[i]
+		}
+		if b := pb.block(); b != nil {
+			log.Printf("action=compact_block, status=reconstructed, transactions=%d", len(pb.transactions))
+			bc.ReceiveBlock(b, p.address)
+			return
+		}
+	}
+	log.Println("action=compact_block, status=fallback_full_block")
+	p.Send(NewMessage(MSG_GETDATA, []*InvItem{{INV_BLOCK, bt.BlockHash}}))
+}
+
+// handleGetBlockTransactions sends p the transactions it lacks of one of
+// our blocks.
+func (bc *Blockchain) handleGetBlockTransactions(p *Peer, r *BlockTransactionsRequest) {
+	hash, ok := decodeHash(r.BlockHash)
+	var b *Block
+	if ok {
+		b = bc.BlockByHash(hash)
+	}
+	if b == nil {
+		p.Send(NewMessage(MSG_NOTFOUND, []*InvItem{{INV_BLOCK, r.BlockHash}}))
+		return
+	}
+	bt := &BlockTransactions{BlockHash: r.BlockHash, Transactions: []*Transaction{}}
+	for _, i := range r.Indexes {
+		if i < 0 || i >= len(b.transactions) {
+			bc.peerManager.Misbehaving(p.address, PENALTY_INVALID_BLOCK, "invalid transaction index")
+			return
+		}
+		bt.Transactions = append(bt.Transactions, b.transactions[i])
+	}
+	p.Send(NewMessage(MSG_BLOCKTXN, bt))
+}
+
+func (p *Peer) addPartialBlock(hash [32]byte, pb *partialBlock) {
+	p.muxPartial.Lock()
+	defer p.muxPartial.Unlock()
+	if len(p.partialBlocks) >= MAX_PARTIAL_BLOCKS {
+		for h := range p.partialBlocks {
+			delete(p.partialBlocks, h)
+			break
+		}
+	}
+	p.partialBlocks[hash] = pb
+}
+
+func (p *Peer) takePartialBlock(hash [32]byte) *partialBlock {
+	p.muxPartial.Lock()
+	defer p.muxPartial.Unlock()
+	pb := p.partialBlocks[hash]
+	delete(p.partialBlocks, hash)
+	return pb
+}
+
+func hasFeature(features []string, feature string) bool {
+	for _, f := range features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+package block
+
+import (
+	"sync"
+	"testing"
+)
+
+// Compact blocks are rebuilt from the pool while transactions keep
+// entering it.
+func TestReconstructWhilePooling(t *testing.T) {
+	bc := NewBlockchain("miner", 0)
+	txs := make([]*Transaction, 20)
+	for i := range txs {
+		txs[i] = NewTransaction("sender", "recipient", float32(i+1), 0)
+	}
+	cb := NewCompactBlock(NewBlock(1, 0, bc.LastBlock().Hash(), append([]*Transaction{newCoinbase("other", 1)}, txs...)))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for _, tx := range txs {
+			bc.addToPool(tx)
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if _, ok := bc.reconstruct(cb); !ok {
+			t.Fatal("compact block refused")
+		}
+	}
+	wg.Wait()
+
+	pb, ok := bc.reconstruct(cb)
+	if !ok || len(pb.missing) != 0 || pb.block() == nil {
+		t.Fatalf("block not rebuilt from the pool, %d transactions missing", len(pb.missing))
+	}
+}
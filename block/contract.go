@@ -0,0 +1,319 @@
+package block
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+)
+
+const CONTRACT_ADDRESS_PREFIX = 0x06 // Version byte of contract addresses
+
+// Contract is a deployed program together with its persistent storage.
+type Contract struct {
+	address string
+	creator string
+	code    []byte
+	storage map[int64]int64
+}
+
+func (c *Contract) Address() string {
+	return c.address
+}
+
+func (c *Contract) Code() []byte {
+	return c.code
+}
+
+func (c *Contract) Storage() map[int64]int64 {
+	return c.storage
+}
+
+func (c *Contract) copyStorage() map[int64]int64 {
+	storage := make(map[int64]int64, len(c.storage))
+	for k, v := range c.storage {
+		storage[k] = v
+	}
+	return storage
+}
+
+func (c *Contract) MarshalJSON() ([]byte, error) {
+	storage := make(map[string]int64, len(c.storage))
+	for k, v := range c.storage {
+		storage[strconv.FormatInt(k, 10)] = v
+	}
+	return json.Marshal(struct {
+		Address string           `json:"contract_address"`
+		Creator string           `json:"creator_blockchain_address"`
+		Code    string           `json:"code"`
+		Storage map[string]int64 `json:"storage"`
+	}{
+		Address: c.address,
+		Creator: c.creator,
+		Code:    hex.EncodeToString(c.code),
+		Storage: storage,
+	})
+}
+
+// Receipt records what executing a transaction did. Plain transfers get
+// a successful receipt without gas.
+type Receipt struct {
+	transactionHash [32]byte
+	success         bool
+	gasUsed         uint64
+	fee             float32
+	contractAddress string
+	returnValue     int64
+	logs            []*Log
+	bloom           Bloom
+	err             string
+}
+
+func (r *Receipt) Success() bool {
+	return r.success
+}
+
+func (r *Receipt) Fee() float32 {
+	return r.fee
+}
+
+func (r *Receipt) Logs() []*Log {
+	return r.logs
+}
+
+func (r *Receipt) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		TransactionHash string  `json:"transaction_hash"`
+		Success         bool    `json:"success"`
+		GasUsed         uint64  `json:"gas_used"`
+		Fee             float32 `json:"fee"`
+		ContractAddress string  `json:"contract_address,omitempty"`
+		ReturnValue     int64   `json:"return_value"`
+		Logs            []*Log  `json:"logs"`
+		Bloom           *Bloom  `json:"bloom"`
+		Error           string  `json:"error,omitempty"`
+	}{
+		TransactionHash: fmt.Sprintf("%x", r.transactionHash),
+		Success:         r.success,
+		GasUsed:         r.gasUsed,
+		Fee:             r.fee,
+		ContractAddress: r.contractAddress,
+		ReturnValue:     r.returnValue,
+		Logs:            r.logs,
+		Bloom:           &r.bloom,
+		Error:           r.err,
+	})
+}
+
+func IsContractAddress(address string) bool {
+	return isHashAddress(address, CONTRACT_ADDRESS_PREFIX)
+}
+
+// IsContractDeploy reports whether t creates a contract from its data.
+// Deploys have no recipient.
+func (t *Transaction) IsContractDeploy() bool {
+	return t.recipientBlockchainAddress == "" && len(t.data) > 0
+}
+
+// IsContractTransaction reports whether t is executed by the VM.
+func (t *Transaction) IsContractTransaction() bool {
+	return t.IsContractDeploy() || IsContractAddress(t.recipientBlockchainAddress)
+}
+
+// ContractAddress is the address a deploy creates its contract at.
+func (t *Transaction) ContractAddress() string {
+	h := t.SigHash()
+	return hashAddress(CONTRACT_ADDRESS_PREFIX, append([]byte(t.senderBlockchainAddress), h[:]...))
+}
+
+// EncodeCallInput packs call arguments into transaction data.
+func EncodeCallInput(input []int64) []byte {
+	data := make([]byte, 0, len(input)*8)
+	for _, v := range input {
+		data = binary.BigEndian.AppendUint64(data, uint64(v))
+	}
+	return data
+}
+
+// DecodeCallInput is the inverse of EncodeCallInput. A trailing partial
+// word is ignored.
+func DecodeCallInput(data []byte) []int64 {
+	input := make([]int64, len(data)/8)
+	for i := range input {
+		input[i] = int64(binary.BigEndian.Uint64(data[i*8:]))
+	}
+	return input
+}
+
+// connectBlock executes the transactions of b, the newest block of the
+// chain, and stores their receipts and the bloom filter of their logs.
+func (bc *Blockchain) connectBlock(b *Block) {
+	bc.muxState.Lock()
+	defer bc.muxState.Unlock()
+	height := len(bc.receipts)
+	receipts := make([]*Receipt, len(b.transactions))
+	bloom := new(Bloom)
+	logIndex := 0
+	for i, t := range b.transactions {
+		r := bc.applyTransaction(t, height)
+		if !t.IsCoinbase() {
+			bc.seenTransactions.Add(r.transactionHash)
+		}
+		for _, l := range r.logs {
+			l.blockHeight = height
+			l.transactionHash = r.transactionHash
+			l.logIndex = logIndex
+			logIndex++
+			r.bloom.addLog(l)
+			bloom.addLog(l)
+		}
+		receipts[i] = r
+	}
+	bc.receipts = append(bc.receipts, receipts)
+	bc.blooms = append(bc.blooms, bloom)
+}
+
+// rebuildState replays the whole chain, after it has been replaced.
+func (bc *Blockchain) rebuildState() {
+	bc.muxState.Lock()
+	bc.contracts = make(map[string]*Contract)
+	bc.receipts = [][]*Receipt{}
+	bc.blooms = []*Bloom{}
+	bc.muxState.Unlock()
+	for _, b := range bc.chain {
+		bc.connectBlock(b)
+	}
+}
+
+func (bc *Blockchain) applyTransaction(t *Transaction, height int) *Receipt {
+	r := &Receipt{transactionHash: t.Hash(), success: true}
+	if !t.IsContractTransaction() {
+		return r
+	}
+
+	r.gasUsed = CONTRACT_BASE_GAS
+	var err error
+	if t.IsContractDeploy() {
+		r.gasUsed += uint64(len(t.data)) * GAS_PER_CODE_BYTE
+		address := t.ContractAddress()
+		switch {
+		case r.gasUsed > t.gasLimit:
+			err = ErrOutOfGas
+		case len(t.data) > VM_MAX_CODE_SIZE:
+			err = fmt.Errorf("code too large")
+		case bc.contracts[address] != nil:
+			err = fmt.Errorf("contract already exists")
+		default:
+			bc.contracts[address] = &Contract{address, t.senderBlockchainAddress, t.data, map[int64]int64{}}
+			r.contractAddress = address
+		}
+	} else {
+		c := bc.contracts[t.recipientBlockchainAddress]
+		switch {
+		case r.gasUsed > t.gasLimit:
+			err = ErrOutOfGas
+		case c == nil:
+			err = fmt.Errorf("no contract at %s", t.recipientBlockchainAddress)
+		default:
+			storage := c.copyStorage()
+			result := ExecuteContract(c.code, storage, &VMContext{
+				Address:     c.address,
+				Caller:      t.senderBlockchainAddress,
+				Value:       t.value,
+				Input:       DecodeCallInput(t.data),
+				BlockHeight: height,
+				GasLimit:    t.gasLimit - r.gasUsed,
+			})
+			r.gasUsed += result.GasUsed
+			r.returnValue = result.ReturnValue
+			err = result.Err
+			if err == nil {
+				c.storage = storage
+				r.logs = result.Logs
+			}
+		}
+	}
+	if err != nil {
+		r.success = false
+		r.err = err.Error()
+		if errors.Is(err, ErrOutOfGas) {
+			r.gasUsed = t.gasLimit
+		}
+	}
+	r.fee = float32(r.gasUsed) * t.gasPrice
+	return r
+}
+
+// receipt returns the receipt of the i-th transaction of the block at
+// height, nil when the chain has not been executed (e.g. a neighbor's
+// chain decoded from JSON).
+func (bc *Blockchain) receipt(height int, i int) *Receipt {
+	if height >= len(bc.receipts) || i >= len(bc.receipts[height]) {
+		return nil
+	}
+	return bc.receipts[height][i]
+}
+
+// Receipts returns the receipts of the block at height.
+func (bc *Blockchain) Receipts(height int) []*Receipt {
+	bc.muxState.RLock()
+	defer bc.muxState.RUnlock()
+	if height < 0 || height >= len(bc.receipts) {
+		return nil
+	}
+	return bc.receipts[height]
+}
+
+func (bc *Blockchain) Contract(address string) *Contract {
+	bc.muxState.RLock()
+	defer bc.muxState.RUnlock()
+	c, ok := bc.contracts[address]
+	if !ok {
+		return nil
+	}
+	return &Contract{c.address, c.creator, c.code, c.copyStorage()}
+}
+
+// Contracts returns the addresses of all deployed contracts, sorted.
+func (bc *Blockchain) Contracts() []string {
+	bc.muxState.RLock()
+	defer bc.muxState.RUnlock()
+	addresses := make([]string, 0, len(bc.contracts))
+	for a := range bc.contracts {
+		addresses = append(addresses, a)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// CallContract runs a contract against the current state without
+// creating a transaction; storage changes are discarded.
+func (bc *Blockchain) CallContract(address string, caller string, input []int64, gasLimit uint64) (*VMResult, bool) {
+	c := bc.Contract(address)
+	if c == nil {
+		log.Printf("ERROR: no contract at %s", address)
+		return nil, false
+	}
+	return ExecuteContract(c.code, c.storage, &VMContext{
+		Address:     c.address,
+		Caller:      caller,
+		Input:       input,
+		BlockHeight: bc.Height() + 1,
+		GasLimit:    gasLimit,
+	}), true
+}
+
+type ContractCallRequest struct {
+	ContractAddress *string  `json:"contract_address"`
+	Caller          *string  `json:"caller_blockchain_address"`
+	Input           *[]int64 `json:"input"`
+	GasLimit        *uint64  `json:"gas_limit"`
+}
+
+func (cr *ContractCallRequest) Validate() bool {
+	return cr.ContractAddress != nil
+}
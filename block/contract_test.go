@@ -0,0 +1,46 @@
+package block
+
+import "testing"
+
+// Transactions that run out of gas are charged their whole gas limit,
+// others the gas they used.
+func TestApplyTransactionGas(t *testing.T) {
+	bc := NewBlockchain("sender", 0)
+	loop, _ := AssembleContract("JUMPDEST PUSH 0 JUMP")
+	ret, _ := AssembleContract("PUSH 1 RETURN")
+	deployCost := CONTRACT_BASE_GAS + uint64(len(loop))*GAS_PER_CODE_BYTE
+	deployLoop := NewContractTransaction("sender", "", 0, loop, deployCost, 1)
+	deployRet := NewContractTransaction("sender", "", 0, ret, 1000, 1)
+	deployRet.value = 1 // Another contract address than deployLoop's
+	for _, d := range []*Transaction{deployLoop, deployRet} {
+		if r := bc.applyTransaction(d, 1); !r.success {
+			t.Fatalf("deploy failed: %s", r.err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		t        *Transaction
+		outOfGas bool
+		gasUsed  uint64
+	}{
+		{"deploy", NewContractTransaction("sender", "", 0, loop, deployCost-1, 1), true, deployCost - 1},
+		{"call below base gas", NewContractTransaction("sender", deployRet.ContractAddress(), 0, nil, CONTRACT_BASE_GAS-1, 1), true, CONTRACT_BASE_GAS - 1},
+		{"endless call", NewContractTransaction("sender", deployLoop.ContractAddress(), 0, nil, 5000, 1), true, 5000},
+		{"call", NewContractTransaction("sender", deployRet.ContractAddress(), 0, nil, 5000, 1), false, CONTRACT_BASE_GAS + 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bc.applyTransaction(tt.t, 2)
+			if tt.outOfGas && (r.success || r.err != ErrOutOfGas.Error()) {
+				t.Fatalf("got success %v, error %q; want %v", r.success, r.err, ErrOutOfGas)
+			}
+			if !tt.outOfGas && !r.success {
+				t.Fatalf("failed: %s", r.err)
+			}
+			if r.gasUsed != tt.gasUsed || r.fee != float32(tt.gasUsed) {
+				t.Fatalf("used %d gas for a fee of %v, want %d", r.gasUsed, r.fee, tt.gasUsed)
+			}
+		})
+	}
+}
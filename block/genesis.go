@@ -0,0 +1,34 @@
+package block
+
+import (
+	"sort"
+)
+
+// Genesis describes the first block of a chain. Nodes built from the same
+// Genesis share their genesis block, so they can sync with each other
+// from the start.
+type Genesis struct {
+	Timestamp   int64              `json:"timestamp"`   // Unix nanoseconds, like block timestamps
+	Allocations map[string]float32 `json:"allocations"` // Coins credited to each address
+}
+
+// Block builds the genesis block. It carries no proof of work, and its
+// previous hash is the hash of an empty block.
+func (g *Genesis) Block() *Block {
+	return NewBlock(g.Timestamp, 0, (&Block{}).Hash(), g.transactions())
+}
+
+// transactions credits the allocations, ordered by address so that every
+// node builds the same block.
+func (g *Genesis) transactions() []*Transaction {
+	addresses := []string{}
+	for address := range g.Allocations {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	transactions := []*Transaction{}
+	for _, address := range addresses {
+		transactions = append(transactions, newCoinbase(address, g.Allocations[address]))
+	}
+	return transactions
+}
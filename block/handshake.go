@@ -0,0 +1,236 @@
+package block
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	PROTOCOL_VERSION     = 1
+	MIN_PROTOCOL_VERSION = 1 // Oldest peer version still understood
+	NETWORK_ID           = "goblockchain-main"
+	MAX_PEER_INFO_PER_IP = 8 // Peers contacting us recorded per IP, loopback aside
+)
+
+// FEATURES lists the optional parts of the protocol this node serves.
+var FEATURES = []string{"blocks", FEATURE_COMPACT_BLOCKS, "contracts", "headers", "peers", "scripts"}
+
+// Handshake is what two nodes tell each other before becoming neighbors.
+type Handshake struct {
+	ProtocolVersion int      `json:"protocol_version"`
+	NetworkID       string   `json:"network_id"`
+	GenesisHash     string   `json:"genesis_hash"`
+	NodeID          string   `json:"node_id"`
+	BestHeight      int      `json:"best_height"`
+	Features        []string `json:"features"`
+	Address         string   `json:"address"`         // Where the sender accepts connections
+	PublicKey       string   `json:"public_key"`      // Identity key the node ID is derived from
+	Nonce           string   `json:"nonce,omitempty"` // Challenge the peer signs its messages with
+	Signature       string   `json:"signature"`
+}
+
+func (h *Handshake) Validate() bool {
+	return h.ProtocolVersion > 0 && h.NetworkID != "" && h.NodeID != "" && h.PublicKey != "" && h.Signature != ""
+}
+
+// PeerInfo is what was negotiated with a neighbor.
+type PeerInfo struct {
+	Address         string   `json:"address"`
+	NodeID          string   `json:"node_id"`
+	ProtocolVersion int      `json:"protocol_version"` // The lower of both versions
+	NetworkID       string   `json:"network_id"`
+	GenesisHash     string   `json:"genesis_hash"`
+	BestHeight      int      `json:"best_height"`
+	Features        []string `json:"features"` // Supported by both sides
+	PublicKey       string   `json:"public_key"`
+	Inbound         bool     `json:"inbound"`
+	HandshakeAt     int64    `json:"handshake_at"`
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+func (bc *Blockchain) genesisHash() string {
+	return fmt.Sprintf("%x", bc.spec.GenesisHash())
+}
+
+func (bc *Blockchain) NodeID() string {
+	return bc.nodeID
+}
+
+// Handshake describes this node, signed with its identity key.
+func (bc *Blockchain) Handshake() *Handshake {
+	return bc.signHandshake("")
+}
+
+func (bc *Blockchain) signHandshake(nonce string) *Handshake {
+	h := &Handshake{
+		ProtocolVersion: PROTOCOL_VERSION,
+		NetworkID:       bc.spec.NetworkID,
+		GenesisHash:     bc.genesisHash(),
+		NodeID:          bc.nodeID,
+		BestHeight:      bc.Height(),
+		Features:        FEATURES,
+		Address:         bc.Address(),
+		PublicKey:       bc.PublicKey(),
+		Nonce:           nonce,
+	}
+	h.Signature = bc.sign(handshakeHash(h))
+	return h
+}
+
+// CheckHandshake returns why a peer cannot be talked to, nil if it can.
+// Peers have to be on the same network and start from the same genesis
+// block.
+func (bc *Blockchain) CheckHandshake(h *Handshake) error {
+	switch {
+	case h.NodeID == bc.nodeID:
+		return fmt.Errorf("connected to self")
+	case h.NetworkID != bc.spec.NetworkID:
+		return fmt.Errorf("network %q, want %q", h.NetworkID, bc.spec.NetworkID)
+	case h.GenesisHash != bc.genesisHash():
+		return fmt.Errorf("genesis %s, want %s", h.GenesisHash, bc.genesisHash())
+	case h.ProtocolVersion < MIN_PROTOCOL_VERSION:
+		return fmt.Errorf("protocol version %d older than %d", h.ProtocolVersion, MIN_PROTOCOL_VERSION)
+	}
+	return verifyHandshake(h)
+}
+
+// AcceptHandshake checks the handshake of a peer contacting us from
+// remoteAddr and, when it is compatible, records what was negotiated.
+// The address the peer announces has to be its own.
+func (bc *Blockchain) AcceptHandshake(h *Handshake, remoteAddr string) error {
+	if err := bc.CheckHandshake(h); err != nil {
+		return err
+	}
+	if !ValidPeerAddress(h.Address) {
+		return nil
+	}
+	if !IsPeerHost(h.Address, remoteAddr) {
+		return fmt.Errorf("announced address %s is not that of %s", h.Address, remoteAddr)
+	}
+	if err := bc.setPeerInfo(negotiate(h, true)); err != nil {
+		return err
+	}
+	if bc.PeerInfo(h.Address) != nil {
+		bc.addressBook.Add(h.Address)
+	}
+	return nil
+}
+
+func negotiate(h *Handshake, inbound bool) *PeerInfo {
+	version := h.ProtocolVersion
+	if version > PROTOCOL_VERSION {
+		version = PROTOCOL_VERSION
+	}
+	features := []string{}
+	for _, f := range h.Features {
+		for _, ours := range FEATURES {
+			if f == ours {
+				features = append(features, f)
+				break
+			}
+		}
+	}
+	sort.Strings(features)
+	return &PeerInfo{
+		Address:         h.Address,
+		NodeID:          h.NodeID,
+		ProtocolVersion: version,
+		NetworkID:       h.NetworkID,
+		GenesisHash:     h.GenesisHash,
+		BestHeight:      h.BestHeight,
+		Features:        features,
+		PublicKey:       h.PublicKey,
+		Inbound:         inbound,
+		HandshakeAt:     time.Now().Unix(),
+	}
+}
+
+// setPeerInfo records what was negotiated with the peer at p.Address.
+// A peer contacting us cannot take over the address of another node,
+// only one we reached at that address can, nor fill the records from a
+// single IP.
+func (bc *Blockchain) setPeerInfo(p *PeerInfo) error {
+	bc.muxPeers.Lock()
+	defer bc.muxPeers.Unlock()
+	old, ok := bc.peerInfo[p.Address]
+	if ok && p.Inbound && old.PublicKey != p.PublicKey {
+		return fmt.Errorf("address %s belongs to node %s", p.Address, old.NodeID)
+	}
+	if !ok && len(bc.peerInfo) >= MAX_ADDRESS_BOOK_SIZE {
+		return nil
+	}
+	if ip := PeerIP(p.Address); !ok && p.Inbound && !isLoopback(ip) && bc.peerInfoFrom(ip) >= MAX_PEER_INFO_PER_IP {
+		return nil
+	}
+	bc.peerInfo[p.Address] = p
+	return nil
+}
+
+func (bc *Blockchain) peerInfoFrom(ip string) int {
+	n := 0
+	for address := range bc.peerInfo {
+		if PeerIP(address) == ip {
+			n++
+		}
+	}
+	return n
+}
+
+// PeerInfo returns what was negotiated with the peer at address.
+func (bc *Blockchain) PeerInfo(address string) *PeerInfo {
+	bc.muxPeers.Lock()
+	defer bc.muxPeers.Unlock()
+	return bc.peerInfo[address]
+}
+
+// NeighborInfo returns the negotiated info of the current neighbors.
+func (bc *Blockchain) NeighborInfo() []*PeerInfo {
+	bc.muxPeers.Lock()
+	defer bc.muxPeers.Unlock()
+	infos := []*PeerInfo{}
+	for _, n := range bc.neighbors {
+		if p, ok := bc.peerInfo[n]; ok {
+			infos = append(infos, p)
+		}
+	}
+	return infos
+}
+
+// handshake introduces us to the node at address and checks its answer.
+func (bc *Blockchain) handshake(address string) (*PeerInfo, bool) {
+	m, _ := json.Marshal(bc.Handshake())
+	client := bc.peerClient(PEER_TIMEOUT_SEC * time.Second)
+	resp, err := client.Post(bc.peerURL(address, "/handshake"), "application/json", bytes.NewBuffer(m))
+	if err != nil {
+		return nil, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		log.Printf("ERROR: Handshake rejected by %s", address)
+		return nil, false
+	}
+	var h Handshake
+	if err := json.NewDecoder(resp.Body).Decode(&h); err != nil || !h.Validate() {
+		log.Printf("ERROR: Invalid handshake from %s", address)
+		return nil, false
+	}
+	if err := bc.CheckHandshake(&h); err != nil {
+		log.Printf("ERROR: Incompatible peer %s: %v", address, err)
+		return nil, false
+	}
+	// Neighbors are known by the address we reached them at.
+	h.Address = address
+	p := negotiate(&h, false)
+	bc.setPeerInfo(p)
+	return p, true
+}
@@ -0,0 +1,55 @@
+package block
+
+import (
+	"fmt"
+	"testing"
+)
+
+func newPeerAt(host string, port uint16) *Blockchain {
+	peer := NewBlockchain("peer", port)
+	peer.SetPeerConfig(host, nil, "")
+	return peer
+}
+
+func TestAcceptHandshakeBindsAddress(t *testing.T) {
+	bc := NewBlockchain("miner", 5000)
+	peer := newPeerAt("127.0.0.1", 5001)
+
+	if err := bc.AcceptHandshake(peer.Handshake(), "203.0.113.5:40000"); err == nil {
+		t.Fatal("address announced from another IP accepted")
+	}
+	if err := bc.AcceptHandshake(peer.Handshake(), "127.0.0.1:40000"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.AcceptHandshake(peer.Handshake(), "127.0.0.1:40001"); err != nil {
+		t.Fatalf("peer handshaking again refused: %v", err)
+	}
+	impostor := newPeerAt("127.0.0.1", 5001)
+	if err := bc.AcceptHandshake(impostor.Handshake(), "127.0.0.1:40002"); err == nil {
+		t.Fatal("address of another node taken over")
+	}
+	if bc.PeerInfo(peer.Address()).PublicKey != peer.PublicKey() {
+		t.Fatal("address rebound to another key")
+	}
+}
+
+// A single IP cannot fill the peer records by announcing many ports.
+func TestPeerInfoPerIP(t *testing.T) {
+	bc := NewBlockchain("miner", 5000)
+	const ip = "203.0.113.5"
+	for i := 0; i < MAX_PEER_INFO_PER_IP+3; i++ {
+		peer := newPeerAt(ip, uint16(6000+i))
+		if err := bc.AcceptHandshake(peer.Handshake(), ip+":40000"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recorded := 0
+	for i := 0; i < MAX_PEER_INFO_PER_IP+3; i++ {
+		if bc.PeerInfo(fmt.Sprintf("%s:%d", ip, 6000+i)) != nil {
+			recorded++
+		}
+	}
+	if recorded != MAX_PEER_INFO_PER_IP || len(bc.addressBook.Addresses()) != MAX_PEER_INFO_PER_IP {
+		t.Fatalf("recorded %d peers of one IP, %d addresses, want %d", recorded, len(bc.addressBook.Addresses()), MAX_PEER_INFO_PER_IP)
+	}
+}
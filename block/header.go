@@ -0,0 +1,152 @@
+package block
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+const MAX_HEADERS_PER_REQUEST = 2000
+
+// BlockHeader is what the proof of work and the block hash cover. The
+// transactions are committed to by their merkle root, so a header can be
+// checked without downloading the block body.
+type BlockHeader struct {
+	timestamp        int64
+	nonce            int
+	previousHash     [32]byte
+	transactionsRoot [32]byte
+}
+
+func (h *BlockHeader) PreviousHash() [32]byte {
+	return h.previousHash
+}
+
+func (h *BlockHeader) Hash() [32]byte {
+	m, _ := json.Marshal(h)
+	return sha256.Sum256(m)
+}
+
+func (h *BlockHeader) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Timestamp        int64  `json:"timestamp"`
+		Nonce            int    `json:"nonce"`
+		PreviousHash     string `json:"previous_hash"`
+		TransactionsRoot string `json:"transactions_root"`
+	}{
+		Timestamp:        h.timestamp,
+		Nonce:            h.nonce,
+		PreviousHash:     fmt.Sprintf("%x", h.previousHash),
+		TransactionsRoot: fmt.Sprintf("%x", h.transactionsRoot),
+	})
+}
+
+func (h *BlockHeader) UnmarshalJSON(data []byte) error {
+	var previousHash, transactionsRoot string
+	v := &struct {
+		Timestamp        *int64  `json:"timestamp"`
+		Nonce            *int    `json:"nonce"`
+		PreviousHash     *string `json:"previous_hash"`
+		TransactionsRoot *string `json:"transactions_root"`
+	}{
+		Timestamp:        &h.timestamp,
+		Nonce:            &h.nonce,
+		PreviousHash:     &previousHash,
+		TransactionsRoot: &transactionsRoot,
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	ph, err := hex.DecodeString(previousHash)
+	if err != nil || len(ph) != 32 {
+		return fmt.Errorf("invalid previous_hash")
+	}
+	tr, err := hex.DecodeString(transactionsRoot)
+	if err != nil || len(tr) != 32 {
+		return fmt.Errorf("invalid transactions_root")
+	}
+	copy(h.previousHash[:], ph)
+	copy(h.transactionsRoot[:], tr)
+	return nil
+}
+
+func (b *Block) Header() *BlockHeader {
+	return &BlockHeader{
+		timestamp:        b.timestamp,
+		nonce:            b.nonce,
+		previousHash:     b.previousHash,
+		transactionsRoot: TransactionsRoot(b.transactions),
+	}
+}
+
+// TransactionsRoot is the merkle root of the transaction hashes. An odd
+// node at any level moves up unpaired: paired with itself, it would give
+// a list with the last transactions repeated the same root.
+func TransactionsRoot(transactions []*Transaction) [32]byte {
+	if len(transactions) == 0 {
+		return [32]byte{}
+	}
+	level := make([][32]byte, len(transactions))
+	for i, t := range transactions {
+		level[i] = t.Hash()
+	}
+	for len(level) > 1 {
+		next := make([][32]byte, (len(level)+1)/2)
+		for i := range next {
+			if 2*i+1 == len(level) {
+				next[i] = level[2*i]
+				continue
+			}
+			next[i] = sha256.Sum256(append(level[2*i][:], level[2*i+1][:]...))
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// BlockLocator lists hashes of our chain from the tip back to genesis,
+// dense near the tip and doubling the step after ten entries, so a peer
+// can find the last block we have in common in a few lookups.
+func (bc *Blockchain) BlockLocator() [][32]byte {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	locator := [][32]byte{}
+	step := 1
+	for i := len(bc.chain) - 1; i > 0; i -= step {
+		locator = append(locator, bc.chain[i].Hash())
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+	return append(locator, bc.chain[0].Hash())
+}
+
+// HeadersAfter returns up to limit headers following the first locator
+// hash found in our chain. When none is found the headers start at our
+// genesis block.
+func (bc *Blockchain) HeadersAfter(locator [][32]byte, limit int) []*BlockHeader {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	start := 0
+	for _, hash := range locator {
+		if i := bc.blockIndex(hash); i >= 0 {
+			start = i + 1
+			break
+		}
+	}
+	if limit <= 0 || limit > MAX_HEADERS_PER_REQUEST {
+		limit = MAX_HEADERS_PER_REQUEST
+	}
+	headers := []*BlockHeader{}
+	for i := start; i < len(bc.chain) && len(headers) < limit; i++ {
+		headers = append(headers, bc.chain[i].Header())
+	}
+	return headers
+}
+
+// HeadersResponse answers GET /headers.
+type HeadersResponse struct {
+	Headers []*BlockHeader `json:"headers"`
+	Height  int            `json:"height"`
+}
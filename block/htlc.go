@@ -0,0 +1,95 @@
+package block
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// HTLC is a hash time-locked contract. Funds sent to its script address
+// can be taken by the recipient with the preimage of Hash, or returned
+// to the sender once Deadline (a block height or unix time) has passed.
+type HTLC struct {
+	Hash               [32]byte
+	RecipientPublicKey []byte
+	SenderPublicKey    []byte
+	Deadline           int64
+}
+
+// Script returns the locking script:
+//
+//	OP_IF
+//	    OP_SHA256 <hash> OP_EQUALVERIFY <recipient key> OP_CHECKSIG
+//	OP_ELSE
+//	    <deadline> OP_CHECKLOCKTIMEVERIFY OP_DROP <sender key> OP_CHECKSIG
+//	OP_ENDIF
+func (h *HTLC) Script() []byte {
+	script := []byte{OP_IF, OP_SHA256}
+	script = append(script, PushData(h.Hash[:])...)
+	script = append(script, OP_EQUALVERIFY)
+	script = append(script, PushData(h.RecipientPublicKey)...)
+	script = append(script, OP_CHECKSIG, OP_ELSE)
+	script = append(script, PushData(ScriptNumber(h.Deadline))...)
+	script = append(script, OP_CHECKLOCKTIMEVERIFY, OP_DROP)
+	script = append(script, PushData(h.SenderPublicKey)...)
+	script = append(script, OP_CHECKSIG, OP_ENDIF)
+	return script
+}
+
+func (h *HTLC) Address() string {
+	return ScriptAddress(h.Script())
+}
+
+// RedeemWitness unlocks the recipient branch.
+func (h *HTLC) RedeemWitness(signature []byte, preimage []byte) [][]byte {
+	return [][]byte{signature, preimage, {1}}
+}
+
+// RefundWitness unlocks the sender branch. The refund transaction must
+// carry a lock time of at least Deadline.
+func (h *HTLC) RefundWitness(signature []byte) [][]byte {
+	return [][]byte{signature, {}}
+}
+
+// ParseHTLC recovers the contract from a script made by HTLC.Script.
+func ParseHTLC(script []byte) (*HTLC, bool) {
+	tokens := strings.Fields(DisassembleScript(script))
+	if len(tokens) != 13 {
+		return nil, false
+	}
+	hash, err1 := hex.DecodeString(tokens[2])
+	recipientKey, err2 := hex.DecodeString(tokens[4])
+	deadline, err3 := hex.DecodeString(tokens[7])
+	senderKey, err4 := hex.DecodeString(tokens[10])
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || len(hash) != 32 {
+		return nil, false
+	}
+	d, err := scriptNumberValue(deadline)
+	if err != nil {
+		return nil, false
+	}
+	h := &HTLC{RecipientPublicKey: recipientKey, SenderPublicKey: senderKey, Deadline: d}
+	copy(h.Hash[:], hash)
+	if !bytes.Equal(h.Script(), script) {
+		return nil, false
+	}
+	return h, true
+}
+
+// FindHTLCPreimage looks through chain for a redeem of the contract and
+// returns the preimage it revealed.
+func FindHTLCPreimage(chain []*Block, h *HTLC) ([]byte, bool) {
+	address := h.Address()
+	for _, b := range chain {
+		for _, t := range b.transactions {
+			if t.senderBlockchainAddress != address || len(t.witness) != 3 {
+				continue
+			}
+			if sha256.Sum256(t.witness[1]) == h.Hash {
+				return t.witness[1], true
+			}
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,78 @@
+package block
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func newTestHTLC(t *testing.T) *HTLC {
+	recipientKey, _ := hex.DecodeString(scriptTestKey0)
+	senderKey, _ := hex.DecodeString(scriptTestKey1)
+	hash, _ := hex.DecodeString(scriptTestHash)
+	h := &HTLC{RecipientPublicKey: recipientKey, SenderPublicKey: senderKey, Deadline: 100}
+	copy(h.Hash[:], hash)
+	parsed, ok := ParseHTLC(h.Script())
+	if !ok || !bytes.Equal(parsed.Script(), h.Script()) {
+		t.Fatal("HTLC script does not parse back")
+	}
+	return h
+}
+
+// The recipient takes the funds with the preimage at any time; the sender
+// takes them back only from the deadline on.
+func TestHTLC(t *testing.T) {
+	h := newTestHTLC(t)
+	recipientSig, _ := hex.DecodeString(scriptTestSig0)
+	senderSig, _ := hex.DecodeString(scriptTestSig1)
+	preimage, _ := hex.DecodeString(scriptTestPreimage)
+
+	tests := []struct {
+		name     string
+		witness  [][]byte
+		lockTime int64
+		valid    bool
+	}{
+		{"redeem", h.RedeemWitness(recipientSig, preimage), 0, true},
+		{"redeem wrong preimage", h.RedeemWitness(recipientSig, []byte("secreu")), 0, false},
+		{"redeem with the sender signature", h.RedeemWitness(senderSig, preimage), 0, false},
+		{"refund before the deadline", h.RefundWitness(senderSig), h.Deadline - 1, false},
+		{"refund at the deadline", h.RefundWitness(senderSig), h.Deadline, true},
+		{"refund after the deadline", h.RefundWitness(senderSig), h.Deadline + 1, true},
+		{"refund with the recipient signature", h.RefundWitness(recipientSig), h.Deadline, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := &ScriptContext{LockTime: tt.lockTime}
+			sigHash, _ := hex.DecodeString(scriptTestSigHash)
+			copy(ctx.SigHash[:], sigHash)
+			if err := RunScript(h.Script(), tt.witness, ctx); (err == nil) != tt.valid {
+				t.Fatalf("valid=%t err=%v", tt.valid, err)
+			}
+		})
+	}
+}
+
+// Only a redeem of the same contract reveals its preimage.
+func TestFindHTLCPreimage(t *testing.T) {
+	h := newTestHTLC(t)
+	recipientSig, _ := hex.DecodeString(scriptTestSig0)
+	senderSig, _ := hex.DecodeString(scriptTestSig1)
+	preimage, _ := hex.DecodeString(scriptTestPreimage)
+
+	other := *h
+	other.Deadline = 200
+	refund := NewScriptTransaction("sender", 1, h.Deadline, h.Script(), h.RefundWitness(senderSig))
+	wrong := NewScriptTransaction("recipient", 1, 0, h.Script(), h.RedeemWitness(recipientSig, []byte("secreu")))
+	elsewhere := NewScriptTransaction("recipient", 1, 0, other.Script(), other.RedeemWitness(recipientSig, preimage))
+	redeem := NewScriptTransaction("recipient", 1, 0, h.Script(), h.RedeemWitness(recipientSig, preimage))
+
+	chain := []*Block{NewBlock(0, 0, [32]byte{}, []*Transaction{refund, wrong, elsewhere})}
+	if _, ok := FindHTLCPreimage(chain, h); ok {
+		t.Fatal("preimage found before the redeem")
+	}
+	chain = append(chain, NewBlock(1, 0, chain[0].Hash(), []*Transaction{redeem}))
+	if found, ok := FindHTLCPreimage(chain, h); !ok || !bytes.Equal(found, preimage) {
+		t.Fatalf("found %x, want %x", found, preimage)
+	}
+}
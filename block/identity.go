@@ -0,0 +1,321 @@
+package block
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"goblockchain/utils"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	REQUEST_SIGNATURE_WINDOW_SEC = 60    // How far a signed request's timestamp may be off
+	MAX_SEEN_REQUESTS            = 10000 // Signed requests remembered to refuse replays
+	MAX_SIGNED_BODY_BYTES        = 1 << 20
+
+	HEADER_NODE_ID        = "X-Node-Id"
+	HEADER_NODE_TIMESTAMP = "X-Node-Timestamp"
+	HEADER_NODE_NONCE     = "X-Node-Nonce"
+	HEADER_NODE_SIGNATURE = "X-Node-Signature"
+)
+
+// NewIdentityKey creates a node identity key.
+func NewIdentityKey() *ecdsa.PrivateKey {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	return key
+}
+
+// LoadIdentityKey reads the identity key kept in path, creating the file
+// with a new key when it does not exist yet.
+func LoadIdentityKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		key := NewIdentityKey()
+		if err := os.WriteFile(path, []byte(fmt.Sprintf("%064x\n", key.D)), 0600); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	d, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(d) != 32 {
+		return nil, fmt.Errorf("%s: invalid identity key", path)
+	}
+	key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	key.PublicKey.Curve = elliptic.P256()
+	key.PublicKey.X, key.PublicKey.Y = elliptic.P256().ScalarBaseMult(d)
+	return key, nil
+}
+
+func publicKeyString(pub *ecdsa.PublicKey) string {
+	return fmt.Sprintf("%064x%064x", pub.X, pub.Y)
+}
+
+// NodeIDFromPublicKey derives the ID of the node with the hex encoded
+// identity key publicKey.
+func NodeIDFromPublicKey(publicKey string) string {
+	h := sha256.Sum256([]byte(publicKey))
+	return fmt.Sprintf("%x", h[:16])
+}
+
+// parsePublicKey returns nil when s is not a hex encoded P-256 point.
+func parsePublicKey(s string) *ecdsa.PublicKey {
+	if len(s) != 128 {
+		return nil
+	}
+	if _, err := hex.DecodeString(s); err != nil {
+		return nil
+	}
+	pub := utils.PublicKeyFromString(s)
+	if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+		return nil
+	}
+	return pub
+}
+
+// verifySignature checks signature, as hex encoded r and s, of h against
+// the public key publicKey.
+func verifySignature(publicKey string, h [32]byte, signature string) bool {
+	pub := parsePublicKey(publicKey)
+	if pub == nil || len(signature) != 128 {
+		return false
+	}
+	if _, err := hex.DecodeString(signature); err != nil {
+		return false
+	}
+	s := utils.SignatureFromString(signature)
+	return ecdsa.Verify(pub, h[:], s.R, s.S)
+}
+
+// SetIdentityKey makes key the identity of this node. The node ID is
+// derived from it, so a node keeps its ID across restarts.
+func (bc *Blockchain) SetIdentityKey(key *ecdsa.PrivateKey) {
+	bc.identityKey = key
+	bc.nodeID = NodeIDFromPublicKey(bc.PublicKey())
+}
+
+// IdentityKeyString is the hex encoded public part of an identity key,
+// as trusted_nodes and admin_keys list them.
+func IdentityKeyString(key *ecdsa.PrivateKey) string {
+	return publicKeyString(&key.PublicKey)
+}
+
+// PublicKey is the public identity key of this node.
+func (bc *Blockchain) PublicKey() string {
+	return publicKeyString(&bc.identityKey.PublicKey)
+}
+
+func (bc *Blockchain) sign(h [32]byte) string {
+	return signHash(bc.identityKey, h)
+}
+
+func signHash(key *ecdsa.PrivateKey, h [32]byte) string {
+	r, s, _ := ecdsa.Sign(rand.Reader, key, h[:])
+	return (&utils.Signature{R: r, S: s}).String()
+}
+
+// handshakeHash is what the signature of a handshake covers: all of its
+// other fields.
+func handshakeHash(h *Handshake) [32]byte {
+	unsigned := *h
+	unsigned.Signature = ""
+	m, _ := json.Marshal(unsigned)
+	return sha256.Sum256(m)
+}
+
+// verifyHandshake checks that h was signed by the key it carries and
+// that the node ID belongs to that key.
+func verifyHandshake(h *Handshake) error {
+	if parsePublicKey(h.PublicKey) == nil {
+		return fmt.Errorf("invalid public key")
+	}
+	if h.NodeID != NodeIDFromPublicKey(h.PublicKey) {
+		return fmt.Errorf("node ID %s does not match its key", h.NodeID)
+	}
+	if !verifySignature(h.PublicKey, handshakeHash(h), h.Signature) {
+		return fmt.Errorf("invalid handshake signature")
+	}
+	return nil
+}
+
+// messageHash is what the signature of a peer message covers. The
+// challenge is the hello nonce of the receiver and the sequence number
+// counts the messages sent over the connection, so a message cannot be
+// replayed on another connection or later on the same one.
+func messageHash(challenge string, m *Message) [32]byte {
+	h := sha256.New()
+	h.Write([]byte(challenge))
+	h.Write(binary.BigEndian.AppendUint64(nil, m.Sequence))
+	h.Write([]byte(m.Type))
+	h.Write([]byte{0})
+	h.Write(m.Payload)
+	var sum [32]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// requestHash is what the signature of a request covers: all of it but
+// the headers. The nonce tells apart identical requests sent within the
+// same second.
+func requestHash(r *http.Request, nodeID string, timestamp string, nonce string) ([32]byte, error) {
+	body, err := readBody(r)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	bodyHash := sha256.Sum256(body)
+	return sha256.Sum256([]byte(r.Method + " " + r.URL.Path + "?" + r.URL.RawQuery + "\n" +
+		nodeID + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(bodyHash[:]))), nil
+}
+
+// readBody reads the body of r and puts it back, for the handler or the
+// client to read again.
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, MAX_SIGNED_BODY_BYTES+1))
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > MAX_SIGNED_BODY_BYTES {
+		return nil, fmt.Errorf("request body over %d bytes", MAX_SIGNED_BODY_BYTES)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// SignRequest adds the headers proving r was sent by this node.
+func (bc *Blockchain) SignRequest(r *http.Request) error {
+	return SignRequestWith(bc.identityKey, r)
+}
+
+// SignRequestWith adds the headers proving r was sent by the holder of
+// the identity key key, e.g. an admin.
+func SignRequestWith(key *ecdsa.PrivateKey, r *http.Request) error {
+	nodeID := NodeIDFromPublicKey(IdentityKeyString(key))
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := newNonce()
+	h, err := requestHash(r, nodeID, timestamp, nonce)
+	if err != nil {
+		return err
+	}
+	r.Header.Set(HEADER_NODE_ID, nodeID)
+	r.Header.Set(HEADER_NODE_TIMESTAMP, timestamp)
+	r.Header.Set(HEADER_NODE_NONCE, nonce)
+	r.Header.Set(HEADER_NODE_SIGNATURE, signHash(key, h))
+	return nil
+}
+
+// SetTrustedNodes sets the identity keys, hex encoded, of the nodes
+// besides this one whose signed requests are served. Completing a
+// handshake proves a node holds its key, not that it may be trusted.
+func (bc *Blockchain) SetTrustedNodes(publicKeys []string) error {
+	trusted, err := keysByNodeID(publicKeys)
+	if err != nil {
+		return err
+	}
+	bc.muxPeers.Lock()
+	defer bc.muxPeers.Unlock()
+	bc.trustedNodes = trusted
+	return nil
+}
+
+// SetAdminKeys sets the identity keys, hex encoded, whose signed
+// requests are served by admin endpoints. The key of this node is one.
+func (bc *Blockchain) SetAdminKeys(publicKeys []string) error {
+	admins, err := keysByNodeID(publicKeys)
+	if err != nil {
+		return err
+	}
+	bc.muxPeers.Lock()
+	defer bc.muxPeers.Unlock()
+	bc.adminKeys = admins
+	return nil
+}
+
+// IsAdmin reports whether nodeID, as returned by VerifyRequest, signed
+// with an admin key.
+func (bc *Blockchain) IsAdmin(nodeID string) bool {
+	if nodeID == bc.nodeID {
+		return true
+	}
+	bc.muxPeers.Lock()
+	defer bc.muxPeers.Unlock()
+	_, ok := bc.adminKeys[nodeID]
+	return ok
+}
+
+func keysByNodeID(publicKeys []string) (map[string]string, error) {
+	keys := make(map[string]string)
+	for _, k := range publicKeys {
+		if parsePublicKey(k) == nil {
+			return nil, fmt.Errorf("invalid identity key %q", k)
+		}
+		keys[NodeIDFromPublicKey(k)] = k
+	}
+	return keys, nil
+}
+
+// VerifyRequest checks that r was signed by this node, a trusted node or
+// an admin key, and was not seen before. It returns the node ID of the
+// signer.
+func (bc *Blockchain) VerifyRequest(r *http.Request) (string, error) {
+	nodeID := r.Header.Get(HEADER_NODE_ID)
+	timestamp := r.Header.Get(HEADER_NODE_TIMESTAMP)
+	nonce := r.Header.Get(HEADER_NODE_NONCE)
+	signature := r.Header.Get(HEADER_NODE_SIGNATURE)
+	if nodeID == "" || timestamp == "" || nonce == "" || signature == "" {
+		return "", fmt.Errorf("unsigned request")
+	}
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid timestamp %q", timestamp)
+	}
+	if d := time.Now().Unix() - sec; d > REQUEST_SIGNATURE_WINDOW_SEC || d < -REQUEST_SIGNATURE_WINDOW_SEC {
+		return "", fmt.Errorf("request signed %d sec ago", d)
+	}
+	publicKey := bc.peerPublicKey(nodeID)
+	if publicKey == "" {
+		return "", fmt.Errorf("unknown node %s", nodeID)
+	}
+	h, err := requestHash(r, nodeID, timestamp, nonce)
+	if err != nil {
+		return "", err
+	}
+	if !verifySignature(publicKey, h, signature) {
+		return "", fmt.Errorf("invalid signature from node %s", nodeID)
+	}
+	if !bc.seenRequests.Add(sha256.Sum256([]byte(nodeID + "\n" + nonce))) {
+		return "", fmt.Errorf("replayed request from node %s", nodeID)
+	}
+	return nodeID, nil
+}
+
+// peerPublicKey returns the identity key of the node nodeID, if it is
+// this node, a trusted one or an admin.
+func (bc *Blockchain) peerPublicKey(nodeID string) string {
+	if nodeID == bc.nodeID {
+		return bc.PublicKey()
+	}
+	bc.muxPeers.Lock()
+	defer bc.muxPeers.Unlock()
+	if k, ok := bc.trustedNodes[nodeID]; ok {
+		return k
+	}
+	return bc.adminKeys[nodeID]
+}
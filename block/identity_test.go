@@ -0,0 +1,138 @@
+package block
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func newSignedRequest(signer *Blockchain) *http.Request {
+	r, _ := http.NewRequest(http.MethodPut, "http://127.0.0.1:5000/consensus", nil)
+	signer.SignRequest(r)
+	return r
+}
+
+// Only this node and the trusted ones may send signed requests, not any
+// node that completed a handshake.
+func TestVerifyRequestSigners(t *testing.T) {
+	bc := NewBlockchain("miner", 5000)
+	peer := NewBlockchain("peer", 5001)
+	peer.SetPeerConfig("127.0.0.1", nil, "")
+	if err := bc.AcceptHandshake(peer.Handshake(), "127.0.0.1:40000"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := bc.VerifyRequest(newSignedRequest(bc)); err != nil {
+		t.Fatalf("request of the node itself refused: %v", err)
+	}
+	if _, err := bc.VerifyRequest(newSignedRequest(peer)); err == nil {
+		t.Fatal("request of an untrusted peer accepted")
+	}
+	if err := bc.SetTrustedNodes([]string{peer.PublicKey()}); err != nil {
+		t.Fatal(err)
+	}
+	if nodeID, err := bc.VerifyRequest(newSignedRequest(peer)); err != nil || nodeID != peer.NodeID() {
+		t.Fatalf("request of a trusted peer: %s, %v", nodeID, err)
+	}
+	if err := bc.SetTrustedNodes([]string{"01"}); err == nil {
+		t.Fatal("invalid trusted key accepted")
+	}
+}
+
+func TestVerifyRequestReplay(t *testing.T) {
+	bc := NewBlockchain("miner", 5000)
+	r := newSignedRequest(bc)
+	if _, err := bc.VerifyRequest(r); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bc.VerifyRequest(r); err == nil {
+		t.Fatal("replayed request accepted")
+	}
+}
+
+// Identical requests sent within the same second differ by their nonce.
+func TestVerifyRequestNonce(t *testing.T) {
+	bc := NewBlockchain("miner", 5000)
+	first, second := newSignedRequest(bc), newSignedRequest(bc)
+	for _, r := range []*http.Request{first, second} {
+		if _, err := bc.VerifyRequest(r); err != nil {
+			t.Fatalf("identical request refused: %v", err)
+		}
+	}
+	tampered := newSignedRequest(bc)
+	tampered.Header.Set(HEADER_NODE_NONCE, first.Header.Get(HEADER_NODE_NONCE)+"00")
+	if _, err := bc.VerifyRequest(tampered); err == nil {
+		t.Fatal("request with a nonce it was not signed with accepted")
+	}
+}
+
+// Admin keys sign requests without being trusted nodes, and trusted nodes
+// are not admins.
+func TestAdminKeys(t *testing.T) {
+	bc := NewBlockchain("miner", 5000)
+	peer := NewBlockchain("peer", 5001)
+	admin, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.SetTrustedNodes([]string{peer.PublicKey()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.SetAdminKeys([]string{IdentityKeyString(admin)}); err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := http.NewRequest(http.MethodDelete, "http://127.0.0.1:5000/transactions", nil)
+	SignRequestWith(admin, r)
+	nodeID, err := bc.VerifyRequest(r)
+	if err != nil || !bc.IsAdmin(nodeID) {
+		t.Fatalf("admin request refused: %s, %v", nodeID, err)
+	}
+	nodeID, err = bc.VerifyRequest(newSignedRequest(peer))
+	if err != nil || bc.IsAdmin(nodeID) {
+		t.Fatalf("trusted node taken for an admin: %s, %v", nodeID, err)
+	}
+	if !bc.IsAdmin(bc.NodeID()) {
+		t.Fatal("node key is not an admin")
+	}
+	if err := bc.SetAdminKeys([]string{"01"}); err == nil {
+		t.Fatal("invalid admin key accepted")
+	}
+}
+
+// The query and the body are signed along with the path: the IP of a ban
+// cannot be swapped in transit.
+func TestVerifyRequestCoversQueryAndBody(t *testing.T) {
+	bc := NewBlockchain("miner", 5000)
+	const body = `{"ip": "203.0.113.7"}`
+	newBan := func() *http.Request {
+		r, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1:5000/peers/ban?duration_sec=60", strings.NewReader(body))
+		if err := bc.SignRequest(r); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	r := newBan()
+	if _, err := bc.VerifyRequest(r); err != nil {
+		t.Fatalf("signed request refused: %v", err)
+	}
+	if read, _ := io.ReadAll(r.Body); string(read) != body {
+		t.Fatalf("handler reads %q, want %q", read, body)
+	}
+
+	r = newBan()
+	r.Body = io.NopCloser(strings.NewReader(`{"ip": "198.51.100.1"}`))
+	if _, err := bc.VerifyRequest(r); err == nil {
+		t.Fatal("request with another body accepted")
+	}
+	r = newBan()
+	r.URL.RawQuery = "duration_sec=999999"
+	if _, err := bc.VerifyRequest(r); err == nil {
+		t.Fatal("request with another query accepted")
+	}
+}
@@ -0,0 +1,167 @@
+package block
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	BLOOM_SIZE         = 256 // Bytes, 2048 bits
+	VM_MAX_LOG_TOPICS  = 4
+	LOG_GAS            = 100
+	LOG_GAS_PER_TOPIC  = 50
+	MAX_LOG_BLOCK_SPAN = 10000 // Widest block range one /logs query may scan
+)
+
+// Log is an event emitted by the LOG opcode of a contract.
+type Log struct {
+	address         string
+	topics          []int64
+	data            int64
+	blockHeight     int
+	transactionHash [32]byte
+	logIndex        int
+}
+
+func (l *Log) Address() string {
+	return l.address
+}
+
+func (l *Log) Topics() []int64 {
+	return l.topics
+}
+
+func (l *Log) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Address         string  `json:"contract_address"`
+		Topics          []int64 `json:"topics"`
+		Data            int64   `json:"data"`
+		BlockHeight     int     `json:"block_height"`
+		TransactionHash string  `json:"transaction_hash"`
+		LogIndex        int     `json:"log_index"`
+	}{
+		Address:         l.address,
+		Topics:          l.topics,
+		Data:            l.data,
+		BlockHeight:     l.blockHeight,
+		TransactionHash: fmt.Sprintf("%x", l.transactionHash),
+		LogIndex:        l.logIndex,
+	})
+}
+
+// Bloom is a bloom filter over the addresses and topics of logs. Every
+// entry sets three bits taken from its SHA-256 hash.
+type Bloom [BLOOM_SIZE]byte
+
+func topicBytes(topic int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(topic))
+}
+
+func bloomBits(data []byte) [3]uint {
+	h := sha256.Sum256(data)
+	var bits [3]uint
+	for i := range bits {
+		bits[i] = uint(binary.BigEndian.Uint16(h[i*2:])) % (BLOOM_SIZE * 8)
+	}
+	return bits
+}
+
+func (b *Bloom) Add(data []byte) {
+	for _, bit := range bloomBits(data) {
+		b[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// Test reports whether data may have been added. False positives are
+// possible, false negatives are not.
+func (b *Bloom) Test(data []byte) bool {
+	for _, bit := range bloomBits(data) {
+		if b[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *Bloom) addLog(l *Log) {
+	b.Add([]byte(l.address))
+	for _, t := range l.topics {
+		b.Add(topicBytes(t))
+	}
+}
+
+func (b *Bloom) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fmt.Sprintf("%x", b[:]))
+}
+
+// matches reports whether l was emitted by address (any when empty) and
+// carries every one of topics.
+func (l *Log) matches(address string, topics []int64) bool {
+	if address != "" && l.address != address {
+		return false
+	}
+	for _, want := range topics {
+		found := false
+		for _, t := range l.topics {
+			if t == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// BlockBloom returns the bloom filter over all logs of the block at height.
+func (bc *Blockchain) BlockBloom(height int) *Bloom {
+	bc.muxState.RLock()
+	defer bc.muxState.RUnlock()
+	if height < 0 || height >= len(bc.blooms) {
+		return nil
+	}
+	return bc.blooms[height]
+}
+
+// FilterLogs returns the logs of blocks fromBlock to toBlock (inclusive)
+// matching address and topics. Blocks whose bloom filter rules out a
+// match are skipped without looking at their receipts.
+func (bc *Blockchain) FilterLogs(address string, topics []int64, fromBlock int, toBlock int) []*Log {
+	bc.muxState.RLock()
+	defer bc.muxState.RUnlock()
+	logs := []*Log{}
+	if fromBlock < 0 {
+		fromBlock = 0
+	}
+	if toBlock >= len(bc.receipts) {
+		toBlock = len(bc.receipts) - 1
+	}
+	for height := fromBlock; height <= toBlock; height++ {
+		bloom := bc.blooms[height]
+		if address != "" && !bloom.Test([]byte(address)) {
+			continue
+		}
+		skip := false
+		for _, t := range topics {
+			if !bloom.Test(topicBytes(t)) {
+				skip = true
+				break
+			}
+		}
+		if skip {
+			continue
+		}
+		for _, r := range bc.receipts[height] {
+			for _, l := range r.logs {
+				if l.matches(address, topics) {
+					logs = append(logs, l)
+				}
+			}
+		}
+	}
+	return logs
+}
@@ -0,0 +1,184 @@
+package block
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	MAX_ORPHAN_BLOCKS = 100
+	ORPHAN_EXPIRY_SEC = 600
+	MAX_ORPHAN_DEPTH  = 50 // Missing ancestors requested one by one before resolving conflicts instead
+)
+
+// orphanBlock is a block whose parent is not known yet.
+type orphanBlock struct {
+	block    *Block
+	sender   string // Peer it came from, asked for its ancestors
+	received time.Time
+}
+
+// orphanPool keeps orphan blocks until their parent arrives, indexed by
+// their own hash and by the hash of the missing parent.
+type orphanPool struct {
+	blocks   map[[32]byte]*orphanBlock
+	byParent map[[32]byte]map[[32]byte]bool
+	max      int
+	mux      sync.Mutex
+}
+
+func newOrphanPool(max int) *orphanPool {
+	return &orphanPool{
+		blocks:   make(map[[32]byte]*orphanBlock),
+		byParent: make(map[[32]byte]map[[32]byte]bool),
+		max:      max,
+	}
+}
+
+// Add keeps b and reports whether it was new. Expired orphans are
+// dropped first; if the pool is still full, the oldest one makes room.
+func (op *orphanPool) Add(b *Block, sender string) bool {
+	op.mux.Lock()
+	defer op.mux.Unlock()
+	h := b.Hash()
+	if _, ok := op.blocks[h]; ok {
+		return false
+	}
+	op.expire()
+	if len(op.blocks) >= op.max {
+		var oldest *orphanBlock
+		for _, o := range op.blocks {
+			if oldest == nil || o.received.Before(oldest.received) {
+				oldest = o
+			}
+		}
+		op.remove(oldest.block.Hash())
+	}
+	op.blocks[h] = &orphanBlock{block: b, sender: sender, received: time.Now()}
+	if op.byParent[b.previousHash] == nil {
+		op.byParent[b.previousHash] = make(map[[32]byte]bool)
+	}
+	op.byParent[b.previousHash][h] = true
+	return true
+}
+
+func (op *orphanPool) Has(h [32]byte) bool {
+	op.mux.Lock()
+	defer op.mux.Unlock()
+	_, ok := op.blocks[h]
+	return ok
+}
+
+func (op *orphanPool) Len() int {
+	op.mux.Lock()
+	defer op.mux.Unlock()
+	return len(op.blocks)
+}
+
+func (op *orphanPool) Remove(h [32]byte) {
+	op.mux.Lock()
+	defer op.mux.Unlock()
+	op.remove(h)
+}
+
+func (op *orphanPool) remove(h [32]byte) {
+	o, ok := op.blocks[h]
+	if !ok {
+		return
+	}
+	delete(op.blocks, h)
+	children := op.byParent[o.block.previousHash]
+	delete(children, h)
+	if len(children) == 0 {
+		delete(op.byParent, o.block.previousHash)
+	}
+}
+
+func (op *orphanPool) expire() {
+	deadline := time.Now().Add(-ORPHAN_EXPIRY_SEC * time.Second)
+	for h, o := range op.blocks {
+		if o.received.Before(deadline) {
+			op.remove(h)
+		}
+	}
+}
+
+// Root follows the parents of the orphan h through the pool and returns
+// the oldest one, whose parent is missing, and how many orphans lead
+// there.
+func (op *orphanPool) Root(h [32]byte) (*orphanBlock, int) {
+	op.mux.Lock()
+	defer op.mux.Unlock()
+	o := op.blocks[h]
+	depth := 1
+	for o != nil {
+		parent, ok := op.blocks[o.block.previousHash]
+		if !ok {
+			break
+		}
+		o = parent
+		depth++
+	}
+	return o, depth
+}
+
+// Branch returns the longest chain of orphans descending from parent,
+// oldest first.
+func (op *orphanPool) Branch(parent [32]byte) []*orphanBlock {
+	op.mux.Lock()
+	defer op.mux.Unlock()
+	return op.branch(parent)
+}
+
+func (op *orphanPool) branch(parent [32]byte) []*orphanBlock {
+	var longest []*orphanBlock
+	for h := range op.byParent[parent] {
+		if b := op.branch(h); len(b)+1 > len(longest) {
+			longest = append([]*orphanBlock{op.blocks[h]}, b...)
+		}
+	}
+	return longest
+}
+
+// addOrphan keeps b until its parent arrives and asks sender for the
+// missing ancestor. Once too many are missing in a row, the chain is
+// synced headers-first instead. Blocks without proof of work are not
+// kept.
+func (bc *Blockchain) addOrphan(b *Block, sender string) bool {
+	if !bc.ValidProof(b.Header(), bc.spec.Difficulty) {
+		log.Println("ERROR: Orphan block without proof of work")
+		bc.peerManager.Misbehaving(sender, PENALTY_INVALID_BLOCK, "invalid orphan block")
+		return false
+	}
+	if !bc.orphans.Add(b, sender) {
+		return true
+	}
+	root, depth := bc.orphans.Root(b.Hash())
+	log.Printf("action=receive_block, status=orphan, depth=%d, orphans=%d", depth, bc.orphans.Len())
+	if depth > MAX_ORPHAN_DEPTH {
+		log.Println("action=receive_block, status=fallback_resolve_conflicts")
+		go bc.ResolveConflicts()
+		return true
+	}
+	bc.requestBlock(sender, root.block.previousHash)
+	return true
+}
+
+// requestBlock asks the peer at address for the block with hash, over
+// its connection when there is one, else over HTTP. The block is handled
+// by ReceiveBlock when it arrives.
+func (bc *Blockchain) requestBlock(address string, hash [32]byte) {
+	for _, p := range bc.ConnectedPeers() {
+		if p.address == address {
+			p.Send(NewMessage(MSG_GETDATA, []*InvItem{{INV_BLOCK, fmt.Sprintf("%x", hash)}}))
+			return
+		}
+	}
+	go func() {
+		if b := bc.fetchBlock(address, hash); b != nil {
+			bc.ReceiveBlock(b, address)
+		}
+	}()
+}
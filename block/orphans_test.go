@@ -0,0 +1,23 @@
+package block
+
+import "testing"
+
+// Orphans cannot be checked against their parent, but their proof of work
+// can: blocks without one are neither pooled nor forgiven.
+func TestOrphanWithoutProofOfWork(t *testing.T) {
+	bc := NewBlockchain("miner", 0)
+	const sender = "203.0.113.9:5000"
+	b := NewBlock(1, 0, [32]byte{1}, []*Transaction{newCoinbase("other", 1)})
+	for bc.ValidProof(b.Header(), bc.spec.Difficulty) {
+		b.nonce++
+	}
+	if bc.ReceiveBlock(b, sender) {
+		t.Fatal("orphan without proof of work accepted")
+	}
+	if bc.orphans.Len() != 0 {
+		t.Fatalf("%d orphans pooled, want 0", bc.orphans.Len())
+	}
+	if p := bc.peerManager.peers["203.0.113.9"]; p == nil || p.score != PENALTY_INVALID_BLOCK {
+		t.Fatal("sender not penalized")
+	}
+}
@@ -0,0 +1,616 @@
+package block
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	P2P_PROTOCOL          = "goblockchain-p2p/1" // Upgrade token of GET /p2p
+	MAX_MESSAGE_SIZE      = 32 << 20
+	PEER_SEND_QUEUE_SIZE  = 256 // Messages queued per peer before new ones are dropped
+	PING_INTERVAL_SEC     = 15
+	PEER_IDLE_TIMEOUT_SEC = 60 // A peer silent for this long is disconnected
+	P2P_HELLO_TIMEOUT_SEC = 5
+	P2P_RECONNECT_SEC     = 5
+	P2P_MAX_BACKOFF_SEC   = 300
+
+	MSG_HELLO    = "hello"
+	MSG_PING     = "ping"
+	MSG_PONG     = "pong"
+	MSG_INV      = "inv"
+	MSG_GETDATA  = "getdata"
+	MSG_NOTFOUND = "notfound"
+	MSG_BLOCK    = "block"
+	MSG_TX       = "tx"
+
+	MSG_CMPCTBLOCK  = "cmpctblock"
+	MSG_GETBLOCKTXN = "getblocktxn"
+	MSG_BLOCKTXN    = "blocktxn"
+
+	INV_BLOCK         = "block"
+	INV_TX            = "tx"
+	INV_COMPACT_BLOCK = "cmpctblock" // Only in getdata, answered with a compact block
+)
+
+// Message is a frame of the peer protocol: a 4 byte big-endian length
+// followed by this struct as JSON. Every message after the hello is
+// signed with the identity key of the sender.
+type Message struct {
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	Sequence  uint64          `json:"sequence,omitempty"`
+	Signature string          `json:"signature,omitempty"`
+}
+
+// InvItem announces (inv) or requests (getdata) a block or transaction.
+type InvItem struct {
+	Type string `json:"type"`
+	Hash string `json:"hash"`
+}
+
+func NewMessage(messageType string, payload interface{}) *Message {
+	m := &Message{Type: messageType}
+	if payload != nil {
+		m.Payload, _ = json.Marshal(payload)
+	}
+	return m
+}
+
+func WriteMessage(w io.Writer, m *Message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	frame := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(data)), uint32(len(data)))
+	_, err = w.Write(append(frame, data...))
+	return err
+}
+
+func ReadMessage(r io.Reader) (*Message, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > MAX_MESSAGE_SIZE {
+		return nil, fmt.Errorf("message of %d bytes too large", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	var m Message
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// Peer is a long-lived connection to a neighbor. Messages are queued and
+// written by a goroutine of their own, so sending never blocks.
+type Peer struct {
+	address     string // HTTP address of the neighbor
+	ip          string // Of the connection, which its requests are rate limited by
+	nodeID      string
+	publicKey   string
+	challenge   string // Our hello nonce, which the peer signs its messages with
+	peerNonce   string // Its hello nonce, which we sign our messages with
+	sendSeq     uint64 // Only used by the write loop
+	recvSeq     uint64 // Only used by the read loop
+	inbound     bool
+	conn        net.Conn
+	reader      io.Reader
+	send        chan *Message
+	closed      chan struct{}
+	closeOnce   sync.Once
+	connectedAt int64
+	lastSeen    atomic.Int64 // Unix time of the last message received
+	pingNonce   atomic.Int64
+	pingSentAt  atomic.Int64 // UnixNano
+	pingMs      atomic.Int64 // Round trip of the last answered ping
+	dropped     atomic.Uint64
+	known       *inventorySet // Blocks and transactions the peer has or was told about
+	invQueue    []*InvItem    // Transaction announcements of the next batch
+	muxInv      sync.Mutex
+
+	compact       bool // Peer understands compact blocks
+	partialBlocks map[[32]byte]*partialBlock
+	muxPartial    sync.Mutex
+}
+
+// ConnectionInfo is the public view of a peer connection.
+type ConnectionInfo struct {
+	Address     string `json:"address"`
+	NodeID      string `json:"node_id"`
+	Inbound     bool   `json:"inbound"`
+	ConnectedAt int64  `json:"connected_at"`
+	LastSeen    int64  `json:"last_seen"`
+	PingMs      int64  `json:"ping_ms"`
+	Dropped     uint64 `json:"dropped"` // Messages dropped on a full send queue
+}
+
+func newPeer(conn net.Conn, reader io.Reader, address string, h *Handshake, challenge string, inbound bool) *Peer {
+	p := &Peer{
+		address:     address,
+		ip:          PeerIP(conn.RemoteAddr().String()),
+		nodeID:      h.NodeID,
+		publicKey:   h.PublicKey,
+		challenge:   challenge,
+		peerNonce:   h.Nonce,
+		inbound:     inbound,
+		conn:        conn,
+		reader:      reader,
+		send:        make(chan *Message, PEER_SEND_QUEUE_SIZE),
+		closed:      make(chan struct{}),
+		connectedAt: time.Now().Unix(),
+		known:       newInventorySet(MAX_KNOWN_INVENTORY),
+
+		compact:       hasFeature(h.Features, FEATURE_COMPACT_BLOCKS),
+		partialBlocks: make(map[[32]byte]*partialBlock),
+	}
+	p.lastSeen.Store(p.connectedAt)
+	return p
+}
+
+func (p *Peer) Address() string {
+	return p.address
+}
+
+// Send queues m and reports whether there was room for it.
+func (p *Peer) Send(m *Message) bool {
+	select {
+	case p.send <- m:
+		return true
+	case <-p.closed:
+		return false
+	default:
+		p.dropped.Add(1)
+		return false
+	}
+}
+
+func (p *Peer) Close() {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		p.conn.Close()
+	})
+}
+
+func (p *Peer) info() *ConnectionInfo {
+	return &ConnectionInfo{
+		Address:     p.address,
+		NodeID:      p.nodeID,
+		Inbound:     p.inbound,
+		ConnectedAt: p.connectedAt,
+		LastSeen:    p.lastSeen.Load(),
+		PingMs:      p.pingMs.Load(),
+		Dropped:     p.dropped.Load(),
+	}
+}
+
+// verify checks that m is the next message signed by the peer.
+func (p *Peer) verify(m *Message) bool {
+	if m.Sequence != p.recvSeq || !verifySignature(p.publicKey, messageHash(p.challenge, m), m.Signature) {
+		return false
+	}
+	p.recvSeq++
+	return true
+}
+
+func (bc *Blockchain) writeLoop(p *Peer) {
+	ticker := time.NewTicker(PING_INTERVAL_SEC * time.Second)
+	defer ticker.Stop()
+	batch := time.NewTicker(INV_BATCH_INTERVAL_MS * time.Millisecond)
+	defer batch.Stop()
+	defer p.Close()
+	for {
+		var m *Message
+		select {
+		case m = <-p.send:
+		case <-batch.C:
+			p.flushInv()
+			continue
+		case <-ticker.C:
+			nonce := rand.Int63()
+			p.pingNonce.Store(nonce)
+			p.pingSentAt.Store(time.Now().UnixNano())
+			m = NewMessage(MSG_PING, nonce)
+		case <-p.closed:
+			return
+		}
+		// m may be shared with other peers, so a copy is signed.
+		signed := *m
+		signed.Sequence = p.sendSeq
+		signed.Signature = bc.sign(messageHash(p.peerNonce, &signed))
+		p.sendSeq++
+		p.conn.SetWriteDeadline(time.Now().Add(PEER_IDLE_TIMEOUT_SEC * time.Second))
+		if err := WriteMessage(p.conn, &signed); err != nil {
+			log.Printf("ERROR: %s: %v", p.address, err)
+			return
+		}
+	}
+}
+
+func (bc *Blockchain) readLoop(p *Peer) {
+	defer bc.removePeer(p)
+	for {
+		p.conn.SetReadDeadline(time.Now().Add(PEER_IDLE_TIMEOUT_SEC * time.Second))
+		m, err := ReadMessage(p.reader)
+		if err != nil {
+			log.Printf("action=disconnect, peer=%s, reason=%v", p.address, err)
+			return
+		}
+		if !p.verify(m) {
+			log.Printf("action=disconnect, peer=%s, reason=bad signature on %s message", p.address, m.Type)
+			bc.peerManager.Misbehaving(p.address, PENALTY_INVALID_SIGNATURE, "bad message signature")
+			return
+		}
+		p.lastSeen.Store(time.Now().Unix())
+		if !bc.peerManager.Allow(p.ip) {
+			continue
+		}
+		if !bc.handleMessage(p, m) {
+			return
+		}
+	}
+}
+
+// handleMessage acts on a message from p and reports whether the
+// connection should be kept.
+func (bc *Blockchain) handleMessage(p *Peer, m *Message) bool {
+	switch m.Type {
+	case MSG_PING:
+		p.Send(&Message{Type: MSG_PONG, Payload: m.Payload})
+	case MSG_PONG:
+		var nonce int64
+		if json.Unmarshal(m.Payload, &nonce) == nil && nonce == p.pingNonce.Load() {
+			p.pingMs.Store((time.Now().UnixNano() - p.pingSentAt.Load()) / int64(time.Millisecond))
+		}
+	case MSG_INV:
+		var items []*InvItem
+		if err := json.Unmarshal(m.Payload, &items); err != nil {
+			return false
+		}
+		bc.handleInv(p, items)
+	case MSG_GETDATA:
+		var items []*InvItem
+		if err := json.Unmarshal(m.Payload, &items); err != nil {
+			return false
+		}
+		bc.handleGetData(p, items)
+	case MSG_BLOCK:
+		var b Block
+		if err := json.Unmarshal(m.Payload, &b); err != nil {
+			bc.peerManager.Misbehaving(p.address, PENALTY_INVALID_BLOCK, "malformed block")
+			return !bc.peerManager.IsBanned(p.address)
+		}
+		p.known.Add(b.Hash())
+		bc.ReceiveBlock(&b, p.address)
+	case MSG_CMPCTBLOCK:
+		var cb CompactBlock
+		if err := json.Unmarshal(m.Payload, &cb); err != nil || !cb.Validate() {
+			bc.peerManager.Misbehaving(p.address, PENALTY_INVALID_BLOCK, "malformed compact block")
+			return !bc.peerManager.IsBanned(p.address)
+		}
+		p.known.Add(cb.Header.Hash())
+		bc.receiveCompactBlock(p, &cb)
+	case MSG_GETBLOCKTXN:
+		var r BlockTransactionsRequest
+		if err := json.Unmarshal(m.Payload, &r); err != nil {
+			return false
+		}
+		bc.handleGetBlockTransactions(p, &r)
+	case MSG_BLOCKTXN:
+		var bt BlockTransactions
+		if err := json.Unmarshal(m.Payload, &bt); err != nil || !bt.Validate() {
+			bc.peerManager.Misbehaving(p.address, PENALTY_INVALID_BLOCK, "malformed block transactions")
+			return !bc.peerManager.IsBanned(p.address)
+		}
+		bc.receiveBlockTransactions(p, &bt)
+	case MSG_TX:
+		var t TransactionRequest
+		if err := json.Unmarshal(m.Payload, &t); err != nil {
+			bc.peerManager.Misbehaving(p.address, PENALTY_INVALID_TRANSACTION, "malformed transaction")
+			return !bc.peerManager.IsBanned(p.address)
+		}
+		bc.receiveTransaction(p, &t)
+	case MSG_NOTFOUND:
+	default:
+		log.Printf("ERROR: Unknown message %q from %s", m.Type, p.address)
+	}
+	return !bc.peerManager.IsBanned(p.address)
+}
+
+func decodeInvHash(item *InvItem) ([32]byte, bool) {
+	if item == nil {
+		return [32]byte{}, false
+	}
+	return decodeHash(item.Hash)
+}
+
+func decodeHash(s string) ([32]byte, bool) {
+	var hash [32]byte
+	h, err := hex.DecodeString(s)
+	if err != nil || len(h) != 32 {
+		return hash, false
+	}
+	copy(hash[:], h)
+	return hash, true
+}
+
+// handleInv requests the announced blocks and transactions we do not
+// have. A transaction already requested from another peer is not asked
+// for again until that request is GETDATA_RETRY_SEC old.
+func (bc *Blockchain) handleInv(p *Peer, items []*InvItem) {
+	wanted := []*InvItem{}
+	for _, item := range items {
+		hash, ok := decodeInvHash(item)
+		if !ok {
+			continue
+		}
+		p.known.Add(hash)
+		switch item.Type {
+		case INV_BLOCK:
+			if bc.BlockByHash(hash) == nil && !bc.orphans.Has(hash) {
+				if p.compact {
+					item = &InvItem{INV_COMPACT_BLOCK, item.Hash}
+				}
+				wanted = append(wanted, item)
+			}
+		case INV_TX:
+			if !bc.HasTransaction(hash) && bc.requestTransaction(hash) {
+				wanted = append(wanted, item)
+			}
+		}
+	}
+	if len(wanted) > 0 {
+		p.Send(NewMessage(MSG_GETDATA, wanted))
+	}
+}
+
+func (bc *Blockchain) handleGetData(p *Peer, items []*InvItem) {
+	notFound := []*InvItem{}
+	for _, item := range items {
+		hash, ok := decodeInvHash(item)
+		if !ok {
+			continue
+		}
+		switch item.Type {
+		case INV_BLOCK:
+			if b := bc.BlockByHash(hash); b != nil {
+				p.Send(NewMessage(MSG_BLOCK, b))
+				continue
+			}
+		case INV_COMPACT_BLOCK:
+			if b := bc.BlockByHash(hash); b != nil {
+				p.Send(NewMessage(MSG_CMPCTBLOCK, NewCompactBlock(b)))
+				continue
+			}
+		case INV_TX:
+			if tr := bc.relayedTransaction(hash); tr != nil {
+				p.known.Add(hash)
+				p.Send(NewMessage(MSG_TX, tr))
+				continue
+			}
+		}
+		notFound = append(notFound, item)
+	}
+	if len(notFound) > 0 {
+		p.Send(NewMessage(MSG_NOTFOUND, notFound))
+	}
+}
+
+// exchangeHello sends our handshake over a fresh connection and reads
+// the one of the peer. It also returns the nonce we challenged the peer
+// with.
+func (bc *Blockchain) exchangeHello(conn net.Conn, reader io.Reader) (*Handshake, string, error) {
+	conn.SetDeadline(time.Now().Add(P2P_HELLO_TIMEOUT_SEC * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	challenge := newNonce()
+	if err := WriteMessage(conn, NewMessage(MSG_HELLO, bc.signHandshake(challenge))); err != nil {
+		return nil, "", err
+	}
+	m, err := ReadMessage(reader)
+	if err != nil {
+		return nil, "", err
+	}
+	var h Handshake
+	if m.Type != MSG_HELLO || json.Unmarshal(m.Payload, &h) != nil || !h.Validate() || h.Nonce == "" {
+		return nil, "", fmt.Errorf("invalid hello")
+	}
+	if err := bc.CheckHandshake(&h); err != nil {
+		return nil, "", err
+	}
+	return &h, challenge, nil
+}
+
+// ConnectPeer opens a connection to the node at address by upgrading a
+// GET /p2p request.
+func (bc *Blockchain) ConnectPeer(address string) error {
+	conn, err := bc.dialPeer(address)
+	if err != nil {
+		return err
+	}
+	req, _ := http.NewRequest("GET", bc.peerURL(address, "/p2p"), nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", P2P_PROTOCOL)
+	conn.SetDeadline(time.Now().Add(P2P_HELLO_TIMEOUT_SEC * time.Second))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return fmt.Errorf("upgrade refused: %s", resp.Status)
+	}
+	h, challenge, err := bc.exchangeHello(conn, reader)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	h.Address = address
+	bc.setPeerInfo(negotiate(h, false))
+	bc.startPeer(newPeer(conn, reader, address, h, challenge, false))
+	bc.catchUp(h)
+	return nil
+}
+
+// AcceptPeer runs a connection upgraded by GET /p2p from remoteAddr.
+func (bc *Blockchain) AcceptPeer(conn net.Conn, reader io.Reader, remoteAddr string) {
+	h, challenge, err := bc.exchangeHello(conn, reader)
+	if err != nil {
+		log.Printf("ERROR: %s: %v", remoteAddr, err)
+		conn.Close()
+		return
+	}
+	if !ValidPeerAddress(h.Address) || !IsPeerHost(h.Address, remoteAddr) {
+		log.Printf("ERROR: %s announced address %q", remoteAddr, h.Address)
+		conn.Close()
+		return
+	}
+	if err := bc.setPeerInfo(negotiate(h, true)); err != nil {
+		log.Printf("ERROR: %s: %v", remoteAddr, err)
+		conn.Close()
+		return
+	}
+	if bc.PeerInfo(h.Address) != nil {
+		bc.addressBook.Add(h.Address)
+	}
+	bc.startPeer(newPeer(conn, reader, h.Address, h, challenge, true))
+	bc.catchUp(h)
+}
+
+// catchUp syncs when a peer that just connected is ahead of us, e.g.
+// because blocks were announced while the connection was down.
+func (bc *Blockchain) catchUp(h *Handshake) {
+	if h.BestHeight > bc.Height() {
+		go bc.ResolveConflicts()
+	}
+}
+
+// startPeer registers p and runs it. When both nodes dialed each other,
+// the connection opened by the node with the lower ID is kept, which
+// both sides agree on.
+func (bc *Blockchain) startPeer(p *Peer) {
+	bc.muxP2P.Lock()
+	if old, ok := bc.p2pPeers[p.nodeID]; ok {
+		keepNew := p.inbound == (p.nodeID < bc.nodeID)
+		if !keepNew {
+			bc.muxP2P.Unlock()
+			p.Close()
+			return
+		}
+		old.Close()
+	}
+	bc.p2pPeers[p.nodeID] = p
+	bc.muxP2P.Unlock()
+	log.Printf("action=connect, peer=%s, inbound=%t", p.address, p.inbound)
+	go bc.writeLoop(p)
+	go bc.readLoop(p)
+}
+
+func (bc *Blockchain) removePeer(p *Peer) {
+	p.Close()
+	bc.muxP2P.Lock()
+	defer bc.muxP2P.Unlock()
+	if bc.p2pPeers[p.nodeID] == p {
+		delete(bc.p2pPeers, p.nodeID)
+	}
+}
+
+// ConnectedPeers returns the open peer connections.
+func (bc *Blockchain) ConnectedPeers() []*Peer {
+	bc.muxP2P.Lock()
+	defer bc.muxP2P.Unlock()
+	peers := make([]*Peer, 0, len(bc.p2pPeers))
+	for _, p := range bc.p2pPeers {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].address < peers[j].address })
+	return peers
+}
+
+func (bc *Blockchain) Connections() []*ConnectionInfo {
+	infos := []*ConnectionInfo{}
+	for _, p := range bc.ConnectedPeers() {
+		infos = append(infos, p.info())
+	}
+	return infos
+}
+
+type dialState struct {
+	next    time.Time
+	backoff time.Duration
+	dialing bool
+}
+
+// StartP2P keeps a connection open to every neighbor, redialing dropped
+// ones with exponential backoff.
+func (bc *Blockchain) StartP2P() {
+	bc.maintainConnections()
+	_ = time.AfterFunc(P2P_RECONNECT_SEC*time.Second, bc.StartP2P)
+}
+
+func (bc *Blockchain) maintainConnections() {
+	bc.muxNeighbors.Lock()
+	neighbors := append([]string{}, bc.neighbors...)
+	bc.muxNeighbors.Unlock()
+
+	connected := map[string]bool{}
+	for _, p := range bc.ConnectedPeers() {
+		connected[p.address] = true
+	}
+	now := time.Now()
+	bc.muxP2P.Lock()
+	defer bc.muxP2P.Unlock()
+	for _, n := range neighbors {
+		if connected[n] || bc.peerManager.IsBanned(n) {
+			continue
+		}
+		d, ok := bc.dials[n]
+		if !ok {
+			d = &dialState{backoff: P2P_RECONNECT_SEC * time.Second}
+			bc.dials[n] = d
+		}
+		if d.dialing || now.Before(d.next) {
+			continue
+		}
+		d.dialing = true
+		go bc.dial(n, d)
+	}
+}
+
+func (bc *Blockchain) dial(address string, d *dialState) {
+	err := bc.ConnectPeer(address)
+	bc.muxP2P.Lock()
+	defer bc.muxP2P.Unlock()
+	d.dialing = false
+	if err != nil {
+		log.Printf("ERROR: connect %s: %v", address, err)
+		d.next = time.Now().Add(d.backoff)
+		if d.backoff *= 2; d.backoff > P2P_MAX_BACKOFF_SEC*time.Second {
+			d.backoff = P2P_MAX_BACKOFF_SEC * time.Second
+		}
+		return
+	}
+	d.backoff = P2P_RECONNECT_SEC * time.Second
+}
@@ -0,0 +1,78 @@
+package block
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// Malformed payloads are refused, and the peers sending invalid ones
+// penalized, without panicking.
+func TestHandleMalformedMessages(t *testing.T) {
+	bc := NewBlockchain("miner", 0)
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+	p := newPeer(conn, conn, "203.0.113.9:5000", &Handshake{}, "", true)
+
+	tests := []struct {
+		name      string
+		msgType   string
+		payload   string
+		penalized bool
+	}{
+		{"null inv item", MSG_INV, `[null]`, false},
+		{"null getdata item", MSG_GETDATA, `[null]`, false},
+		{"short previous hash", MSG_BLOCK, `{"previous_hash":"00","transactions":[]}`, true},
+		{"missing previous hash", MSG_BLOCK, `{"transactions":[]}`, true},
+		{"null block transaction", MSG_BLOCK, `{"previous_hash":"` + zeroHash + `","transactions":[null]}`, true},
+		{"compact block without header", MSG_CMPCTBLOCK, `{"short_ids":[1]}`, true},
+		{"null prefilled transaction", MSG_CMPCTBLOCK, `{"header":{"previous_hash":"` + zeroHash + `","transactions_root":"` + zeroHash + `"},"prefilled":[null]}`, true},
+		{"null block transactions", MSG_BLOCKTXN, `{"block_hash":"` + zeroHash + `","transactions":[null]}`, true},
+		{"short public key", MSG_TX, `{"sender_blockchain_address":"a","recipient_blockchain_address":"b","sender_public_key":"01","value":1,"signature":"01"}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bc.peerManager = NewPeerManager()
+			if !bc.handleMessage(p, &Message{Type: tt.msgType, Payload: json.RawMessage(tt.payload)}) {
+				t.Fatal("connection dropped")
+			}
+			if penalized := len(bc.peerManager.Peers()) > 0; penalized != tt.penalized {
+				t.Fatalf("penalized %t, want %t", penalized, tt.penalized)
+			}
+		})
+	}
+}
+
+// Peers ask for blocks while others are mined. Run with -race.
+func TestGetDataWhileMining(t *testing.T) {
+	bc := NewBlockchain("miner", 0)
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+	p := newPeer(conn, conn, "203.0.113.9:5000", &Handshake{}, "", true)
+	items, _ := json.Marshal([]*InvItem{{INV_BLOCK, fmt.Sprintf("%x", bc.Chain()[0].Hash())}, {INV_COMPACT_BLOCK, zeroHash}})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			bc.Mining()
+		}
+	}()
+	for mining := true; mining; {
+		select {
+		case <-done:
+			mining = false
+		default:
+		}
+		bc.handleMessage(p, &Message{Type: MSG_INV, Payload: items})
+		bc.handleMessage(p, &Message{Type: MSG_GETDATA, Payload: items})
+	}
+	if bc.Height() != 5 {
+		t.Fatalf("height %d, want 5", bc.Height())
+	}
+}
+
+const zeroHash = "0000000000000000000000000000000000000000000000000000000000000000"
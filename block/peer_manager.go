@@ -0,0 +1,281 @@
+package block
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	PEER_BAN_SCORE        = 100  // Misbehavior score that gets a peer banned
+	PEER_BAN_DURATION_SEC = 3600 // Default length of a ban
+	PEER_RATE_LIMIT       = 100  // Requests per second allowed per IP
+	PEER_RATE_BURST       = 500  // Requests an idle IP may send at once
+	PEER_SCORE_DECAY_SEC  = 60   // A point of score is forgiven every so often
+	MAX_PEER_RECORDS      = 10000
+
+	PENALTY_INVALID_BLOCK       = 50
+	PENALTY_INVALID_HEADERS     = 50
+	PENALTY_INVALID_TRANSACTION = 10
+	PENALTY_INVALID_SIGNATURE   = 50
+	PENALTY_TIMEOUT             = 5
+	PENALTY_RATE_LIMITED        = 1
+)
+
+type peerRecord struct {
+	score       int
+	decayedAt   time.Time
+	bannedUntil int64 // Unix time, 0 when not banned
+	tokens      float64
+	refilledAt  time.Time
+}
+
+// PeerStatus is the public view of a peer record.
+type PeerStatus struct {
+	IP          string `json:"ip"`
+	Score       int    `json:"score"`
+	BannedUntil int64  `json:"banned_until,omitempty"`
+}
+
+// PeerManager scores peers by IP on misbehavior, bans them for a while
+// once the score reaches PEER_BAN_SCORE and rate limits their requests
+// with a token bucket. Scores decay, so that only peers misbehaving
+// faster than a point per PEER_SCORE_DECAY_SEC get banned. Loopback
+// addresses are scored and rate limited, but only banned by hand, so
+// local test networks keep working.
+type PeerManager struct {
+	peers map[string]*peerRecord
+	mux   sync.Mutex
+}
+
+func NewPeerManager() *PeerManager {
+	return &PeerManager{peers: make(map[string]*peerRecord)}
+}
+
+// PeerIP returns the IP of a host:port address, or address itself when
+// it has no port.
+func PeerIP(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+// IsPeerHost reports whether the host of address, an IP or a name,
+// resolves to the IP of remoteAddr.
+func IsPeerHost(address string, remoteAddr string) bool {
+	host, ip := PeerIP(address), PeerIP(remoteAddr)
+	if host == ip {
+		return true
+	}
+	if net.ParseIP(host) != nil {
+		return false
+	}
+	ips, err := net.LookupHost(host)
+	if err != nil {
+		return false
+	}
+	for _, a := range ips {
+		if a == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// peerIPs returns the IPs requests from the peer at address come from:
+// its IP, or those its host name resolves to. Bans are checked against
+// the IP of requests, so they have to be keyed on these.
+func peerIPs(address string) []string {
+	host := PeerIP(address)
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{ip.String()}
+	}
+	ips, err := net.LookupHost(host)
+	if err != nil || len(ips) == 0 {
+		return []string{host}
+	}
+	return ips
+}
+
+func isLoopback(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && parsed.IsLoopback()
+}
+
+func (pm *PeerManager) record(ip string) *peerRecord {
+	p, ok := pm.peers[ip]
+	if !ok {
+		if len(pm.peers) >= MAX_PEER_RECORDS {
+			pm.prune()
+		}
+		p = &peerRecord{decayedAt: time.Now(), tokens: PEER_RATE_BURST, refilledAt: time.Now()}
+		pm.peers[ip] = p
+	}
+	p.decay(time.Now())
+	return p
+}
+
+// decay forgives the points of score earned more than
+// PEER_SCORE_DECAY_SEC each ago.
+func (p *peerRecord) decay(now time.Time) {
+	if p.score == 0 {
+		p.decayedAt = now
+		return
+	}
+	interval := PEER_SCORE_DECAY_SEC * time.Second
+	points := int(now.Sub(p.decayedAt) / interval)
+	if points == 0 {
+		return
+	}
+	p.score -= points
+	p.decayedAt = p.decayedAt.Add(time.Duration(points) * interval)
+	if p.score <= 0 {
+		p.score = 0
+		p.decayedAt = now
+	}
+}
+
+// prune forgets the peers that are neither scored nor banned.
+func (pm *PeerManager) prune() {
+	now := time.Now()
+	for ip, p := range pm.peers {
+		p.decay(now)
+		if p.score == 0 && p.bannedUntil <= now.Unix() {
+			delete(pm.peers, ip)
+		}
+	}
+}
+
+// Misbehaving adds penalty to the score of the peer at address.
+func (pm *PeerManager) Misbehaving(address string, penalty int, reason string) {
+	ips := peerIPs(address)
+	pm.mux.Lock()
+	defer pm.mux.Unlock()
+	for _, ip := range ips {
+		p := pm.record(ip)
+		p.score += penalty
+		log.Printf("action=misbehaving, peer=%s, reason=%s, score=%d", ip, reason, p.score)
+		if p.score >= PEER_BAN_SCORE && !isLoopback(ip) {
+			pm.ban(ip, PEER_BAN_DURATION_SEC*time.Second)
+		}
+	}
+}
+
+func (pm *PeerManager) ban(ip string, d time.Duration) {
+	p := pm.record(ip)
+	p.bannedUntil = time.Now().Add(d).Unix()
+	p.score = 0
+	log.Printf("action=ban, peer=%s, until=%d", ip, p.bannedUntil)
+}
+
+// Ban bans ip for d.
+func (pm *PeerManager) Ban(ip string, d time.Duration) error {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return fmt.Errorf("invalid ip %q", ip)
+	}
+	pm.mux.Lock()
+	defer pm.mux.Unlock()
+	pm.ban(parsed.String(), d)
+	return nil
+}
+
+// Unban lifts the ban of ip and clears its score.
+func (pm *PeerManager) Unban(ip string) bool {
+	pm.mux.Lock()
+	defer pm.mux.Unlock()
+	p, ok := pm.peers[ip]
+	if !ok {
+		return false
+	}
+	p.bannedUntil = 0
+	p.score = 0
+	log.Printf("action=unban, peer=%s", ip)
+	return true
+}
+
+// IsBanned reports whether the peer at address is banned.
+func (pm *PeerManager) IsBanned(address string) bool {
+	ips := peerIPs(address)
+	pm.mux.Lock()
+	defer pm.mux.Unlock()
+	for _, ip := range ips {
+		if p, ok := pm.peers[ip]; ok && p.bannedUntil > time.Now().Unix() {
+			return true
+		}
+	}
+	return false
+}
+
+// Allow takes a token from the bucket of the peer at address and reports
+// whether its request may be served. Banned peers are never served.
+func (pm *PeerManager) Allow(address string) bool {
+	ip := peerIPs(address)[0]
+	pm.mux.Lock()
+	defer pm.mux.Unlock()
+	p := pm.record(ip)
+	now := time.Now()
+	if p.bannedUntil > now.Unix() {
+		return false
+	}
+	p.tokens += now.Sub(p.refilledAt).Seconds() * PEER_RATE_LIMIT
+	if p.tokens > PEER_RATE_BURST {
+		p.tokens = PEER_RATE_BURST
+	}
+	p.refilledAt = now
+	if p.tokens < 1 {
+		p.score += PENALTY_RATE_LIMITED
+		if p.score >= PEER_BAN_SCORE && !isLoopback(ip) {
+			pm.ban(ip, PEER_BAN_DURATION_SEC*time.Second)
+		}
+		return false
+	}
+	p.tokens--
+	return true
+}
+
+// Peers returns the peers with a score or a ban, sorted by IP.
+func (pm *PeerManager) Peers() []*PeerStatus {
+	pm.mux.Lock()
+	defer pm.mux.Unlock()
+	now := time.Now().Unix()
+	peers := []*PeerStatus{}
+	for ip, p := range pm.peers {
+		p.decay(time.Now())
+		if p.score == 0 && p.bannedUntil <= now {
+			continue
+		}
+		s := &PeerStatus{IP: ip, Score: p.score}
+		if p.bannedUntil > now {
+			s.BannedUntil = p.bannedUntil
+		}
+		peers = append(peers, s)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].IP < peers[j].IP })
+	return peers
+}
+
+func (bc *Blockchain) PeerManager() *PeerManager {
+	return bc.peerManager
+}
+
+// BanRequest is sent to the admin ban and unban endpoints.
+type BanRequest struct {
+	IP          *string `json:"ip"`
+	DurationSec *int64  `json:"duration_sec"`
+}
+
+func (br *BanRequest) Validate() bool {
+	return br.IP != nil
+}
+
+func (br *BanRequest) Duration() time.Duration {
+	if br.DurationSec == nil || *br.DurationSec <= 0 {
+		return PEER_BAN_DURATION_SEC * time.Second
+	}
+	return time.Duration(*br.DurationSec) * time.Second
+}
@@ -0,0 +1,67 @@
+package block
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScoreDecay(t *testing.T) {
+	start := time.Now()
+	interval := PEER_SCORE_DECAY_SEC * time.Second
+	p := &peerRecord{score: 10, decayedAt: start}
+	p.decay(start.Add(interval - time.Second))
+	if p.score != 10 {
+		t.Fatalf("score %d before a decay interval, want 10", p.score)
+	}
+	p.decay(start.Add(3*interval + time.Second))
+	if p.score != 7 {
+		t.Fatalf("score %d after 3 decay intervals, want 7", p.score)
+	}
+	p.decay(start.Add(4 * interval))
+	if p.score != 6 {
+		t.Fatalf("score %d after 4 decay intervals, want 6", p.score)
+	}
+	p.decay(start.Add(time.Hour))
+	if p.score != 0 {
+		t.Fatalf("score %d after an hour, want 0", p.score)
+	}
+}
+
+// A peer timing out now and then is never banned, one misbehaving fast
+// is.
+func TestBanNeedsSustainedMisbehavior(t *testing.T) {
+	pm := NewPeerManager()
+	const ip = "203.0.113.7"
+	for i := 0; i < 3*PEER_BAN_SCORE/PENALTY_TIMEOUT; i++ {
+		pm.Misbehaving(ip+":5000", PENALTY_TIMEOUT, "timeout")
+		pm.peers[ip].decayedAt = pm.peers[ip].decayedAt.Add(-PENALTY_TIMEOUT * PEER_SCORE_DECAY_SEC * time.Second)
+	}
+	if pm.IsBanned(ip) {
+		t.Fatal("peer with occasional timeouts banned")
+	}
+	for i := 0; i < PEER_BAN_SCORE/PENALTY_INVALID_BLOCK; i++ {
+		pm.Misbehaving(ip+":5000", PENALTY_INVALID_BLOCK, "invalid block")
+	}
+	if !pm.IsBanned(ip) {
+		t.Fatal("peer sending invalid blocks not banned")
+	}
+}
+
+// Bans apply to the IP requests come from, whether the peer is known by
+// IP or by host name.
+func TestBanMatchesRequestIP(t *testing.T) {
+	pm := NewPeerManager()
+	if err := pm.Ban("127.0.0.1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if !pm.IsBanned("localhost:5000") {
+		t.Fatal("host name of a banned IP not banned")
+	}
+	if pm.Allow("127.0.0.1:43210") {
+		t.Fatal("request from a banned IP allowed")
+	}
+	pm.Unban("127.0.0.1")
+	if pm.IsBanned("localhost:5000") || !pm.Allow("127.0.0.1:43210") {
+		t.Fatal("unbanned IP still refused")
+	}
+}
@@ -0,0 +1,352 @@
+package block
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"goblockchain/utils"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	MAX_NEIGHBORS            = 8    // Peers we keep talking to
+	MAX_ADDRESS_BOOK_SIZE    = 1000 // Addresses remembered
+	MAX_PEER_EXCHANGE_SIZE   = 100  // Addresses given out per /peers request
+	PEER_MAX_FAILURES        = 5    // Failed contacts before an address is forgotten
+	PEER_TIMEOUT_SEC         = 1
+	PEER_REQUEST_TIMEOUT_SEC = 10 // For block and header downloads
+)
+
+// PeerAddress is an entry of the address book.
+type PeerAddress struct {
+	Address  string `json:"address"`
+	LastSeen int64  `json:"last_seen"` // Unix time of the last successful contact, 0 if never
+	Failures int    `json:"failures"`  // Failed contacts since then
+}
+
+// AddressBook remembers the peers a node has heard of and persists them
+// to a JSON file so a restarted node can rejoin without its seeds.
+type AddressBook struct {
+	path  string
+	peers map[string]*PeerAddress
+	mux   sync.Mutex
+}
+
+// NewAddressBook loads the address book at path. An empty path keeps it
+// in memory only.
+func NewAddressBook(path string) *AddressBook {
+	ab := &AddressBook{path: path, peers: make(map[string]*PeerAddress)}
+	if path == "" {
+		return ab
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("ERROR: %v", err)
+		}
+		return ab
+	}
+	var peers []*PeerAddress
+	if err := json.Unmarshal(data, &peers); err != nil {
+		log.Printf("ERROR: %v", err)
+		return ab
+	}
+	for _, p := range peers {
+		if ValidPeerAddress(p.Address) {
+			ab.peers[p.Address] = p
+		}
+	}
+	return ab
+}
+
+// ValidPeerAddress reports whether address is a usable host:port.
+func ValidPeerAddress(address string) bool {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || host == "" {
+		return false
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	return err == nil && p != 0
+}
+
+// Add remembers address if it is new.
+func (ab *AddressBook) Add(address string) {
+	ab.mux.Lock()
+	defer ab.mux.Unlock()
+	if !ValidPeerAddress(address) || ab.peers[address] != nil || len(ab.peers) >= MAX_ADDRESS_BOOK_SIZE {
+		return
+	}
+	ab.peers[address] = &PeerAddress{Address: address}
+}
+
+func (ab *AddressBook) MarkGood(address string) {
+	ab.mux.Lock()
+	defer ab.mux.Unlock()
+	p := ab.peers[address]
+	if p == nil {
+		if len(ab.peers) >= MAX_ADDRESS_BOOK_SIZE {
+			return
+		}
+		p = &PeerAddress{Address: address}
+		ab.peers[address] = p
+	}
+	p.LastSeen = time.Now().Unix()
+	p.Failures = 0
+}
+
+func (ab *AddressBook) MarkFailed(address string) {
+	ab.mux.Lock()
+	defer ab.mux.Unlock()
+	p := ab.peers[address]
+	if p == nil {
+		return
+	}
+	p.Failures++
+	if p.Failures >= PEER_MAX_FAILURES {
+		delete(ab.peers, address)
+	}
+}
+
+// Addresses returns the remembered addresses, most recently seen first.
+func (ab *AddressBook) Addresses() []string {
+	ab.mux.Lock()
+	defer ab.mux.Unlock()
+	peers := make([]*PeerAddress, 0, len(ab.peers))
+	for _, p := range ab.peers {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].LastSeen != peers[j].LastSeen {
+			return peers[i].LastSeen > peers[j].LastSeen
+		}
+		return peers[i].Address < peers[j].Address
+	})
+	addresses := make([]string, len(peers))
+	for i, p := range peers {
+		addresses[i] = p.Address
+	}
+	return addresses
+}
+
+// GoodAddresses returns the addresses that answered at least once.
+func (ab *AddressBook) GoodAddresses() []string {
+	good := []string{}
+	for _, a := range ab.Addresses() {
+		ab.mux.Lock()
+		p := ab.peers[a]
+		if p != nil && p.LastSeen > 0 {
+			good = append(good, a)
+		}
+		ab.mux.Unlock()
+	}
+	return good
+}
+
+func (ab *AddressBook) Save() {
+	if ab.path == "" {
+		return
+	}
+	ab.mux.Lock()
+	peers := make([]*PeerAddress, 0, len(ab.peers))
+	for _, p := range ab.peers {
+		peers = append(peers, p)
+	}
+	ab.mux.Unlock()
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Address < peers[j].Address })
+	m, _ := json.MarshalIndent(peers, "", "  ")
+	if err := os.WriteFile(ab.path, m, 0644); err != nil {
+		log.Printf("ERROR: %v", err)
+	}
+}
+
+// PeersRequest announces the sender to a peer during peer exchange.
+type PeersRequest struct {
+	Address *string `json:"address"`
+}
+
+func (pr *PeersRequest) Validate() bool {
+	return pr.Address != nil && ValidPeerAddress(*pr.Address)
+}
+
+type PeersResponse struct {
+	Peers       []string          `json:"peers"`
+	Neighbors   []*PeerInfo       `json:"neighbors,omitempty"` // Only answered to GET
+	Connections []*ConnectionInfo `json:"connections,omitempty"`
+}
+
+// SetPeerConfig sets the host we advertise, the seed peers and the file
+// the address book is kept in.
+func (bc *Blockchain) SetPeerConfig(host string, seeds []string, addressBookPath string) {
+	bc.muxNeighbors.Lock()
+	defer bc.muxNeighbors.Unlock()
+	if host != "" {
+		bc.host = host
+	}
+	bc.seeds = seeds
+	bc.addressBook = NewAddressBook(addressBookPath)
+	for _, s := range seeds {
+		bc.addressBook.Add(s)
+	}
+}
+
+// KnownPeers returns the peers we hand out in peer exchange.
+func (bc *Blockchain) KnownPeers() []string {
+	peers := bc.addressBook.GoodAddresses()
+	if len(peers) > MAX_PEER_EXCHANGE_SIZE {
+		peers = peers[:MAX_PEER_EXCHANGE_SIZE]
+	}
+	return peers
+}
+
+// AddPeer remembers a peer that announced itself to us.
+func (bc *Blockchain) AddPeer(address string) {
+	if address != bc.Address() {
+		bc.addressBook.Add(address)
+	}
+}
+
+// discoverNeighbors exchanges addresses with the seeds and the address
+// book until MAX_NEIGHBORS peers have answered. Addresses learned along
+// the way are tried as well, so peers are found transitively.
+func (bc *Blockchain) discoverNeighbors() []string {
+	self := bc.Address()
+	neighbors := []string{}
+	tried := map[string]bool{self: true}
+	queue := append(append([]string{}, bc.seeds...), bc.addressBook.Addresses()...)
+	for len(queue) > 0 && len(neighbors) < MAX_NEIGHBORS {
+		address := queue[0]
+		queue = queue[1:]
+		if tried[address] || bc.peerManager.IsBanned(address) {
+			continue
+		}
+		tried[address] = true
+		if _, ok := bc.handshake(address); !ok {
+			bc.addressBook.MarkFailed(address)
+			continue
+		}
+		peers, ok := bc.exchangePeers(address, self)
+		if !ok {
+			bc.addressBook.MarkFailed(address)
+			continue
+		}
+		bc.addressBook.MarkGood(address)
+		neighbors = append(neighbors, address)
+		for _, p := range peers {
+			if !tried[p] && ValidPeerAddress(p) {
+				bc.addressBook.Add(p)
+				queue = append(queue, p)
+			}
+		}
+	}
+	bc.addressBook.Save()
+	return neighbors
+}
+
+func (bc *Blockchain) exchangePeers(address string, self string) ([]string, bool) {
+	m, _ := json.Marshal(&PeersRequest{&self})
+	client := bc.peerClient(PEER_TIMEOUT_SEC * time.Second)
+	resp, err := client.Post(bc.peerURL(address, "/peers"), "application/json", bytes.NewBuffer(m))
+	if err != nil {
+		return nil, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, false
+	}
+	var pr PeersResponse
+	if err := json.NewDecoder(resp.Body).Decode(&pr); err != nil {
+		return nil, false
+	}
+	return pr.Peers, true
+}
+
+// scanNeighbors is the discovery used without seeds or known peers: it
+// probes the default port range next to our own host and keeps the
+// nodes that complete a handshake.
+func (bc *Blockchain) scanNeighbors() []string {
+	neighbors := []string{}
+	for _, n := range utils.FindNeighbors(
+		bc.host, bc.port,
+		NEIGHBOR_IP_RANGE_START, NEIGHBOR_IP_RANGE_END,
+		BLOCKCHAIN_PORT_RANGE_START, BLOCKCHAIN_PORT_RANGE_END,
+	) {
+		if bc.peerManager.IsBanned(n) {
+			continue
+		}
+		if _, ok := bc.handshake(n); ok {
+			neighbors = append(neighbors, n)
+		}
+	}
+	return neighbors
+}
+
+// SetTLS makes the node talk to its peers over TLS with config, which
+// carries our client certificate. Nil goes back to plain HTTP.
+func (bc *Blockchain) SetTLS(config *tls.Config) {
+	bc.tlsConfig = config
+}
+
+// DialFunc opens connections to peers; net.DialTimeout is one.
+type DialFunc func(network string, address string, timeout time.Duration) (net.Conn, error)
+
+// SetDialFunc makes the node reach its peers through dial, e.g. over a
+// simulated network. Nil goes back to net.DialTimeout.
+func (bc *Blockchain) SetDialFunc(dial DialFunc) {
+	bc.dialFunc = dial
+}
+
+// peerURL is the URL of path on the node at address.
+func (bc *Blockchain) peerURL(address string, path string) string {
+	scheme := "http"
+	if bc.tlsConfig != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, address, path)
+}
+
+func (bc *Blockchain) peerClient(timeout time.Duration) *http.Client {
+	client := &http.Client{Timeout: timeout}
+	if bc.tlsConfig != nil || bc.dialFunc != nil {
+		// The transport is not shared, so idle connections are not kept.
+		transport := &http.Transport{TLSClientConfig: bc.tlsConfig, DisableKeepAlives: true}
+		if bc.dialFunc != nil {
+			transport.DialContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
+				return bc.dialFunc(network, address, timeout)
+			}
+		}
+		client.Transport = transport
+	}
+	return client
+}
+
+// dialPeer opens a connection to address, wrapped in TLS when enabled.
+func (bc *Blockchain) dialPeer(address string) (net.Conn, error) {
+	dial := net.DialTimeout
+	if bc.dialFunc != nil {
+		dial = bc.dialFunc
+	}
+	conn, err := dial("tcp", address, PEER_TIMEOUT_SEC*time.Second)
+	if err != nil || bc.tlsConfig == nil {
+		return conn, err
+	}
+	config := bc.tlsConfig.Clone()
+	if config.ServerName == "" {
+		config.ServerName = PeerIP(address)
+	}
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(P2P_HELLO_TIMEOUT_SEC * time.Second))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
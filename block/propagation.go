@@ -0,0 +1,189 @@
+package block
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// BlockRequest pushes a block to a neighbor over HTTP (POST /blocks).
+// Sender is the host:port the block can be fetched back from.
+type BlockRequest struct {
+	Block  *Block  `json:"block"`
+	Sender *string `json:"sender"`
+}
+
+func (br *BlockRequest) Validate() bool {
+	if br.Block == nil || br.Sender == nil {
+		return false
+	}
+	return true
+}
+
+// Address is the host:port neighbors reach this node at.
+func (bc *Blockchain) Address() string {
+	return net.JoinHostPort(bc.host, strconv.Itoa(int(bc.port)))
+}
+
+// broadcastBlock announces b right away to every connected peer except
+// skip that does not know it yet. Peers without it ask for it with
+// getdata.
+func (bc *Blockchain) broadcastBlock(b *Block, skip string) {
+	h := b.Hash()
+	m := NewMessage(MSG_INV, []*InvItem{{INV_BLOCK, fmt.Sprintf("%x", h)}})
+	for _, p := range bc.ConnectedPeers() {
+		if p.address != skip && p.known.Add(h) {
+			p.Send(m)
+		}
+	}
+}
+
+// BlockByHash returns the block of the chain with the given hash.
+func (bc *Blockchain) BlockByHash(hash [32]byte) *Block {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	if i := bc.blockIndex(hash); i >= 0 {
+		return bc.chain[i]
+	}
+	return nil
+}
+
+// Height is the height of the last block of the chain.
+func (bc *Blockchain) Height() int {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	return len(bc.chain) - 1
+}
+
+// heightOf is blockIndex for callers not holding bc.mux.
+func (bc *Blockchain) heightOf(hash [32]byte) int {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	return bc.blockIndex(hash)
+}
+
+func (bc *Blockchain) blockIndex(hash [32]byte) int {
+	for i := len(bc.chain) - 1; i >= 0; i-- {
+		if bc.chain[i].Hash() == hash {
+			return i
+		}
+	}
+	return -1
+}
+
+// ReceiveBlock handles a block pushed by the neighbor at sender. A block
+// whose parent is unknown is kept as an orphan while its ancestors are
+// requested from sender. Once the parent is known, the block and the
+// longest chain of orphans descending from it extend our tip, or replace
+// our branch if they make a longer one. Accepted blocks are relayed.
+func (bc *Blockchain) ReceiveBlock(b *Block, sender string) bool {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+
+	h := b.Hash()
+	if bc.blockIndex(h) >= 0 || bc.orphans.Has(h) {
+		return true
+	}
+	forkIndex := bc.blockIndex(b.previousHash)
+	if forkIndex < 0 && b.previousHash == (&Block{}).Hash() {
+		log.Println("ERROR: Block of another genesis")
+		bc.peerManager.Misbehaving(sender, PENALTY_INVALID_BLOCK, "another genesis")
+		return false
+	}
+	if forkIndex < 0 {
+		return bc.addOrphan(b, sender)
+	}
+	branch := append([]*orphanBlock{{block: b, sender: sender}}, bc.orphans.Branch(h)...)
+	if forkIndex == len(bc.chain)-1 {
+		return bc.extendChain(branch)
+	}
+	return bc.switchBranch(branch, forkIndex, sender)
+}
+
+// extendChain connects the blocks of branch on top of our tip, up to the
+// first invalid one, which is dropped along with its descendants.
+func (bc *Blockchain) extendChain(branch []*orphanBlock) bool {
+	bs := bc.newBalanceSheet(bc.chain)
+	for i, o := range branch {
+		if !bc.validAfter(bc.chain, o.block, true, bs) {
+			log.Println("ERROR: Invalid block")
+			bc.peerManager.Misbehaving(o.sender, PENALTY_INVALID_BLOCK, "invalid block")
+			for _, d := range branch[i:] {
+				bc.orphans.Remove(d.block.Hash())
+			}
+			return i > 0
+		}
+		bc.orphans.Remove(o.block.Hash())
+		bc.chain = append(bc.chain, o.block)
+		bc.connectBlock(o.block)
+		bs.add(o.block)
+		bc.removeTransactions([]*Block{o.block})
+		log.Printf("action=receive_block, status=connected, height=%d", len(bc.chain)-1)
+		bc.broadcastBlock(o.block, o.sender)
+	}
+	return true
+}
+
+// switchBranch replaces our blocks after forkIndex with branch if that
+// makes a longer valid chain.
+func (bc *Blockchain) switchBranch(branch []*orphanBlock, forkIndex int, sender string) bool {
+	if forkIndex+1+len(branch) <= len(bc.chain) {
+		// A side branch no longer than ours. Should it grow, its blocks
+		// are fetched again as the ancestors of the newer ones.
+		log.Println("action=receive_block, status=stale")
+		return false
+	}
+	if cp := bc.spec.lastCheckpoint(); forkIndex < cp && cp < len(bc.chain) {
+		log.Println("action=receive_block, status=rejected_branch, reason=checkpoint")
+		bc.peerManager.Misbehaving(sender, PENALTY_INVALID_BLOCK, "fork before checkpoint")
+		return false
+	}
+	blocks := make([]*Block, len(branch))
+	for i, o := range branch {
+		blocks[i] = o.block
+	}
+	chain := append(append([]*Block{}, bc.chain[:forkIndex+1]...), blocks...)
+	if !bc.ValidChain(chain) {
+		log.Println("action=receive_block, status=rejected_branch")
+		bc.peerManager.Misbehaving(sender, PENALTY_INVALID_BLOCK, "invalid branch")
+		return false
+	}
+	for _, b := range blocks {
+		bc.orphans.Remove(b.Hash())
+	}
+	disconnected := bc.chain[forkIndex+1:]
+	bc.chain = chain
+	bc.rebuildState()
+	bc.reorganizePool(disconnected, blocks)
+	log.Printf("action=receive_block, status=reorganized, height=%d", len(bc.chain)-1)
+	tip := branch[len(branch)-1]
+	bc.broadcastBlock(tip.block, tip.sender)
+	return true
+}
+
+// fetchBlock asks host for the block with hash. Peers that do not answer
+// in time or send a different block are penalized.
+func (bc *Blockchain) fetchBlock(host string, hash [32]byte) *Block {
+	endPoint := bc.peerURL(host, fmt.Sprintf("/blocks?hash=%x", hash))
+	client := bc.peerClient(PEER_REQUEST_TIMEOUT_SEC * time.Second)
+	resp, err := client.Get(endPoint)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		bc.peerManager.Misbehaving(host, PENALTY_TIMEOUT, "timeout")
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil
+	}
+	var b Block
+	if err := json.NewDecoder(resp.Body).Decode(&b); err != nil || b.Hash() != hash {
+		log.Printf("ERROR: Invalid block %x from %s", hash, host)
+		bc.peerManager.Misbehaving(host, PENALTY_INVALID_BLOCK, "invalid block")
+		return nil
+	}
+	return &b
+}
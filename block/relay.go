@@ -0,0 +1,274 @@
+package block
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	MAX_KNOWN_INVENTORY   = 10000 // Hashes remembered per peer
+	MAX_SEEN_TRANSACTIONS = 50000 // Transaction hashes remembered to drop duplicates
+	MAX_INV_BATCH         = 1000  // Items per inv message
+	INV_BATCH_INTERVAL_MS = 200   // How long announcements are collected before sending
+	GETDATA_RETRY_SEC     = 30    // Before asking another peer for a requested transaction
+)
+
+// inventorySet is a set of hashes that forgets the oldest one once it
+// holds max of them.
+type inventorySet struct {
+	hashes map[[32]byte]struct{}
+	order  [][32]byte
+	max    int
+	mux    sync.Mutex
+}
+
+func newInventorySet(max int) *inventorySet {
+	return &inventorySet{hashes: make(map[[32]byte]struct{}), max: max}
+}
+
+// Add inserts h and reports whether it was new.
+func (s *inventorySet) Add(h [32]byte) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if _, ok := s.hashes[h]; ok {
+		return false
+	}
+	if len(s.order) >= s.max {
+		delete(s.hashes, s.order[0])
+		s.order = s.order[1:]
+	}
+	s.hashes[h] = struct{}{}
+	s.order = append(s.order, h)
+	return true
+}
+
+func (s *inventorySet) Has(h [32]byte) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	_, ok := s.hashes[h]
+	return ok
+}
+
+// Transaction builds the transaction the request describes, without
+// checking it.
+func (tr *TransactionRequest) Transaction() (*Transaction, error) {
+	if !tr.Validate() {
+		return nil, fmt.Errorf("missing field(s)")
+	}
+	if tr.IsScriptSpend() {
+		script, witness, err := tr.ScriptAndWitness()
+		if err != nil {
+			return nil, err
+		}
+		return NewScriptTransaction(*tr.RecipientBlockchainAddress, *tr.Value, tr.LockTimeValue(), script, witness), nil
+	}
+	if tr.IsContractTransaction() {
+		data, err := tr.ContractData()
+		if err != nil {
+			return nil, err
+		}
+		return NewContractTransaction(*tr.SenderBlockchainAddress, *tr.RecipientBlockchainAddress, *tr.Value, data, *tr.GasLimit, tr.GasPriceValue()), nil
+	}
+	return NewTransaction(*tr.SenderBlockchainAddress, *tr.RecipientBlockchainAddress, *tr.Value, tr.LockTimeValue()), nil
+}
+
+// HasTransaction reports whether the transaction with hash h is in the
+// pool or was seen recently, in the pool or in a block.
+func (bc *Blockchain) HasTransaction(h [32]byte) bool {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	return bc.hasTransaction(h)
+}
+
+func (bc *Blockchain) hasTransaction(h [32]byte) bool {
+	if bc.seenTransactions.Has(h) {
+		return true
+	}
+	for _, t := range bc.transactionPool {
+		if t.Hash() == h {
+			return true
+		}
+	}
+	return false
+}
+
+// addToPool appends t to the pool unless it is already known. The pool
+// is guarded by bc.mux, like the chain whose blocks take transactions out
+// of it.
+func (bc *Blockchain) addToPool(t *Transaction) bool {
+	if t.IsCoinbase() {
+		log.Println("ERROR: Coinbase transaction outside of a block")
+		return false
+	}
+	h := t.Hash()
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	if bc.hasTransaction(h) {
+		log.Println("ERROR: Duplicate transaction")
+		return false
+	}
+	bc.seenTransactions.Add(h)
+	bc.transactionPool = append(bc.transactionPool, t)
+	return true
+}
+
+// removeTransactions drops the transactions included in blocks from the
+// pool. The others stay there for a later block.
+func (bc *Blockchain) removeTransactions(blocks []*Block) {
+	included := make(map[[32]byte]bool)
+	for _, b := range blocks {
+		for _, t := range b.transactions {
+			included[t.Hash()] = true
+		}
+	}
+	pool := []*Transaction{}
+	for _, t := range bc.transactionPool {
+		if !included[t.Hash()] {
+			pool = append(pool, t)
+		}
+	}
+	if removed := len(bc.transactionPool) - len(pool); removed > 0 {
+		log.Printf("action=remove_transactions, removed=%d, pool=%d", removed, len(pool))
+	}
+	bc.transactionPool = pool
+	bc.pruneRelay()
+}
+
+// reorganizePool follows the switch of the chain from the disconnected
+// blocks to the connected ones. The transactions of the abandoned blocks
+// go back to the pool while their senders can still cover them, and the
+// transactions of the new blocks leave it.
+func (bc *Blockchain) reorganizePool(disconnected []*Block, connected []*Block) {
+	pooled := make(map[[32]byte]bool)
+	for _, t := range bc.transactionPool {
+		pooled[t.Hash()] = true
+	}
+	spent := make(map[string]float32)
+	returned := 0
+	for _, b := range disconnected {
+		for _, t := range b.transactions {
+			if t.IsCoinbase() || pooled[t.Hash()] {
+				continue
+			}
+			sender := t.senderBlockchainAddress
+			spendable, _ := bc.CalculateAmounts(sender)
+			if spendable < spent[sender]+t.value+t.MaxFee() {
+				continue
+			}
+			spent[sender] += t.value + t.MaxFee()
+			pooled[t.Hash()] = true
+			bc.transactionPool = append(bc.transactionPool, t)
+			returned++
+		}
+	}
+	if returned > 0 {
+		log.Printf("action=return_transactions, returned=%d, pool=%d", returned, len(bc.transactionPool))
+	}
+	bc.removeTransactions(connected)
+}
+
+// relayTransaction keeps tr to answer getdata with and announces it to
+// every peer that does not know it yet; the peer it came from does.
+func (bc *Blockchain) relayTransaction(tr *TransactionRequest) {
+	t, err := tr.Transaction()
+	if err != nil {
+		return
+	}
+	h := t.Hash()
+	bc.muxRelay.Lock()
+	bc.relayTransactions[h] = tr
+	bc.muxRelay.Unlock()
+	for _, p := range bc.ConnectedPeers() {
+		p.queueInv(&InvItem{INV_TX, fmt.Sprintf("%x", h)}, h)
+	}
+}
+
+func (bc *Blockchain) relayedTransaction(h [32]byte) *TransactionRequest {
+	bc.muxRelay.Lock()
+	defer bc.muxRelay.Unlock()
+	return bc.relayTransactions[h]
+}
+
+// pruneRelay forgets the relayed transactions that left the pool.
+func (bc *Blockchain) pruneRelay() {
+	inPool := make(map[[32]byte]bool, len(bc.transactionPool))
+	for _, t := range bc.transactionPool {
+		inPool[t.Hash()] = true
+	}
+	bc.muxRelay.Lock()
+	defer bc.muxRelay.Unlock()
+	for h := range bc.relayTransactions {
+		if !inPool[h] {
+			delete(bc.relayTransactions, h)
+		}
+	}
+}
+
+// requestTransaction reports whether h should be asked for now, i.e. it
+// was not requested from any peer in the last GETDATA_RETRY_SEC.
+func (bc *Blockchain) requestTransaction(h [32]byte) bool {
+	bc.muxRelay.Lock()
+	defer bc.muxRelay.Unlock()
+	now := time.Now()
+	if at, ok := bc.requestedTransactions[h]; ok && now.Sub(at) < GETDATA_RETRY_SEC*time.Second {
+		return false
+	}
+	for r, at := range bc.requestedTransactions {
+		if now.Sub(at) >= GETDATA_RETRY_SEC*time.Second {
+			delete(bc.requestedTransactions, r)
+		}
+	}
+	bc.requestedTransactions[h] = now
+	return true
+}
+
+// receiveTransaction handles a transaction sent by p, relaying it on
+// when it was new and valid.
+func (bc *Blockchain) receiveTransaction(p *Peer, tr *TransactionRequest) {
+	t, err := tr.Transaction()
+	if err != nil {
+		bc.peerManager.Misbehaving(p.address, PENALTY_INVALID_TRANSACTION, "invalid transaction")
+		return
+	}
+	h := t.Hash()
+	p.known.Add(h)
+	bc.muxRelay.Lock()
+	delete(bc.requestedTransactions, h)
+	bc.muxRelay.Unlock()
+	if bc.HasTransaction(h) {
+		return
+	}
+	if !bc.AddTransactionRequest(tr) && !bc.VerifyTransactionRequest(tr) {
+		bc.peerManager.Misbehaving(p.address, PENALTY_INVALID_TRANSACTION, "invalid transaction")
+	}
+}
+
+// queueInv adds an announcement for the next inv batch of p, unless p
+// already knows about h.
+func (p *Peer) queueInv(item *InvItem, h [32]byte) {
+	if !p.known.Add(h) {
+		return
+	}
+	p.muxInv.Lock()
+	defer p.muxInv.Unlock()
+	p.invQueue = append(p.invQueue, item)
+}
+
+// flushInv sends the queued announcements in messages of at most
+// MAX_INV_BATCH items.
+func (p *Peer) flushInv() {
+	p.muxInv.Lock()
+	items := p.invQueue
+	p.invQueue = nil
+	p.muxInv.Unlock()
+	for len(items) > 0 {
+		n := len(items)
+		if n > MAX_INV_BATCH {
+			n = MAX_INV_BATCH
+		}
+		p.Send(NewMessage(MSG_INV, items[:n]))
+		items = items[n:]
+	}
+}
@@ -0,0 +1,62 @@
+package block
+
+import (
+	"sync"
+	"testing"
+)
+
+// Peers racing to deliver the same transaction get it pooled once.
+func TestAddToPoolConcurrently(t *testing.T) {
+	bc := NewBlockchain("miner", 0)
+	var wg sync.WaitGroup
+	var muxAdded sync.Mutex
+	added := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tx := NewTransaction("sender", "recipient", float32(i%5+1), 0)
+			if bc.addToPool(tx) {
+				muxAdded.Lock()
+				added++
+				muxAdded.Unlock()
+			}
+			bc.HasTransaction(tx.Hash())
+			bc.TransactionPool()
+		}(i)
+	}
+	wg.Wait()
+	if added != 5 || len(bc.TransactionPool()) != 5 {
+		t.Fatalf("added %d, pool has %d, want 5 distinct transactions", added, len(bc.TransactionPool()))
+	}
+}
+
+// Transactions of abandoned blocks go back to the pool unless the new
+// branch includes them or their sender can no longer cover them.
+func TestReorganizePool(t *testing.T) {
+	spec := DefaultChainSpec()
+	spec.Genesis.Allocations = map[string]float32{"alice": 10}
+	bc := NewBlockchainWithSpec("miner", 0, spec)
+	genesis := bc.LastBlock()
+
+	paid := NewTransaction("alice", "bob", 3, 0)
+	overspent := NewTransaction("alice", "carol", 7, 0)
+	included := NewTransaction("alice", "dave", 1, 0)
+	pooled := NewTransaction("alice", "erin", 1, 0)
+	abandoned := NewBlock(1, 0, genesis.Hash(), []*Transaction{newCoinbase("other", 1), paid, overspent, included})
+	connected := NewBlock(2, 0, genesis.Hash(), []*Transaction{newCoinbase("miner", 1), included})
+	bc.chain = append(bc.chain, connected)
+	bc.rebuildState()
+	bc.transactionPool = []*Transaction{pooled}
+
+	bc.reorganizePool([]*Block{abandoned}, []*Block{connected})
+	want := []*Transaction{pooled, paid}
+	if len(bc.transactionPool) != len(want) {
+		t.Fatalf("pool has %d transactions, want %d", len(bc.transactionPool), len(want))
+	}
+	for i, tx := range want {
+		if bc.transactionPool[i] != tx {
+			t.Fatalf("pool[%d] = %s, want %s", i, bc.transactionPool[i].recipientBlockchainAddress, tx.recipientBlockchainAddress)
+		}
+	}
+}
@@ -0,0 +1,546 @@
+package block
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/btcsuite/btcutil/base58"
+)
+
+const (
+	MAX_SCRIPT_SIZE       = 1024
+	MAX_SCRIPT_STEPS      = 256
+	MAX_SCRIPT_STACK_SIZE = 100
+	MAX_MULTISIG_KEYS     = 16
+	SCRIPT_ADDRESS_PREFIX = 0x05 // Version byte of addresses derived from a script
+)
+
+// Opcodes. Values follow Bitcoin script so the assembly reads familiar.
+// 0x01-0x4b push the next n bytes onto the stack.
+const (
+	OP_0                   byte = 0x00
+	OP_PUSHDATA1           byte = 0x4c // next byte is the data length
+	OP_PUSHDATA2           byte = 0x4d // next two bytes (little endian) are the data length
+	OP_1                   byte = 0x51
+	OP_16                  byte = 0x60
+	OP_IF                  byte = 0x63
+	OP_NOTIF               byte = 0x64
+	OP_ELSE                byte = 0x67
+	OP_ENDIF               byte = 0x68
+	OP_VERIFY              byte = 0x69
+	OP_RETURN              byte = 0x6a
+	OP_DROP                byte = 0x75
+	OP_DUP                 byte = 0x76
+	OP_SWAP                byte = 0x7c
+	OP_EQUAL               byte = 0x87
+	OP_EQUALVERIFY         byte = 0x88
+	OP_SHA256              byte = 0xa8
+	OP_CHECKSIG            byte = 0xac
+	OP_CHECKSIGVERIFY      byte = 0xad
+	OP_CHECKMULTISIG       byte = 0xae
+	OP_CHECKLOCKTIMEVERIFY byte = 0xb1
+)
+
+var opcodeNames = map[byte]string{
+	OP_0:                   "OP_0",
+	OP_IF:                  "OP_IF",
+	OP_NOTIF:               "OP_NOTIF",
+	OP_ELSE:                "OP_ELSE",
+	OP_ENDIF:               "OP_ENDIF",
+	OP_VERIFY:              "OP_VERIFY",
+	OP_RETURN:              "OP_RETURN",
+	OP_DROP:                "OP_DROP",
+	OP_DUP:                 "OP_DUP",
+	OP_SWAP:                "OP_SWAP",
+	OP_EQUAL:               "OP_EQUAL",
+	OP_EQUALVERIFY:         "OP_EQUALVERIFY",
+	OP_SHA256:              "OP_SHA256",
+	OP_CHECKSIG:            "OP_CHECKSIG",
+	OP_CHECKSIGVERIFY:      "OP_CHECKSIGVERIFY",
+	OP_CHECKMULTISIG:       "OP_CHECKMULTISIG",
+	OP_CHECKLOCKTIMEVERIFY: "OP_CHECKLOCKTIMEVERIFY",
+}
+
+// ScriptContext carries the parts of the spending transaction that
+// signature and lock time opcodes are checked against.
+type ScriptContext struct {
+	SigHash  [32]byte
+	LockTime int64
+}
+
+// ScriptNumber encodes n the way the interpreter reads numbers:
+// little endian, without trailing zero bytes.
+func ScriptNumber(n int64) []byte {
+	b := make([]byte, 0, 8)
+	for u := uint64(n); u > 0; u >>= 8 {
+		b = append(b, byte(u))
+	}
+	return b
+}
+
+func scriptNumberValue(b []byte) (int64, error) {
+	if len(b) > 8 {
+		return 0, fmt.Errorf("number too long")
+	}
+	var u uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		u = u<<8 | uint64(b[i])
+	}
+	if int64(u) < 0 {
+		return 0, fmt.Errorf("number out of range")
+	}
+	return int64(u), nil
+}
+
+func scriptBool(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// PushData returns the opcodes pushing data onto the stack.
+func PushData(data []byte) []byte {
+	n := len(data)
+	switch {
+	case n == 0:
+		return []byte{OP_0}
+	case n < int(OP_PUSHDATA1):
+		return append([]byte{byte(n)}, data...)
+	case n <= 0xff:
+		return append([]byte{OP_PUSHDATA1, byte(n)}, data...)
+	default:
+		return append([]byte{OP_PUSHDATA2, byte(n), byte(n >> 8)}, data...)
+	}
+}
+
+// readPush decodes the push instruction at script[pc]. ok is false when
+// the opcode is not a push.
+func readPush(script []byte, pc int) (data []byte, next int, ok bool, err error) {
+	op := script[pc]
+	var n, start int
+	switch {
+	case op == OP_0:
+		return []byte{}, pc + 1, true, nil
+	case op < OP_PUSHDATA1:
+		n, start = int(op), pc+1
+	case op == OP_PUSHDATA1:
+		if pc+1 >= len(script) {
+			return nil, 0, true, fmt.Errorf("truncated OP_PUSHDATA1")
+		}
+		n, start = int(script[pc+1]), pc+2
+	case op == OP_PUSHDATA2:
+		if pc+2 >= len(script) {
+			return nil, 0, true, fmt.Errorf("truncated OP_PUSHDATA2")
+		}
+		n, start = int(script[pc+1])|int(script[pc+2])<<8, pc+3
+	case op >= OP_1 && op <= OP_16:
+		return []byte{op - OP_1 + 1}, pc + 1, true, nil
+	default:
+		return nil, 0, false, nil
+	}
+	if start+n > len(script) {
+		return nil, 0, true, fmt.Errorf("push past end of script")
+	}
+	return script[start : start+n], start + n, true, nil
+}
+
+type scriptStack [][]byte
+
+func (s *scriptStack) push(b []byte) error {
+	if len(*s) >= MAX_SCRIPT_STACK_SIZE {
+		return fmt.Errorf("stack overflow")
+	}
+	*s = append(*s, b)
+	return nil
+}
+
+func (s *scriptStack) pop() ([]byte, error) {
+	if len(*s) == 0 {
+		return nil, fmt.Errorf("stack underflow")
+	}
+	b := (*s)[len(*s)-1]
+	*s = (*s)[:len(*s)-1]
+	return b, nil
+}
+
+func (s *scriptStack) popNumber() (int64, error) {
+	b, err := s.pop()
+	if err != nil {
+		return 0, err
+	}
+	return scriptNumberValue(b)
+}
+
+// RunScript executes script on a stack initialised with witness, bottom
+// first. It returns nil when the script finishes within MAX_SCRIPT_STEPS
+// with a true value on top of the stack.
+func RunScript(script []byte, witness [][]byte, ctx *ScriptContext) error {
+	if len(script) > MAX_SCRIPT_SIZE {
+		return fmt.Errorf("script too large")
+	}
+	stack := scriptStack{}
+	for _, w := range witness {
+		if err := stack.push(w); err != nil {
+			return err
+		}
+	}
+	// conditions holds one entry per open OP_IF; code runs only when all are true.
+	conditions := []bool{}
+	executing := func() bool {
+		for _, c := range conditions {
+			if !c {
+				return false
+			}
+		}
+		return true
+	}
+
+	steps := 0
+	for pc := 0; pc < len(script); {
+		steps++
+		if steps > MAX_SCRIPT_STEPS {
+			return fmt.Errorf("step limit exceeded")
+		}
+		data, next, isPush, err := readPush(script, pc)
+		if err != nil {
+			return err
+		}
+		if isPush {
+			pc = next
+			if executing() {
+				if err := stack.push(data); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		op := script[pc]
+		pc++
+
+		switch op {
+		case OP_IF, OP_NOTIF:
+			cond := false
+			if executing() {
+				b, err := stack.pop()
+				if err != nil {
+					return err
+				}
+				cond = scriptBool(b) == (op == OP_IF)
+			}
+			conditions = append(conditions, cond)
+			continue
+		case OP_ELSE:
+			if len(conditions) == 0 {
+				return fmt.Errorf("OP_ELSE without OP_IF")
+			}
+			conditions[len(conditions)-1] = !conditions[len(conditions)-1]
+			continue
+		case OP_ENDIF:
+			if len(conditions) == 0 {
+				return fmt.Errorf("OP_ENDIF without OP_IF")
+			}
+			conditions = conditions[:len(conditions)-1]
+			continue
+		}
+		if !executing() {
+			if _, known := opcodeNames[op]; !known {
+				return fmt.Errorf("unknown opcode 0x%02x", op)
+			}
+			continue
+		}
+
+		switch op {
+		case OP_VERIFY:
+			b, err := stack.pop()
+			if err != nil {
+				return err
+			}
+			if !scriptBool(b) {
+				return fmt.Errorf("OP_VERIFY failed")
+			}
+		case OP_RETURN:
+			return fmt.Errorf("OP_RETURN")
+		case OP_DROP:
+			if _, err := stack.pop(); err != nil {
+				return err
+			}
+		case OP_DUP:
+			b, err := stack.pop()
+			if err != nil {
+				return err
+			}
+			stack.push(b)
+			if err := stack.push(b); err != nil {
+				return err
+			}
+		case OP_SWAP:
+			a, err := stack.pop()
+			if err != nil {
+				return err
+			}
+			b, err := stack.pop()
+			if err != nil {
+				return err
+			}
+			stack.push(a)
+			stack.push(b)
+		case OP_EQUAL, OP_EQUALVERIFY:
+			a, err := stack.pop()
+			if err != nil {
+				return err
+			}
+			b, err := stack.pop()
+			if err != nil {
+				return err
+			}
+			equal := bytes.Equal(a, b)
+			if op == OP_EQUALVERIFY {
+				if !equal {
+					return fmt.Errorf("OP_EQUALVERIFY failed")
+				}
+				break
+			}
+			stack.push(boolBytes(equal))
+		case OP_SHA256:
+			b, err := stack.pop()
+			if err != nil {
+				return err
+			}
+			h := sha256.Sum256(b)
+			stack.push(h[:])
+		case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+			publicKey, err := stack.pop()
+			if err != nil {
+				return err
+			}
+			signature, err := stack.pop()
+			if err != nil {
+				return err
+			}
+			valid := verifyScriptSignature(publicKey, signature, ctx.SigHash)
+			if op == OP_CHECKSIGVERIFY {
+				if !valid {
+					return fmt.Errorf("OP_CHECKSIGVERIFY failed")
+				}
+				break
+			}
+			stack.push(boolBytes(valid))
+		case OP_CHECKMULTISIG:
+			valid, err := checkMultisig(&stack, ctx.SigHash)
+			if err != nil {
+				return err
+			}
+			stack.push(boolBytes(valid))
+		case OP_CHECKLOCKTIMEVERIFY:
+			if len(stack) == 0 {
+				return fmt.Errorf("stack underflow")
+			}
+			lockTime, err := scriptNumberValue(stack[len(stack)-1])
+			if err != nil {
+				return err
+			}
+			if (lockTime < LOCKTIME_THRESHOLD) != (ctx.LockTime < LOCKTIME_THRESHOLD) {
+				return fmt.Errorf("lock time type mismatch")
+			}
+			if lockTime > ctx.LockTime {
+				return fmt.Errorf("lock time not reached")
+			}
+		default:
+			return fmt.Errorf("unknown opcode 0x%02x", op)
+		}
+	}
+
+	if len(conditions) != 0 {
+		return fmt.Errorf("unbalanced conditional")
+	}
+	top, err := stack.pop()
+	if err != nil {
+		return err
+	}
+	if !scriptBool(top) {
+		return fmt.Errorf("script evaluated to false")
+	}
+	return nil
+}
+
+func boolBytes(b bool) []byte {
+	if b {
+		return []byte{1}
+	}
+	return []byte{}
+}
+
+// checkMultisig consumes <sig>... <m> <key>... <n> from the stack.
+// Signatures must appear in the same order as their keys.
+func checkMultisig(stack *scriptStack, sigHash [32]byte) (bool, error) {
+	n, err := stack.popNumber()
+	if err != nil {
+		return false, err
+	}
+	if n < 1 || n > MAX_MULTISIG_KEYS {
+		return false, fmt.Errorf("invalid multisig key count %d", n)
+	}
+	keys := make([][]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		if keys[i], err = stack.pop(); err != nil {
+			return false, err
+		}
+	}
+	m, err := stack.popNumber()
+	if err != nil {
+		return false, err
+	}
+	if m < 1 || m > n {
+		return false, fmt.Errorf("invalid multisig threshold %d", m)
+	}
+	signatures := make([][]byte, m)
+	for i := m - 1; i >= 0; i-- {
+		if signatures[i], err = stack.pop(); err != nil {
+			return false, err
+		}
+	}
+
+	k := 0
+	for _, s := range signatures {
+		for k < len(keys) && !verifyScriptSignature(keys[k], s, sigHash) {
+			k++
+		}
+		if k == len(keys) {
+			return false, nil
+		}
+		k++
+	}
+	return true, nil
+}
+
+// verifyScriptSignature checks a 64 byte R||S signature against a
+// 64 byte X||Y P-256 public key, the same encodings the wallet uses.
+func verifyScriptSignature(publicKey []byte, signature []byte, sigHash [32]byte) bool {
+	if len(publicKey) != 64 || len(signature) != 64 {
+		return false
+	}
+	x := new(big.Int).SetBytes(publicKey[:32])
+	y := new(big.Int).SetBytes(publicKey[32:])
+	if !elliptic.P256().IsOnCurve(x, y) {
+		return false
+	}
+	pk := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	return ecdsa.Verify(pk, sigHash[:], r, s)
+}
+
+// ParseScript assembles a space separated script such as
+// "OP_SHA256 <hex> OP_EQUAL". Tokens that are not opcode names are
+// pushed as hex data.
+func ParseScript(asm string) ([]byte, error) {
+	script := []byte{}
+	for _, token := range strings.Fields(asm) {
+		if op, ok := opcodeByName(token); ok {
+			script = append(script, op)
+			continue
+		}
+		data, err := hex.DecodeString(token)
+		if err != nil {
+			return nil, fmt.Errorf("invalid token %q", token)
+		}
+		script = append(script, PushData(data)...)
+	}
+	if len(script) > MAX_SCRIPT_SIZE {
+		return nil, fmt.Errorf("script too large")
+	}
+	return script, nil
+}
+
+func opcodeByName(name string) (byte, bool) {
+	if name == "OP_FALSE" {
+		return OP_0, true
+	}
+	if name == "OP_TRUE" {
+		return OP_1, true
+	}
+	for n := 1; n <= 16; n++ {
+		if name == fmt.Sprintf("OP_%d", n) {
+			return OP_1 + byte(n-1), true
+		}
+	}
+	for op, n := range opcodeNames {
+		if n == name {
+			return op, true
+		}
+	}
+	return 0, false
+}
+
+// DisassembleScript is the inverse of ParseScript.
+func DisassembleScript(script []byte) string {
+	tokens := []string{}
+	for pc := 0; pc < len(script); {
+		data, next, isPush, err := readPush(script, pc)
+		if err != nil {
+			tokens = append(tokens, "[error]")
+			break
+		}
+		if isPush {
+			op := script[pc]
+			switch {
+			case op == OP_0:
+				tokens = append(tokens, "OP_0")
+			case op >= OP_1 && op <= OP_16:
+				tokens = append(tokens, fmt.Sprintf("OP_%d", op-OP_1+1))
+			default:
+				tokens = append(tokens, hex.EncodeToString(data))
+			}
+			pc = next
+			continue
+		}
+		if name, ok := opcodeNames[script[pc]]; ok {
+			tokens = append(tokens, name)
+		} else {
+			tokens = append(tokens, fmt.Sprintf("[0x%02x]", script[pc]))
+		}
+		pc++
+	}
+	return strings.Join(tokens, " ")
+}
+
+// ScriptAddress derives the blockchain address funds locked by script
+// are sent to.
+func ScriptAddress(script []byte) string {
+	return hashAddress(SCRIPT_ADDRESS_PREFIX, script)
+}
+
+// IsScriptAddress reports whether address was produced by ScriptAddress.
+func IsScriptAddress(address string) bool {
+	return isHashAddress(address, SCRIPT_ADDRESS_PREFIX)
+}
+
+// hashAddress is laid out like a wallet address (see wallet.NewWallet),
+// with its own version byte and the SHA-256 of data cut to 20 bytes in
+// place of the RIPEMD-160 of a public key.
+func hashAddress(version byte, data []byte) string {
+	h := sha256.Sum256(data)
+	vd := append([]byte{version}, h[:20]...)
+	d1 := sha256.Sum256(vd)
+	d2 := sha256.Sum256(d1[:])
+	return base58.Encode(append(vd, d2[:4]...))
+}
+
+func isHashAddress(address string, version byte) bool {
+	b := base58.Decode(address)
+	if len(b) != 25 || b[0] != version {
+		return false
+	}
+	d1 := sha256.Sum256(b[:21])
+	d2 := sha256.Sum256(d1[:])
+	return bytes.Equal(d2[:4], b[21:])
+}
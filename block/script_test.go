@@ -0,0 +1,106 @@
+package block
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// Keys and signatures below sign scriptTestSigHash.
+const (
+	scriptTestSigHash = "e45282550735d449367b454e0ad088454b3f0ed11bcd9c9e6d2030ab541676a5"
+
+	scriptTestKey0 = "a718d0184fd45a1087854f1fd5eb9f419c932c0c3074d2f352024d1d1b5452491c2430fa9b467771028ef1a41f8f3a975ae3143e26c1639070238b4a4014b6de"
+	scriptTestSig0 = "85d44404a554b4e32fd1c40bd65fb95c67c65d8a0112203aae485f374272a9554e53b1295f38c1bdbe13aba8627a1f9aa7ed8dc5dc1a440f22f64dd47452e82b"
+	scriptTestKey1 = "796e00c13a3cdab7dbf6501ff35a803c240850c2c13f008569b878b9c1201e5ae8ead3a3462b5670a22eea8df7719af6806a7929b154f258c1fa245de1742022"
+	scriptTestSig1 = "4bef8e6269c69cf2407854c99ecefaf4af3cb75379b6eefc059cb5d1bb6ebdb1182f07b98269b8232f9691f1209156426c6cb903723b205ec53ae62f71534682"
+	scriptTestKey2 = "36db4072a6985eaca2811b07f3ab2a8bc4a1b227001b03e4ad5afdc0dd8e215fd4654a7f2400d12a6c4ed476a53392bd138398f70bec4b22d318349afd7e9833"
+	scriptTestSig2 = "22867a561f0897fa65f93ed8f795950941183b6ddc6b04e7f940c719ac288defa28e1860b99fdc6d7d90b823bc341cf0e0bbd875f988b6bf90fca427e6da8e2a"
+
+	scriptTestPreimage = "736563726574" // "secret"
+	scriptTestHash     = "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b"
+)
+
+var scriptTests = []struct {
+	name     string
+	script   string   // Assembly, see ParseScript
+	witness  []string // Hex, bottom of the stack first
+	lockTime int64
+	valid    bool
+}{
+	{name: "true", script: "OP_1", valid: true},
+	{name: "false", script: "OP_0", valid: false},
+	{name: "empty script", script: "", valid: false},
+	{name: "op_return", script: "OP_1 OP_RETURN", valid: false},
+	{name: "equal", script: "0102 0102 OP_EQUAL", valid: true},
+	{name: "equalverify mismatch", script: "0102 0103 OP_EQUALVERIFY OP_1", valid: false},
+	{name: "dup drop swap", script: "OP_1 OP_0 OP_SWAP OP_DUP OP_DROP", valid: true},
+	{name: "stack underflow", script: "OP_DROP OP_1", valid: false},
+	{name: "if branch", script: "OP_1 OP_IF OP_1 OP_ELSE OP_0 OP_ENDIF", valid: true},
+	{name: "else branch", script: "OP_0 OP_IF OP_0 OP_ELSE OP_1 OP_ENDIF", valid: true},
+	{name: "notif", script: "OP_0 OP_NOTIF OP_1 OP_ENDIF", valid: true},
+	{name: "nested skipped branch", script: "OP_0 OP_IF OP_1 OP_IF OP_RETURN OP_ENDIF OP_ELSE OP_1 OP_ENDIF", valid: true},
+	{name: "unbalanced if", script: "OP_1 OP_IF OP_1", valid: false},
+	{name: "step limit", script: strings.Repeat("OP_1 OP_DROP ", MAX_SCRIPT_STEPS/2) + "OP_1", valid: false},
+
+	{name: "hash lock", script: "OP_SHA256 " + scriptTestHash + " OP_EQUAL",
+		witness: []string{scriptTestPreimage}, valid: true},
+	{name: "hash lock wrong preimage", script: "OP_SHA256 " + scriptTestHash + " OP_EQUAL",
+		witness: []string{"736563726575"}, valid: false},
+
+	{name: "checksig", script: scriptTestKey0 + " OP_CHECKSIG",
+		witness: []string{scriptTestSig0}, valid: true},
+	{name: "checksig wrong key", script: scriptTestKey1 + " OP_CHECKSIG",
+		witness: []string{scriptTestSig0}, valid: false},
+	{name: "checksigverify", script: scriptTestKey0 + " OP_CHECKSIGVERIFY OP_1",
+		witness: []string{scriptTestSig0}, valid: true},
+	{name: "checksig malformed key", script: "0102 OP_CHECKSIG",
+		witness: []string{scriptTestSig0}, valid: false},
+
+	{name: "multisig 2 of 3", script: "OP_2 " + scriptTestKey0 + " " + scriptTestKey1 + " " + scriptTestKey2 + " OP_3 OP_CHECKMULTISIG",
+		witness: []string{scriptTestSig0, scriptTestSig2}, valid: true},
+	{name: "multisig out of order", script: "OP_2 " + scriptTestKey0 + " " + scriptTestKey1 + " " + scriptTestKey2 + " OP_3 OP_CHECKMULTISIG",
+		witness: []string{scriptTestSig2, scriptTestSig0}, valid: false},
+	{name: "multisig same signature twice", script: "OP_2 " + scriptTestKey0 + " " + scriptTestKey1 + " " + scriptTestKey2 + " OP_3 OP_CHECKMULTISIG",
+		witness: []string{scriptTestSig1, scriptTestSig1}, valid: false},
+	{name: "multisig threshold above keys", script: "OP_3 " + scriptTestKey0 + " OP_1 OP_CHECKMULTISIG",
+		witness: []string{scriptTestSig0, scriptTestSig0, scriptTestSig0}, valid: false},
+
+	{name: "height lock reached", script: "64 OP_CHECKLOCKTIMEVERIFY OP_DROP OP_1", lockTime: 100, valid: true},
+	{name: "height lock not reached", script: "64 OP_CHECKLOCKTIMEVERIFY OP_DROP OP_1", lockTime: 99, valid: false},
+	{name: "time lock reached", script: "00f15365 OP_CHECKLOCKTIMEVERIFY OP_DROP OP_1", lockTime: 1700000000, valid: true},
+	{name: "time lock against height", script: "00f15365 OP_CHECKLOCKTIMEVERIFY OP_DROP OP_1", lockTime: 100, valid: false},
+
+	{name: "hash time lock redeem", script: "OP_IF OP_SHA256 " + scriptTestHash + " OP_EQUALVERIFY " + scriptTestKey0 +
+		" OP_CHECKSIG OP_ELSE 64 OP_CHECKLOCKTIMEVERIFY OP_DROP " + scriptTestKey1 + " OP_CHECKSIG OP_ENDIF",
+		witness: []string{scriptTestSig0, scriptTestPreimage, "01"}, valid: true},
+	{name: "hash time lock refund", script: "OP_IF OP_SHA256 " + scriptTestHash + " OP_EQUALVERIFY " + scriptTestKey0 +
+		" OP_CHECKSIG OP_ELSE 64 OP_CHECKLOCKTIMEVERIFY OP_DROP " + scriptTestKey1 + " OP_CHECKSIG OP_ENDIF",
+		witness: []string{scriptTestSig1, ""}, lockTime: 100, valid: true},
+	{name: "hash time lock early refund", script: "OP_IF OP_SHA256 " + scriptTestHash + " OP_EQUALVERIFY " + scriptTestKey0 +
+		" OP_CHECKSIG OP_ELSE 64 OP_CHECKLOCKTIMEVERIFY OP_DROP " + scriptTestKey1 + " OP_CHECKSIG OP_ENDIF",
+		witness: []string{scriptTestSig1, ""}, lockTime: 50, valid: false},
+}
+
+// Every node must agree on whether the interpreter accepts these scripts.
+func TestRunScript(t *testing.T) {
+	h, _ := hex.DecodeString(scriptTestSigHash)
+	ctx := &ScriptContext{}
+	copy(ctx.SigHash[:], h)
+	for _, tt := range scriptTests {
+		t.Run(tt.name, func(t *testing.T) {
+			script, err := ParseScript(tt.script)
+			if err != nil {
+				t.Fatal(err)
+			}
+			witness, err := decodeWitness(tt.witness)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx.LockTime = tt.lockTime
+			if err := RunScript(script, witness, ctx); (err == nil) != tt.valid {
+				t.Fatalf("valid=%t err=%v", tt.valid, err)
+			}
+		})
+	}
+}
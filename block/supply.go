@@ -0,0 +1,111 @@
+package block
+
+import (
+	"math"
+)
+
+const (
+	REWARD_HALVING_INTERVAL = 210000
+	MAX_HALVINGS            = 64 // The scheduled reward is 0 after that many halvings
+)
+
+// Supply describes the coins in circulation and to come.
+type Supply struct {
+	Height      int      `json:"height"`
+	Circulating float64  `json:"circulating_supply"` // Genesis allocations and coinbases of our chain
+	Max         *float64 `json:"max_supply"`         // Nil when emission never ends
+	NextReward  float32  `json:"next_block_reward"`
+}
+
+// scheduled is the reward of the block at height before the supply cap.
+// Heights 1 to HalvingInterval pay the initial reward, the next ones
+// half of it, and so on.
+func (rs *RewardSchedule) scheduled(height int) float64 {
+	r := float64(rs.Initial)
+	if rs.HalvingInterval > 0 {
+		halvings := (height - 1) / rs.HalvingInterval
+		if halvings >= MAX_HALVINGS {
+			r = 0
+		} else {
+			r = math.Ldexp(r, -halvings)
+		}
+	}
+	return math.Max(r, float64(rs.TailEmission))
+}
+
+// emitted sums the scheduled rewards of the blocks up to height, era by
+// era.
+func (rs *RewardSchedule) emitted(height int) float64 {
+	total := 0.0
+	for start := 1; start <= height; {
+		end := height
+		if rs.HalvingInterval > 0 && start+rs.HalvingInterval-1 < end {
+			end = start + rs.HalvingInterval - 1
+		}
+		total += float64(end-start+1) * rs.scheduled(start)
+		start = end + 1
+	}
+	return total
+}
+
+// GenesisSupply sums the genesis allocations.
+func (cs *ChainSpec) GenesisSupply() float64 {
+	total := 0.0
+	for _, value := range cs.Genesis.Allocations {
+		total += float64(value)
+	}
+	return total
+}
+
+// BlockReward is the most the coinbase of the block at height may claim:
+// the scheduled reward, cut once the blocks before it would have reached
+// the supply cap. Gas fees are not part of it, they reach the miner
+// through the receipts of the block.
+func (cs *ChainSpec) BlockReward(height int) float32 {
+	r := cs.Reward.scheduled(height)
+	if cs.Reward.MaxSupply > 0 {
+		left := float64(cs.Reward.MaxSupply) - cs.GenesisSupply() - cs.Reward.emitted(height-1)
+		r = math.Max(0, math.Min(r, left))
+	}
+	return float32(r)
+}
+
+// MaxSupply is the most coins there will ever be, false when emission
+// never ends.
+func (cs *ChainSpec) MaxSupply() (float64, bool) {
+	rs := cs.Reward
+	switch {
+	case rs.MaxSupply > 0:
+		return float64(rs.MaxSupply), true
+	case rs.Initial == 0 && rs.TailEmission == 0:
+		return cs.GenesisSupply(), true
+	case rs.HalvingInterval == 0 || rs.TailEmission > 0:
+		return 0, false
+	}
+	return cs.GenesisSupply() + rs.emitted(MAX_HALVINGS*rs.HalvingInterval), true
+}
+
+// coinbaseValue sums what the mining sender pays in b.
+func (b *Block) coinbaseValue() float64 {
+	total := 0.0
+	for _, t := range b.transactions {
+		if t.IsCoinbase() {
+			total += float64(t.value)
+		}
+	}
+	return total
+}
+
+func (bc *Blockchain) Supply() *Supply {
+	chain := bc.Chain()
+	bc.muxState.RLock()
+	defer bc.muxState.RUnlock()
+	s := &Supply{Height: len(chain) - 1, NextReward: bc.spec.BlockReward(len(chain))}
+	for _, b := range chain {
+		s.Circulating += b.coinbaseValue()
+	}
+	if max, ok := bc.spec.MaxSupply(); ok {
+		s.Max = &max
+	}
+	return s
+}
@@ -0,0 +1,82 @@
+package block
+
+import (
+	"math"
+	"testing"
+)
+
+// The reward halves on the first block of every era and is 0 once it has
+// halved MAX_HALVINGS times, unless a tail emission or the cap applies.
+func TestBlockReward(t *testing.T) {
+	halving := func(rs RewardSchedule) *ChainSpec {
+		spec := DefaultChainSpec()
+		spec.Reward = rs
+		return spec
+	}
+	standard := halving(RewardSchedule{Initial: 8, HalvingInterval: 10})
+	tail := halving(RewardSchedule{Initial: 8, HalvingInterval: 10, TailEmission: 1.5})
+	capped := halving(RewardSchedule{Initial: 8, HalvingInterval: 10, MaxSupply: 125})
+	capped.Genesis.Allocations = map[string]float32{"alice": 5}
+
+	tests := []struct {
+		name   string
+		spec   *ChainSpec
+		height int
+		reward float32
+	}{
+		{"first block", standard, 1, 8},
+		{"last block of the first era", standard, 10, 8},
+		{"first halving", standard, 11, 4},
+		{"last block of the second era", standard, 20, 4},
+		{"second halving", standard, 21, 2},
+		{"last halving", standard, MAX_HALVINGS * 10, float32(math.Ldexp(8, -(MAX_HALVINGS - 1)))},
+		{"after the last halving", standard, MAX_HALVINGS*10 + 1, 0},
+		{"far after the last halving", standard, 1000 * MAX_HALVINGS * 10, 0},
+		{"above the tail", tail, 21, 2},
+		{"down to the tail", tail, 31, 1.5},
+		{"tail after the last halving", tail, MAX_HALVINGS*10 + 1, 1.5},
+		{"below the cap", capped, 11, 4},
+		{"cut at the cap", capped, 21, 0},
+		{"after the cap", capped, 22, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if reward := tt.spec.BlockReward(tt.height); reward != tt.reward {
+				t.Fatalf("reward %v at %d, want %v", reward, tt.height, tt.reward)
+			}
+		})
+	}
+}
+
+// Supply counts the genesis allocations and every reward paid, and all
+// rewards ever paid add up to the max supply.
+func TestSupply(t *testing.T) {
+	spec := DefaultChainSpec()
+	spec.Reward = RewardSchedule{Initial: 8, HalvingInterval: 2}
+	spec.Genesis.Allocations = map[string]float32{"alice": 5}
+	bc := NewBlockchainWithSpec("miner", 0, spec)
+
+	total := spec.GenesisSupply()
+	chain := []*Block{bc.LastBlock()}
+	for height := 1; height <= 9; height++ {
+		reward := spec.BlockReward(height)
+		total += float64(reward)
+		chain = append(chain, NewBlock(int64(height), 0, chain[height-1].Hash(), []*Transaction{newCoinbase("miner", reward)}))
+	}
+	bc.chain = chain
+
+	s := bc.Supply()
+	if s.Height != 9 || s.Circulating != total || s.NextReward != 0.5 {
+		t.Fatalf("height %d, %v circulating and next reward %v, want 9, %v and 0.5", s.Height, s.Circulating, s.NextReward, total)
+	}
+
+	for height := 10; height <= MAX_HALVINGS*spec.Reward.HalvingInterval+1; height++ {
+		total += float64(spec.BlockReward(height))
+	}
+	if s.Max == nil {
+		t.Fatal("no max supply")
+	}
+	if math.Abs(*s.Max-total) > 1e-9 {
+		t.Fatalf("max supply %v, want %v", *s.Max, total)
+	}
+}
@@ -0,0 +1,226 @@
+package block
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MAX_HEADERS_PER_SYNC = 100000 // Headers kept by one sync; the next one goes on from there
+	SYNC_HEIGHT_MARGIN   = 100    // Blocks a peer may mine during a sync beyond the height it announced
+)
+
+// SyncProgress reports what the running (or last) chain sync is doing.
+type SyncProgress struct {
+	Syncing         bool   `json:"syncing"`
+	Peer            string `json:"peer"`
+	Height          int    `json:"height"`
+	TargetHeight    int    `json:"target_height"`
+	HeadersReceived int    `json:"headers_received"`
+	BlocksReceived  int    `json:"blocks_received"`
+	BlocksTotal     int    `json:"blocks_total"`
+	Orphans         int    `json:"orphans"` // Received blocks waiting for their parent
+}
+
+// headerChain is the branch a peer announced with its headers.
+type headerChain struct {
+	peer      string
+	forkIndex int // Index of the last block in common with our chain
+	headers   []*BlockHeader
+}
+
+func (hc *headerChain) length() int {
+	return hc.forkIndex + 1 + len(hc.headers)
+}
+
+func (bc *Blockchain) SyncStatus() SyncProgress {
+	bc.muxSync.Lock()
+	defer bc.muxSync.Unlock()
+	p := bc.syncProgress
+	p.Orphans = bc.orphans.Len()
+	return p
+}
+
+func (bc *Blockchain) updateSync(f func(p *SyncProgress)) {
+	bc.muxSync.Lock()
+	defer bc.muxSync.Unlock()
+	f(&bc.syncProgress)
+}
+
+// fetchHeaders asks peer for the headers following our block locator,
+// batch by batch, and checks that they link up and carry a valid proof
+// of work. Peers sending more headers than the height they announced in
+// the first batch are penalized.
+func (bc *Blockchain) fetchHeaders(peer string) (*headerChain, bool) {
+	hc := &headerChain{peer: peer}
+	locator := bc.BlockLocator()
+	announced := -1
+	for {
+		resp, ok := bc.getHeaders(peer, locator)
+		if !ok {
+			return nil, false
+		}
+		if announced < 0 {
+			announced = resp.Height
+		}
+		if len(resp.Headers) > MAX_HEADERS_PER_REQUEST {
+			log.Printf("ERROR: %d headers from %s in one batch", len(resp.Headers), peer)
+			bc.peerManager.Misbehaving(peer, PENALTY_INVALID_HEADERS, "too many headers")
+			return nil, false
+		}
+		for _, h := range resp.Headers {
+			var previousHash [32]byte
+			if len(hc.headers) > 0 {
+				previousHash = hc.headers[len(hc.headers)-1].Hash()
+			} else if i := bc.heightOf(h.previousHash); i >= 0 {
+				hc.forkIndex = i
+				previousHash = h.previousHash
+			} else {
+				log.Printf("ERROR: Headers from %s do not connect", peer)
+				bc.peerManager.Misbehaving(peer, PENALTY_INVALID_HEADERS, "unconnected headers")
+				return nil, false
+			}
+			if h.previousHash != previousHash || !bc.ValidProof(h, bc.spec.Difficulty) {
+				log.Printf("ERROR: Invalid header from %s", peer)
+				bc.peerManager.Misbehaving(peer, PENALTY_INVALID_HEADERS, "invalid header")
+				return nil, false
+			}
+			if hc.length() > announced+SYNC_HEIGHT_MARGIN {
+				log.Printf("ERROR: Headers from %s beyond its height %d", peer, announced)
+				bc.peerManager.Misbehaving(peer, PENALTY_INVALID_HEADERS, "headers beyond announced height")
+				return nil, false
+			}
+			if !bc.matchesCheckpoint(hc.forkIndex+1+len(hc.headers), h.Hash()) {
+				bc.peerManager.Misbehaving(peer, PENALTY_INVALID_HEADERS, "checkpoint mismatch")
+				return nil, false
+			}
+			hc.headers = append(hc.headers, h)
+		}
+		bc.updateSync(func(p *SyncProgress) {
+			p.HeadersReceived = len(hc.headers)
+			p.TargetHeight = resp.Height
+		})
+		if len(resp.Headers) < MAX_HEADERS_PER_REQUEST || len(hc.headers) >= MAX_HEADERS_PER_SYNC {
+			return hc, true
+		}
+		locator = [][32]byte{hc.headers[len(hc.headers)-1].Hash()}
+	}
+}
+
+func (bc *Blockchain) getHeaders(peer string, locator [][32]byte) (*HeadersResponse, bool) {
+	hashes := make([]string, len(locator))
+	for i, h := range locator {
+		hashes[i] = fmt.Sprintf("%x", h)
+	}
+	endPoint := bc.peerURL(peer, fmt.Sprintf("/headers?locator=%s&limit=%d", strings.Join(hashes, ","), MAX_HEADERS_PER_REQUEST))
+	client := bc.peerClient(PEER_REQUEST_TIMEOUT_SEC * time.Second)
+	resp, err := client.Get(endPoint)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		bc.peerManager.Misbehaving(peer, PENALTY_TIMEOUT, "timeout")
+		return nil, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, false
+	}
+	var hr HeadersResponse
+	if err := json.NewDecoder(resp.Body).Decode(&hr); err != nil {
+		log.Printf("ERROR: %v", err)
+		bc.peerManager.Misbehaving(peer, PENALTY_INVALID_HEADERS, "invalid headers")
+		return nil, false
+	}
+	return &hr, true
+}
+
+// downloadBodies fetches the blocks of hc we do not have yet, spreading
+// the requests over peers in parallel. Blocks a peer cannot serve are
+// retried from the peer that announced the headers.
+func (bc *Blockchain) downloadBodies(hc *headerChain, peers []string) ([]*Block, bool) {
+	blocks := make([]*Block, len(hc.headers))
+	jobs := make(chan int, len(hc.headers))
+	for i, h := range hc.headers {
+		if b := bc.BlockByHash(h.Hash()); b != nil {
+			blocks[i] = b
+			continue
+		}
+		jobs <- i
+	}
+	close(jobs)
+	bc.updateSync(func(p *SyncProgress) {
+		p.BlocksTotal = len(jobs)
+	})
+
+	fetch := func(peer string, i int) bool {
+		hash := hc.headers[i].Hash()
+		b := bc.fetchBlock(peer, hash)
+		if b == nil {
+			return false
+		}
+		blocks[i] = b
+		bc.updateSync(func(p *SyncProgress) {
+			p.BlocksReceived++
+		})
+		return true
+	}
+
+	var wg sync.WaitGroup
+	var muxFailed sync.Mutex
+	failed := []int{}
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			for i := range jobs {
+				if !fetch(peer, i) {
+					muxFailed.Lock()
+					failed = append(failed, i)
+					muxFailed.Unlock()
+				}
+			}
+		}(peer)
+	}
+	wg.Wait()
+
+	for _, i := range failed {
+		if !fetch(hc.peer, i) {
+			log.Printf("ERROR: Could not download block %x", hc.headers[i].Hash())
+			return nil, false
+		}
+	}
+	return blocks, true
+}
+
+// syncTo downloads the bodies of hc and switches to its chain if it is
+// still longer than ours once everything has been validated.
+func (bc *Blockchain) syncTo(hc *headerChain, peers []string, assumeValid bool) bool {
+	log.Printf("action=sync, status=downloading, peer=%s, blocks=%d", hc.peer, len(hc.headers))
+	blocks, ok := bc.downloadBodies(hc, peers)
+	if !ok {
+		return false
+	}
+
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	if hc.forkIndex >= len(bc.chain) || hc.length() <= len(bc.chain) {
+		return false
+	}
+	if bc.chain[hc.forkIndex].Hash() != hc.headers[0].previousHash {
+		return false
+	}
+	chain := append(append([]*Block{}, bc.chain[:hc.forkIndex+1]...), blocks...)
+	if !bc.validChain(chain, assumeValid) {
+		log.Printf("ERROR: Invalid chain from %s", hc.peer)
+		bc.peerManager.Misbehaving(hc.peer, PENALTY_INVALID_BLOCK, "invalid chain")
+		return false
+	}
+	disconnected := bc.chain[hc.forkIndex+1:]
+	bc.chain = chain
+	bc.rebuildState()
+	bc.reorganizePool(disconnected, blocks)
+	return true
+}
@@ -0,0 +1,54 @@
+package block
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Peers cannot make a sync buffer headers beyond the height they announce.
+func TestFetchHeadersBeyondAnnouncedHeight(t *testing.T) {
+	spec := DefaultChainSpec()
+	spec.Difficulty = 1
+	peer := NewBlockchainWithSpec("peer", 0, spec)
+	blocks := SYNC_HEIGHT_MARGIN + 10
+	for i := 0; i < blocks; i++ {
+		peer.Mining()
+	}
+
+	tests := []struct {
+		name      string
+		announced int
+		ok        bool
+	}{
+		{"honest", blocks, true},
+		{"within the margin", blocks - SYNC_HEIGHT_MARGIN, true},
+		{"beyond the margin", blocks - SYNC_HEIGHT_MARGIN - 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(&HeadersResponse{
+					Headers: peer.HeadersAfter(nil, 0)[1:],
+					Height:  tt.announced,
+				})
+			}))
+			defer srv.Close()
+			bc := NewBlockchainWithSpec("miner", 0, spec)
+			address := strings.TrimPrefix(srv.URL, "http://")
+
+			hc, ok := bc.fetchHeaders(address)
+			if ok != tt.ok {
+				t.Fatalf("fetched %v, want %v", ok, tt.ok)
+			}
+			if ok && hc.length() != blocks+1 {
+				t.Fatalf("chain of %d headers, want %d", hc.length(), blocks+1)
+			}
+			if penalized := len(bc.peerManager.Peers()) > 0; penalized == tt.ok {
+				t.Fatalf("penalized %v", penalized)
+			}
+		})
+	}
+}
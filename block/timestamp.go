@@ -0,0 +1,61 @@
+package block
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	MEDIAN_TIME_BLOCKS   = 11   // Blocks the median time past is taken over
+	MAX_FUTURE_DRIFT_SEC = 7200 // Default of ChainSpec.MaxFutureDriftSec
+)
+
+// Clock tells the time blocks are mined and checked at. Tests can set a
+// fixed one with SetClock.
+type Clock func() time.Time
+
+func (bc *Blockchain) SetClock(clock Clock) {
+	bc.clock = clock
+}
+
+// medianTimePast is the median timestamp of the last MEDIAN_TIME_BLOCKS
+// blocks of chain. Unlike the timestamp of the last block, a single
+// miner cannot move it far.
+func medianTimePast(chain []*Block) int64 {
+	start := len(chain) - MEDIAN_TIME_BLOCKS
+	if start < 0 {
+		start = 0
+	}
+	timestamps := []int64{}
+	for _, b := range chain[start:] {
+		timestamps = append(timestamps, b.timestamp)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2]
+}
+
+// validTimestamp checks that b, the block following chain, is later than
+// the median time past of chain and not too far ahead of our clock.
+func (bc *Blockchain) validTimestamp(chain []*Block, b *Block) bool {
+	if b.timestamp <= medianTimePast(chain) {
+		log.Println("ERROR: Block timestamp not after the median time past")
+		return false
+	}
+	drift := time.Duration(bc.spec.MaxFutureDriftSec) * time.Second
+	if b.timestamp > bc.clock().Add(drift).UnixNano() {
+		log.Println("ERROR: Block timestamp too far in the future")
+		return false
+	}
+	return true
+}
+
+// nextTimestamp is the timestamp of the block we mine next: now, unless
+// our clock lags behind the median time past.
+func (bc *Blockchain) nextTimestamp() int64 {
+	timestamp := bc.clock().UnixNano()
+	if mtp := medianTimePast(bc.chain); timestamp <= mtp {
+		timestamp = mtp + 1
+	}
+	return timestamp
+}
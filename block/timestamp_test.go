@@ -0,0 +1,83 @@
+package block
+
+import (
+	"testing"
+	"time"
+)
+
+// chainAt builds a chain whose blocks after genesis have timestamps.
+func chainAt(bc *Blockchain, timestamps ...int64) []*Block {
+	chain := []*Block{bc.LastBlock()}
+	for _, ts := range timestamps {
+		chain = append(chain, NewBlock(ts, 0, chain[len(chain)-1].Hash(), []*Transaction{newCoinbase("miner", 1)}))
+	}
+	return chain
+}
+
+func TestMedianTimePast(t *testing.T) {
+	bc := NewBlockchain("miner", 0)
+	g := bc.LastBlock().timestamp
+	tests := []struct {
+		name       string
+		timestamps []int64
+		want       int64
+	}{
+		{"genesis only", nil, g},
+		{"two blocks", []int64{g + 10}, g + 10},
+		{"out of order", []int64{g + 30, g + 10, g + 20}, g + 20},
+		{"last blocks only", []int64{g + 1, g + 2, g + 3, g + 4, g + 5, g + 6, g + 7, g + 8, g + 9, g + 10, g + 11, g + 12, g + 13}, g + 8},
+		{"one miner far ahead", []int64{g + 1, g + 2, g + 3, g + 4, g + 1000}, g + 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := medianTimePast(chainAt(bc, tt.timestamps...)); got != tt.want {
+				t.Fatalf("median time past %d, want %d", got-g, tt.want-g)
+			}
+		})
+	}
+}
+
+func TestValidTimestamp(t *testing.T) {
+	bc := NewBlockchain("miner", 0)
+	now := time.Unix(0, GENESIS_TIMESTAMP).Add(24 * time.Hour)
+	bc.SetClock(func() time.Time { return now })
+	chain := chainAt(bc, now.Add(-3*time.Minute).UnixNano(), now.Add(-2*time.Minute).UnixNano(), now.Add(-time.Minute).UnixNano())
+	mtp := medianTimePast(chain)
+	drift := time.Duration(bc.spec.MaxFutureDriftSec) * time.Second
+
+	tests := []struct {
+		name      string
+		timestamp int64
+		valid     bool
+	}{
+		{"now", now.UnixNano(), true},
+		{"at the median time past", mtp, false},
+		{"just after the median time past", mtp + 1, true},
+		{"before the median time past", mtp - 1, false},
+		{"at the future drift", now.Add(drift).UnixNano(), true},
+		{"beyond the future drift", now.Add(drift).UnixNano() + 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBlock(tt.timestamp, 0, chain[len(chain)-1].Hash(), []*Transaction{newCoinbase("miner", 1)})
+			if got := bc.validTimestamp(chain, b); got != tt.valid {
+				t.Fatalf("valid %v, want %v", got, tt.valid)
+			}
+		})
+	}
+}
+
+// A node whose clock lags behind the chain still mines after the median
+// time past.
+func TestNextTimestamp(t *testing.T) {
+	bc := NewBlockchain("miner", 0)
+	now := time.Unix(0, GENESIS_TIMESTAMP).Add(time.Hour)
+	bc.SetClock(func() time.Time { return now })
+	if got := bc.nextTimestamp(); got != now.UnixNano() {
+		t.Fatalf("next timestamp %d, want the clock's %d", got, now.UnixNano())
+	}
+	bc.chain = chainAt(bc, now.Add(time.Minute).UnixNano(), now.Add(2*time.Minute).UnixNano())
+	if got, want := bc.nextTimestamp(), now.Add(time.Minute).UnixNano()+1; got != want {
+		t.Fatalf("next timestamp %d, want %d after the median time past", got, want)
+	}
+}
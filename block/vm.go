@@ -0,0 +1,407 @@
+package block
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	VM_MAX_STACK_SIZE   = 1024
+	VM_MAX_CODE_SIZE    = 24576
+	VM_VALUE_UNITS      = 1000000 // CALLVALUE reports the value in millionths
+	CONTRACT_BASE_GAS   = 100     // Charged for every contract transaction
+	GAS_PER_CODE_BYTE   = 10      // Charged per byte of deployed code
+	BLOCK_GAS_LIMIT     = 1000000 // Sum of gas limits a block may carry
+	VM_DEFAULT_CALL_GAS = 100000  // Gas given to read-only calls
+)
+
+// VM opcodes. Words on the stack are int64, PUSH is followed by eight
+// big endian bytes. As in the EVM the top of the stack is the first
+// operand: PUSH 3 PUSH 5 SUB leaves 2, PUSH value PUSH key SSTORE stores.
+const (
+	VM_STOP         byte = 0x00
+	VM_ADD          byte = 0x01
+	VM_SUB          byte = 0x02
+	VM_MUL          byte = 0x03
+	VM_DIV          byte = 0x04
+	VM_MOD          byte = 0x05
+	VM_LT           byte = 0x10
+	VM_GT           byte = 0x11
+	VM_EQ           byte = 0x12
+	VM_ISZERO       byte = 0x13
+	VM_CALLER       byte = 0x33
+	VM_CALLVALUE    byte = 0x34
+	VM_CALLDATA     byte = 0x35
+	VM_CALLDATASIZE byte = 0x36
+	VM_BLOCKHEIGHT  byte = 0x43
+	VM_POP          byte = 0x50
+	VM_SLOAD        byte = 0x54
+	VM_SSTORE       byte = 0x55
+	VM_JUMP         byte = 0x56
+	VM_JUMPI        byte = 0x57
+	VM_JUMPDEST     byte = 0x5b
+	VM_PUSH         byte = 0x60
+	VM_DUP          byte = 0x80
+	VM_SWAP         byte = 0x90
+	VM_LOG          byte = 0xa0 // n topics... data: emits a Log with n (at most 4) topics
+	VM_RETURN       byte = 0xf3
+	VM_REVERT       byte = 0xfd
+)
+
+// ErrOutOfGas is the error of executions that ran out of gas. The whole
+// gas limit of their transaction is charged.
+var ErrOutOfGas = errors.New("out of gas")
+
+type vmOp struct {
+	name string
+	gas  uint64
+}
+
+var vmOps = map[byte]vmOp{
+	VM_STOP:         {"STOP", 0},
+	VM_ADD:          {"ADD", 3},
+	VM_SUB:          {"SUB", 3},
+	VM_MUL:          {"MUL", 5},
+	VM_DIV:          {"DIV", 5},
+	VM_MOD:          {"MOD", 5},
+	VM_LT:           {"LT", 3},
+	VM_GT:           {"GT", 3},
+	VM_EQ:           {"EQ", 3},
+	VM_ISZERO:       {"ISZERO", 3},
+	VM_CALLER:       {"CALLER", 2},
+	VM_CALLVALUE:    {"CALLVALUE", 2},
+	VM_CALLDATA:     {"CALLDATA", 3},
+	VM_CALLDATASIZE: {"CALLDATASIZE", 2},
+	VM_BLOCKHEIGHT:  {"BLOCKHEIGHT", 2},
+	VM_POP:          {"POP", 2},
+	VM_SLOAD:        {"SLOAD", 50},
+	VM_SSTORE:       {"SSTORE", 200},
+	VM_JUMP:         {"JUMP", 8},
+	VM_JUMPI:        {"JUMPI", 10},
+	VM_JUMPDEST:     {"JUMPDEST", 1},
+	VM_PUSH:         {"PUSH", 3},
+	VM_DUP:          {"DUP", 3},
+	VM_SWAP:         {"SWAP", 3},
+	VM_LOG:          {"LOG", LOG_GAS},
+	VM_RETURN:       {"RETURN", 0},
+	VM_REVERT:       {"REVERT", 0},
+}
+
+// VMContext is everything a contract can observe besides its storage.
+type VMContext struct {
+	Address     string // Of the contract being run
+	Caller      string
+	Value       float32
+	Input       []int64
+	BlockHeight int
+	GasLimit    uint64
+}
+
+// VMResult is the outcome of ExecuteContract. Storage changes are only
+// valid when Err is nil.
+type VMResult struct {
+	ReturnValue int64
+	GasUsed     uint64
+	Logs        []*Log
+	Err         error
+}
+
+// AddressWord maps an address to the word CALLER pushes for it, so
+// contracts can compare callers against stored addresses.
+func AddressWord(address string) int64 {
+	h := sha256.Sum256([]byte(address))
+	return int64(binary.BigEndian.Uint64(h[:8]))
+}
+
+type vmStack []int64
+
+func (s *vmStack) push(v int64) error {
+	if len(*s) >= VM_MAX_STACK_SIZE {
+		return fmt.Errorf("stack overflow")
+	}
+	*s = append(*s, v)
+	return nil
+}
+
+func (s *vmStack) pop() (int64, error) {
+	if len(*s) == 0 {
+		return 0, fmt.Errorf("stack underflow")
+	}
+	v := (*s)[len(*s)-1]
+	*s = (*s)[:len(*s)-1]
+	return v, nil
+}
+
+func (s *vmStack) pop2() (int64, int64, error) {
+	a, err := s.pop()
+	if err != nil {
+		return 0, 0, err
+	}
+	b, err := s.pop()
+	return a, b, err
+}
+
+func vmBool(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// ExecuteContract runs code against storage, which it modifies in place;
+// pass a copy and keep it only when the result has no error. Execution
+// is deterministic and bounded by ctx.GasLimit.
+func ExecuteContract(code []byte, storage map[int64]int64, ctx *VMContext) *VMResult {
+	result := &VMResult{}
+	stack := vmStack{}
+	jumpDests := findJumpDests(code)
+	fail := func(err error) *VMResult {
+		result.Err = err
+		return result
+	}
+
+	for pc := 0; pc < len(code); {
+		op := code[pc]
+		info, ok := vmOps[op]
+		if !ok {
+			return fail(fmt.Errorf("invalid opcode 0x%02x at %d", op, pc))
+		}
+		result.GasUsed += info.gas
+		if result.GasUsed > ctx.GasLimit {
+			result.GasUsed = ctx.GasLimit
+			return fail(ErrOutOfGas)
+		}
+		pc++
+
+		var err error
+		switch op {
+		case VM_STOP:
+			return result
+		case VM_ADD, VM_SUB, VM_MUL, VM_DIV, VM_MOD, VM_LT, VM_GT, VM_EQ:
+			a, b, e := stack.pop2()
+			if e != nil {
+				return fail(e)
+			}
+			var v int64
+			switch op {
+			case VM_ADD:
+				v = a + b
+			case VM_SUB:
+				v = a - b
+			case VM_MUL:
+				v = a * b
+			case VM_DIV, VM_MOD:
+				if b == 0 {
+					return fail(fmt.Errorf("division by zero"))
+				}
+				if op == VM_DIV {
+					v = a / b
+				} else {
+					v = a % b
+				}
+			case VM_LT:
+				v = vmBool(a < b)
+			case VM_GT:
+				v = vmBool(a > b)
+			case VM_EQ:
+				v = vmBool(a == b)
+			}
+			err = stack.push(v)
+		case VM_ISZERO:
+			a, e := stack.pop()
+			if e != nil {
+				return fail(e)
+			}
+			err = stack.push(vmBool(a == 0))
+		case VM_CALLER:
+			err = stack.push(AddressWord(ctx.Caller))
+		case VM_CALLVALUE:
+			err = stack.push(int64(float64(ctx.Value) * VM_VALUE_UNITS))
+		case VM_CALLDATA:
+			i, e := stack.pop()
+			if e != nil {
+				return fail(e)
+			}
+			var v int64
+			if i >= 0 && i < int64(len(ctx.Input)) {
+				v = ctx.Input[i]
+			}
+			err = stack.push(v)
+		case VM_CALLDATASIZE:
+			err = stack.push(int64(len(ctx.Input)))
+		case VM_BLOCKHEIGHT:
+			err = stack.push(int64(ctx.BlockHeight))
+		case VM_POP:
+			_, err = stack.pop()
+		case VM_SLOAD:
+			k, e := stack.pop()
+			if e != nil {
+				return fail(e)
+			}
+			err = stack.push(storage[k])
+		case VM_SSTORE:
+			k, v, e := stack.pop2()
+			if e != nil {
+				return fail(e)
+			}
+			if v == 0 {
+				delete(storage, k)
+			} else {
+				storage[k] = v
+			}
+		case VM_JUMP, VM_JUMPI:
+			target, e := stack.pop()
+			if e != nil {
+				return fail(e)
+			}
+			if op == VM_JUMPI {
+				cond, e := stack.pop()
+				if e != nil {
+					return fail(e)
+				}
+				if cond == 0 {
+					break
+				}
+			}
+			if target < 0 || target >= int64(len(code)) || !jumpDests[target] {
+				return fail(fmt.Errorf("invalid jump destination %d", target))
+			}
+			pc = int(target)
+		case VM_JUMPDEST:
+		case VM_PUSH:
+			if pc+8 > len(code) {
+				return fail(fmt.Errorf("truncated PUSH at %d", pc-1))
+			}
+			err = stack.push(int64(binary.BigEndian.Uint64(code[pc : pc+8])))
+			pc += 8
+		case VM_DUP:
+			a, e := stack.pop()
+			if e != nil {
+				return fail(e)
+			}
+			stack.push(a)
+			err = stack.push(a)
+		case VM_SWAP:
+			a, b, e := stack.pop2()
+			if e != nil {
+				return fail(e)
+			}
+			stack.push(a)
+			err = stack.push(b)
+		case VM_LOG:
+			n, e := stack.pop()
+			if e != nil {
+				return fail(e)
+			}
+			if n < 0 || n > VM_MAX_LOG_TOPICS {
+				return fail(fmt.Errorf("invalid LOG topic count %d", n))
+			}
+			result.GasUsed += uint64(n) * LOG_GAS_PER_TOPIC
+			if result.GasUsed > ctx.GasLimit {
+				result.GasUsed = ctx.GasLimit
+				return fail(ErrOutOfGas)
+			}
+			topics := make([]int64, n)
+			for i := range topics {
+				if topics[i], e = stack.pop(); e != nil {
+					return fail(e)
+				}
+			}
+			data, e := stack.pop()
+			if e != nil {
+				return fail(e)
+			}
+			result.Logs = append(result.Logs, &Log{address: ctx.Address, topics: topics, data: data})
+		case VM_RETURN:
+			v, e := stack.pop()
+			if e != nil {
+				return fail(e)
+			}
+			result.ReturnValue = v
+			return result
+		case VM_REVERT:
+			return fail(fmt.Errorf("reverted"))
+		}
+		if err != nil {
+			return fail(err)
+		}
+	}
+	return result
+}
+
+// findJumpDests marks the JUMPDEST opcodes of code, leaving out bytes of
+// PUSH data that happen to equal VM_JUMPDEST. It is computed once per
+// execution so that jumps cost the same whatever the size of the code.
+func findJumpDests(code []byte) []bool {
+	dests := make([]bool, len(code))
+	for pc := 0; pc < len(code); pc++ {
+		switch code[pc] {
+		case VM_JUMPDEST:
+			dests[pc] = true
+		case VM_PUSH:
+			pc += 8
+		}
+	}
+	return dests
+}
+
+// AssembleContract turns "PUSH 1 PUSH 2 ADD RETURN" into bytecode. PUSH
+// takes a decimal argument.
+func AssembleContract(asm string) ([]byte, error) {
+	code := []byte{}
+	tokens := strings.Fields(asm)
+	for i := 0; i < len(tokens); i++ {
+		op, ok := vmOpcodeByName(strings.ToUpper(tokens[i]))
+		if !ok {
+			return nil, fmt.Errorf("unknown instruction %q", tokens[i])
+		}
+		code = append(code, op)
+		if op != VM_PUSH {
+			continue
+		}
+		i++
+		if i == len(tokens) {
+			return nil, fmt.Errorf("PUSH without argument")
+		}
+		v, err := strconv.ParseInt(tokens[i], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid PUSH argument %q", tokens[i])
+		}
+		code = binary.BigEndian.AppendUint64(code, uint64(v))
+	}
+	if len(code) > VM_MAX_CODE_SIZE {
+		return nil, fmt.Errorf("code too large")
+	}
+	return code, nil
+}
+
+func vmOpcodeByName(name string) (byte, bool) {
+	for op, info := range vmOps {
+		if info.name == name {
+			return op, true
+		}
+	}
+	return 0, false
+}
+
+// DisassembleContract is the inverse of AssembleContract.
+func DisassembleContract(code []byte) string {
+	tokens := []string{}
+	for pc := 0; pc < len(code); pc++ {
+		info, ok := vmOps[code[pc]]
+		if !ok {
+			tokens = append(tokens, fmt.Sprintf("[0x%02x]", code[pc]))
+			continue
+		}
+		tokens = append(tokens, info.name)
+		if code[pc] == VM_PUSH && pc+9 <= len(code) {
+			tokens = append(tokens, strconv.FormatInt(int64(binary.BigEndian.Uint64(code[pc+1:pc+9])), 10))
+			pc += 8
+		}
+	}
+	return strings.Join(tokens, " ")
+}
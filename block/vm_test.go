@@ -0,0 +1,63 @@
+package block
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func runContract(t *testing.T, asm string, gasLimit uint64) *VMResult {
+	t.Helper()
+	code, err := AssembleContract(asm)
+	if err != nil {
+		t.Fatalf("assemble %q: %v", asm, err)
+	}
+	return ExecuteContract(code, map[int64]int64{}, &VMContext{GasLimit: gasLimit})
+}
+
+func TestJumpDestinations(t *testing.T) {
+	tests := []struct {
+		name string
+		asm  string
+		want int64
+		err  string
+	}{
+		{"jumpdest", "PUSH 10 JUMP JUMPDEST PUSH 7 RETURN", 7, ""},
+		{"push data", "PUSH 91 PUSH 8 JUMP", 0, "invalid jump destination 8"},
+		{"not a jumpdest", "PUSH 9 JUMP STOP", 0, "invalid jump destination 9"},
+		{"past the end", "PUSH 100 JUMP", 0, "invalid jump destination 100"},
+		{"jumpi not taken", "PUSH 0 PUSH 100 JUMPI PUSH 3 RETURN", 3, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := runContract(t, tt.asm, VM_DEFAULT_CALL_GAS)
+			if tt.err == "" && (r.Err != nil || r.ReturnValue != tt.want) {
+				t.Fatalf("got %v, %v; want %v", r.ReturnValue, r.Err, tt.want)
+			}
+			if tt.err != "" && (r.Err == nil || r.Err.Error() != tt.err) {
+				t.Fatalf("got error %v, want %q", r.Err, tt.err)
+			}
+		})
+	}
+}
+
+// A loop at the end of code full of JUMPDESTs runs until it is out of
+// gas. Its jumps must not rescan the code, which made this transaction
+// take seconds.
+func TestJumpLoopInLargeCode(t *testing.T) {
+	prefix := strings.Repeat("JUMPDEST ", VM_MAX_CODE_SIZE-100)
+	loop := len(prefix) / len("JUMPDEST ")
+	asm := prefix + "JUMPDEST PUSH " + strconv.Itoa(loop) + " JUMP"
+	r := runContract(t, asm, BLOCK_GAS_LIMIT)
+	if r.Err == nil || r.GasUsed != BLOCK_GAS_LIMIT {
+		t.Fatalf("got %v after %d gas, want to run out of gas", r.Err, r.GasUsed)
+	}
+}
+
+func TestOutOfGas(t *testing.T) {
+	r := runContract(t, "JUMPDEST PUSH 0 JUMP", 100)
+	if !errors.Is(r.Err, ErrOutOfGas) || r.GasUsed != 100 {
+		t.Fatalf("got %v after %d gas, want %v after 100", r.Err, r.GasUsed, ErrOutOfGas)
+	}
+}
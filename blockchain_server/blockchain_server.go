@@ -14,11 +14,12 @@ import (
 var cache map[string]*block.Blockchain = make(map[string]*block.Blockchain)
 
 type Blockchainserver struct {
-	port uint16
+	port   uint16
+	config *NodeConfig
 }
 
-func NewBlockchainserver(port uint16) *Blockchainserver {
-	return &Blockchainserver{port}
+func NewBlockchainserver(port uint16, config *NodeConfig) *Blockchainserver {
+	return &Blockchainserver{port, config}
 }
 
 func (bcs *Blockchainserver) Port() uint16 {
@@ -29,11 +30,40 @@ func (bcs *Blockchainserver) GetBlockchain() *block.Blockchain {
 	bc, ok := cache["blockchain"]
 	if !ok {
 		minerWallet := wallet.NewWallet()
-		bc = block.NewBlockchain(minerWallet.BlockchainAddress(), bcs.Port())
+		spec := block.DefaultChainSpec()
+		if bcs.config.ChainSpec != "" {
+			var err error
+			if spec, err = block.LoadChainSpec(bcs.config.ChainSpec); err != nil {
+				log.Fatal(err)
+			}
+		}
+		bc = block.NewBlockchainWithSpec(minerWallet.BlockchainAddress(), bcs.Port(), spec)
+		bc.SetPeerConfig(bcs.config.Host, bcs.config.Seeds, bcs.config.AddressBook)
+		identityKey, err := block.LoadIdentityKey(bcs.config.IdentityKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		bc.SetIdentityKey(identityKey)
+		if err := bc.SetTrustedNodes(bcs.config.TrustedNodes); err != nil {
+			log.Fatal(err)
+		}
+		if err := bc.SetAdminKeys(bcs.config.AdminKeys); err != nil {
+			log.Fatal(err)
+		}
+		if bcs.config.TLS.Enabled() {
+			tlsConfig, err := bcs.config.TLS.ClientConfig()
+			if err != nil {
+				log.Fatal(err)
+			}
+			bc.SetTLS(tlsConfig)
+		}
 		cache["blockchain"] = bc
 		log.Printf("private key %v", minerWallet.PrivateKeyStr())
 		log.Printf("public key %v", minerWallet.PublicKeyStr())
 		log.Printf("blockchain address %v", minerWallet.BlockchainAddress())
+		log.Printf("node id %v", bc.NodeID())
+		log.Printf("identity key %v", bc.PublicKey())
+		log.Printf("network %v, genesis %x", spec.NetworkID, spec.GenesisHash())
 	}
 	return bc
 }
@@ -79,10 +109,33 @@ func (bcs *Blockchainserver) Transactions(w http.ResponseWriter, r *http.Request
 			io.WriteString(w, string(utils.JsonStatus("fail")))
 			return
 		}
-		publicKey := utils.PublicKeyFromString(*t.SenderPublicKey)
-		signature := utils.SignatureFromString(*t.Signature)
 		bc := bcs.GetBlockchain()
-		isCreated := bc.CreateTransaction(*t.SenderBlockchainAddress, *t.RecipientBlockchainAddress, *t.Value, publicKey, signature)
+		var isCreated bool
+		if t.IsScriptSpend() {
+			script, witness, err := t.ScriptAndWitness()
+			if err != nil {
+				log.Printf("ERROR: %v", err)
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, string(utils.JsonStatus("fail")))
+				return
+			}
+			isCreated = bc.CreateScriptTransaction(*t.RecipientBlockchainAddress, *t.Value, t.LockTimeValue(), script, witness)
+		} else if t.IsContractTransaction() {
+			data, err := t.ContractData()
+			if err != nil {
+				log.Printf("ERROR: %v", err)
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, string(utils.JsonStatus("fail")))
+				return
+			}
+			publicKey := utils.PublicKeyFromString(*t.SenderPublicKey)
+			signature := utils.SignatureFromString(*t.Signature)
+			isCreated = bc.CreateContractTransaction(*t.SenderBlockchainAddress, *t.RecipientBlockchainAddress, *t.Value, data, *t.GasLimit, t.GasPriceValue(), publicKey, signature)
+		} else {
+			publicKey := utils.PublicKeyFromString(*t.SenderPublicKey)
+			signature := utils.SignatureFromString(*t.Signature)
+			isCreated = bc.CreateTransaction(*t.SenderBlockchainAddress, *t.RecipientBlockchainAddress, *t.Value, t.LockTimeValue(), publicKey, signature)
+		}
 		w.Header().Add("Content-Type", "application/json")
 		var m []byte
 		if !isCreated {
@@ -107,13 +160,14 @@ func (bcs *Blockchainserver) Transactions(w http.ResponseWriter, r *http.Request
 			io.WriteString(w, string(utils.JsonStatus("fail")))
 			return
 		}
-		publicKey := utils.PublicKeyFromString(*t.SenderPublicKey)
-		signature := utils.SignatureFromString(*t.Signature)
 		bc := bcs.GetBlockchain()
-		isUpdated := bc.AddTransaction(*t.SenderBlockchainAddress, *t.RecipientBlockchainAddress, *t.Value, publicKey, signature)
+		isUpdated := bc.AddTransactionRequest(&t)
 		w.Header().Add("Content-Type", "application/json")
 		var m []byte
 		if !isUpdated {
+			if !bc.VerifyTransactionRequest(&t) {
+				bc.PeerManager().Misbehaving(r.RemoteAddr, block.PENALTY_INVALID_TRANSACTION, "invalid transaction")
+			}
 			w.WriteHeader(http.StatusBadRequest)
 			m = utils.JsonStatus("fail")
 		} else {
@@ -121,6 +175,11 @@ func (bcs *Blockchainserver) Transactions(w http.ResponseWriter, r *http.Request
 		}
 		io.WriteString(w, string(m))
 	case http.MethodDelete:
+		// Blocks remove the transactions they include from the pool;
+		// emptying it wholesale is left to the operator.
+		if !bcs.authenticateAdmin(w, r) {
+			return
+		}
 		bc := bcs.GetBlockchain()
 		bc.ClearTransactionPool()
 		io.WriteString(w, string(utils.JsonStatus("success")))
@@ -170,9 +229,9 @@ func (bcs *Blockchainserver) Amount(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
 		blockchainAddress := r.URL.Query().Get("blockchain_address")
-		amount := bcs.GetBlockchain().CalculateTotalAmount(blockchainAddress)
+		amount, immature := bcs.GetBlockchain().CalculateAmounts(blockchainAddress)
 
-		ar := &block.AmountResponse{amount}
+		ar := &block.AmountResponse{amount, immature}
 		m, _ := ar.MarshalJSON()
 
 		w.Header().Add("Content-Type", "application/json")
@@ -183,10 +242,26 @@ func (bcs *Blockchainserver) Amount(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Supply reports the circulating and maximum supply of coins.
+func (bcs *Blockchainserver) Supply(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		m, _ := json.Marshal(bcs.GetBlockchain().Supply())
+		w.Header().Add("Content-Type", "application/json")
+		io.WriteString(w, string(m[:]))
+	default:
+		log.Printf("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
 func (bcs *Blockchainserver) Consensus(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodPut:
 		bc := bcs.GetBlockchain()
+		if !bcs.authenticate(w, r) {
+			return
+		}
 		isReplaced := bc.ResolveConflicts()
 		w.Header().Add("Content-Type", "application/json")
 		if isReplaced {
@@ -200,13 +275,72 @@ func (bcs *Blockchainserver) Consensus(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// authenticate checks that r was signed by a known node, and answers
+// 401 when it was not.
+func (bcs *Blockchainserver) authenticate(w http.ResponseWriter, r *http.Request) bool {
+	nodeID, err := bcs.GetBlockchain().VerifyRequest(r)
+	if err != nil {
+		log.Printf("ERROR: %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, string(utils.JsonStatus("fail")))
+		return false
+	}
+	log.Printf("action=%s, path=%s, node=%s", r.Method, r.URL.Path, nodeID)
+	return true
+}
+
+// authenticateAdmin checks that r was signed with an admin key, and
+// answers 401 or 403 when it was not.
+func (bcs *Blockchainserver) authenticateAdmin(w http.ResponseWriter, r *http.Request) bool {
+	bc := bcs.GetBlockchain()
+	nodeID, err := bc.VerifyRequest(r)
+	if err != nil {
+		log.Printf("ERROR: %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, string(utils.JsonStatus("fail")))
+		return false
+	}
+	if !bc.IsAdmin(nodeID) {
+		log.Printf("ERROR: %s %s from %s: node %s is not an admin", r.Method, r.URL.Path, r.RemoteAddr, nodeID)
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, string(utils.JsonStatus("fail")))
+		return false
+	}
+	log.Printf("action=%s, path=%s, admin=%s", r.Method, r.URL.Path, nodeID)
+	return true
+}
+
 func (bcs *Blockchainserver) Run() {
 	bcs.GetBlockchain().Run()
-	http.HandleFunc("/", bcs.GetChain)
-	http.HandleFunc("/transactions", bcs.Transactions)
-	http.HandleFunc("/mine", bcs.Mine)
-	http.HandleFunc("/mine/start", bcs.StartMine)
-	http.HandleFunc("/amount", bcs.Amount)
-	http.HandleFunc("/consensus", bcs.Consensus)
-	log.Fatal(http.ListenAndServe("0.0.0.0:"+strconv.Itoa(int(bcs.Port())), nil))
+	http.HandleFunc("/", bcs.guard(bcs.GetChain))
+	http.HandleFunc("/transactions", bcs.guard(bcs.Transactions))
+	http.HandleFunc("/mine", bcs.guard(bcs.Mine))
+	http.HandleFunc("/mine/start", bcs.guard(bcs.StartMine))
+	http.HandleFunc("/amount", bcs.guard(bcs.Amount))
+	http.HandleFunc("/supply", bcs.guard(bcs.Supply))
+	http.HandleFunc("/consensus", bcs.guard(bcs.Consensus))
+	http.HandleFunc("/blocks", bcs.guard(bcs.Blocks))
+	http.HandleFunc("/headers", bcs.guard(bcs.Headers))
+	http.HandleFunc("/sync", bcs.guard(bcs.Sync))
+	http.HandleFunc("/peers", bcs.guard(bcs.Peers))
+	http.HandleFunc("/handshake", bcs.guard(bcs.Handshake))
+	http.HandleFunc("/p2p", bcs.guard(bcs.P2P))
+	http.HandleFunc("/peers/bans", bcs.guard(bcs.Bans))
+	http.HandleFunc("/peers/ban", bcs.guard(bcs.Ban))
+	http.HandleFunc("/peers/unban", bcs.guard(bcs.Unban))
+	http.HandleFunc("/contracts", bcs.guard(bcs.Contracts))
+	http.HandleFunc("/contracts/call", bcs.guard(bcs.CallContract))
+	http.HandleFunc("/contracts/storage", bcs.guard(bcs.ContractStorage))
+	http.HandleFunc("/receipts", bcs.guard(bcs.Receipts))
+	http.HandleFunc("/logs", bcs.guard(bcs.Logs))
+	addr := "0.0.0.0:" + strconv.Itoa(int(bcs.Port()))
+	if !bcs.config.TLS.Enabled() {
+		log.Fatal(http.ListenAndServe(addr, nil))
+	}
+	tlsConfig, err := bcs.config.TLS.ServerConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := &http.Server{Addr: addr, TLSConfig: tlsConfig}
+	log.Fatal(server.ListenAndServeTLS("", ""))
 }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"goblockchain/block"
+	"goblockchain/utils"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Blocks returns the block with ?hash= (GET) or receives a block pushed
+// by a neighbor (POST).
+func (bcs *Blockchainserver) Blocks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Add("Content-Type", "application/json")
+		h, err := hex.DecodeString(r.URL.Query().Get("hash"))
+		if err != nil || len(h) != 32 {
+			log.Println("ERROR: Invalid block hash")
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		var hash [32]byte
+		copy(hash[:], h)
+		b := bcs.GetBlockchain().BlockByHash(hash)
+		if b == nil {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		m, _ := b.MarshalJSON()
+		io.WriteString(w, string(m[:]))
+	case http.MethodPost:
+		decoder := json.NewDecoder(r.Body)
+		var br block.BlockRequest
+		err := decoder.Decode(&br)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		if !br.Validate() {
+			log.Println("ERROR: missing field(s)")
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		// Blocks are only taken from the host that sends them, so that a
+		// peer cannot get another one penalized for its blocks.
+		if !block.IsPeerHost(*br.Sender, r.RemoteAddr) {
+			log.Println("ERROR: Block sender does not match the connection")
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		accepted := bcs.GetBlockchain().ReceiveBlock(br.Block, *br.Sender)
+		w.Header().Add("Content-Type", "application/json")
+		var m []byte
+		if !accepted {
+			w.WriteHeader(http.StatusBadRequest)
+			m = utils.JsonStatus("fail")
+		} else {
+			w.WriteHeader(http.StatusCreated)
+			m = utils.JsonStatus("success")
+		}
+		io.WriteString(w, string(m))
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// Headers returns the headers following the first hash of the
+// comma-separated ?locator= that is part of our chain.
+func (bcs *Blockchainserver) Headers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Add("Content-Type", "application/json")
+		locator := [][32]byte{}
+		if l := r.URL.Query().Get("locator"); l != "" {
+			for _, s := range strings.Split(l, ",") {
+				h, err := hex.DecodeString(s)
+				if err != nil || len(h) != 32 {
+					log.Println("ERROR: Invalid block locator")
+					w.WriteHeader(http.StatusBadRequest)
+					io.WriteString(w, string(utils.JsonStatus("fail")))
+					return
+				}
+				var hash [32]byte
+				copy(hash[:], h)
+				locator = append(locator, hash)
+			}
+		}
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		bc := bcs.GetBlockchain()
+		m, _ := json.Marshal(&block.HeadersResponse{
+			Headers: bc.HeadersAfter(locator, limit),
+			Height:  bc.Height(),
+		})
+		io.WriteString(w, string(m[:]))
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// Sync reports the progress of the chain sync.
+func (bcs *Blockchainserver) Sync(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Add("Content-Type", "application/json")
+		m, _ := json.Marshal(bcs.GetBlockchain().SyncStatus())
+		io.WriteString(w, string(m[:]))
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"goblockchain/utils"
+	"os"
+	"strings"
+)
+
+// NodeConfig is read from the file given with -config. Flags override it.
+//
+//	{
+//	  "host": "192.168.0.10",
+//	  "seeds": ["192.168.0.11:5000", "seed.example.org:5000"],
+//	  "address_book": "peers_5000.json",
+//	  "identity_key": "node_5000.key",
+//	  "chain_spec": "chain_spec.json",
+//	  "trusted_nodes": ["3f1c...e9a0"],
+//	  "admin_keys": ["9b2d...41c7"],
+//	  "tls": {"cert": "certs/node.pem", "key": "certs/node-key.pem", "ca": "certs/ca.pem"}
+//	}
+type NodeConfig struct {
+	Host         string         `json:"host"`
+	Seeds        []string       `json:"seeds"`
+	AddressBook  string         `json:"address_book"`
+	IdentityKey  string         `json:"identity_key"`
+	ChainSpec    string         `json:"chain_spec"`    // Network parameters, the main network when empty
+	TrustedNodes []string       `json:"trusted_nodes"` // Identity keys of the nodes allowed to send signed requests
+	AdminKeys    []string       `json:"admin_keys"`    // Identity keys allowed to call admin endpoints, besides this node's
+	TLS          utils.TLSFiles `json:"tls"`
+}
+
+func LoadNodeConfig(path string) (*NodeConfig, error) {
+	c := &NodeConfig{}
+	if path == "" {
+		return c, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return c, nil
+}
+
+// SplitSeeds parses a comma-separated list of host:port seeds.
+func SplitSeeds(s string) []string {
+	return splitList(s)
+}
+
+// splitList parses a comma-separated list, skipping empty entries.
+func splitList(s string) []string {
+	items := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"goblockchain/block"
+	"goblockchain/utils"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Contracts lists deployed contracts (GET), shows one with ?contract_address=
+// (GET) or deploys a signed contract transaction (POST).
+func (bcs *Blockchainserver) Contracts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Add("Content-Type", "application/json")
+		bc := bcs.GetBlockchain()
+		address := r.URL.Query().Get("contract_address")
+		if address == "" {
+			addresses := bc.Contracts()
+			m, _ := json.Marshal(struct {
+				Contracts []string `json:"contracts"`
+				Length    int      `json:"length"`
+			}{
+				Contracts: addresses,
+				Length:    len(addresses),
+			})
+			io.WriteString(w, string(m[:]))
+			return
+		}
+		c := bc.Contract(address)
+		if c == nil {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		m, _ := c.MarshalJSON()
+		io.WriteString(w, string(m[:]))
+	case http.MethodPost:
+		decoder := json.NewDecoder(r.Body)
+		var t block.TransactionRequest
+		err := decoder.Decode(&t)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		if !t.Validate() || !t.IsContractTransaction() || *t.RecipientBlockchainAddress != "" {
+			log.Println("ERROR: missing field(s)")
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		data, err := t.ContractData()
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		publicKey := utils.PublicKeyFromString(*t.SenderPublicKey)
+		signature := utils.SignatureFromString(*t.Signature)
+		bc := bcs.GetBlockchain()
+		isCreated := bc.CreateContractTransaction(*t.SenderBlockchainAddress, "", *t.Value, data, *t.GasLimit, t.GasPriceValue(), publicKey, signature)
+		w.Header().Add("Content-Type", "application/json")
+		if !isCreated {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		deploy := block.NewContractTransaction(*t.SenderBlockchainAddress, "", *t.Value, data, *t.GasLimit, t.GasPriceValue())
+		w.WriteHeader(http.StatusCreated)
+		m, _ := json.Marshal(struct {
+			Message         string `json:"message"`
+			ContractAddress string `json:"contract_address"`
+		}{
+			Message:         "success",
+			ContractAddress: deploy.ContractAddress(),
+		})
+		io.WriteString(w, string(m))
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// CallContract runs a contract read-only; nothing is written to the chain.
+func (bcs *Blockchainserver) CallContract(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		decoder := json.NewDecoder(r.Body)
+		var c block.ContractCallRequest
+		err := decoder.Decode(&c)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		if !c.Validate() {
+			log.Println("ERROR: missing field(s)")
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		var caller string
+		if c.Caller != nil {
+			caller = *c.Caller
+		}
+		var input []int64
+		if c.Input != nil {
+			input = *c.Input
+		}
+		gasLimit := uint64(block.VM_DEFAULT_CALL_GAS)
+		if c.GasLimit != nil && *c.GasLimit < gasLimit {
+			gasLimit = *c.GasLimit
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		result, ok := bcs.GetBlockchain().CallContract(*c.ContractAddress, caller, input, gasLimit)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		message, errStr := "success", ""
+		if result.Err != nil {
+			message, errStr = "fail", result.Err.Error()
+		}
+		m, _ := json.Marshal(struct {
+			Message     string `json:"message"`
+			ReturnValue int64  `json:"return_value"`
+			GasUsed     uint64 `json:"gas_used"`
+			Error       string `json:"error,omitempty"`
+		}{
+			Message:     message,
+			ReturnValue: result.ReturnValue,
+			GasUsed:     result.GasUsed,
+			Error:       errStr,
+		})
+		io.WriteString(w, string(m))
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// ContractStorage returns the value stored under ?key= of a contract.
+func (bcs *Blockchainserver) ContractStorage(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		key, err := strconv.ParseInt(q.Get("key"), 10, 64)
+		if err != nil {
+			log.Println("ERROR: parse error")
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		c := bcs.GetBlockchain().Contract(q.Get("contract_address"))
+		if c == nil {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		m, _ := json.Marshal(struct {
+			Key   int64 `json:"key"`
+			Value int64 `json:"value"`
+		}{
+			Key:   key,
+			Value: c.Storage()[key],
+		})
+		io.WriteString(w, string(m))
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// Receipts returns the receipts and log bloom filter of the block at ?height=.
+func (bcs *Blockchainserver) Receipts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		height, err := strconv.Atoi(r.URL.Query().Get("height"))
+		if err != nil {
+			log.Println("ERROR: parse error")
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		bc := bcs.GetBlockchain()
+		receipts := bc.Receipts(height)
+		if receipts == nil {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		m, _ := json.Marshal(struct {
+			Height   int              `json:"height"`
+			Receipts []*block.Receipt `json:"receipts"`
+			Bloom    *block.Bloom     `json:"bloom"`
+		}{
+			Height:   height,
+			Receipts: receipts,
+			Bloom:    bc.BlockBloom(height),
+		})
+		io.WriteString(w, string(m))
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// Logs returns contract logs filtered by ?contract_address=, any number
+// of ?topic= (all must match) and the ?from_block= to ?to_block= range.
+func (bcs *Blockchainserver) Logs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		bc := bcs.GetBlockchain()
+		fromBlock, toBlock := 0, bc.Height()
+		var err error
+		if s := q.Get("from_block"); s != "" {
+			if fromBlock, err = strconv.Atoi(s); err != nil {
+				log.Println("ERROR: parse error")
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, string(utils.JsonStatus("fail")))
+				return
+			}
+		}
+		if s := q.Get("to_block"); s != "" {
+			if toBlock, err = strconv.Atoi(s); err != nil {
+				log.Println("ERROR: parse error")
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, string(utils.JsonStatus("fail")))
+				return
+			}
+		}
+		// Bounds left out make the widest range allowed, ending at the
+		// tip by default.
+		if q.Get("from_block") == "" && toBlock > block.MAX_LOG_BLOCK_SPAN {
+			fromBlock = toBlock - block.MAX_LOG_BLOCK_SPAN
+		}
+		if q.Get("to_block") == "" && toBlock-fromBlock > block.MAX_LOG_BLOCK_SPAN {
+			toBlock = fromBlock + block.MAX_LOG_BLOCK_SPAN
+		}
+		if toBlock-fromBlock > block.MAX_LOG_BLOCK_SPAN {
+			log.Println("ERROR: block range too wide")
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		topics := []int64{}
+		for _, s := range q["topic"] {
+			t, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				log.Println("ERROR: parse error")
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, string(utils.JsonStatus("fail")))
+				return
+			}
+			topics = append(topics, t)
+		}
+
+		logs := bc.FilterLogs(q.Get("contract_address"), topics, fromBlock, toBlock)
+		w.Header().Add("Content-Type", "application/json")
+		m, _ := json.Marshal(struct {
+			Logs   []*block.Log `json:"logs"`
+			Length int          `json:"length"`
+		}{
+			Logs:   logs,
+			Length: len(logs),
+		})
+		io.WriteString(w, string(m))
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
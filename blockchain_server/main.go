@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 )
 
@@ -11,7 +12,64 @@ func init() {
 
 func main() {
 	port := flag.Uint("port", 5000, "TCP port  Number for Blockchain server.")
+	configPath := flag.String("config", "", "Node config file (JSON).")
+	host := flag.String("host", "", "Host advertised to peers. Defaults to the address of the hostname.")
+	seeds := flag.String("seeds", "", "Comma-separated host:port of peers to join through.")
+	addressBook := flag.String("address_book", "", "File the known peers are kept in. Defaults to peers_<port>.json.")
+	identityKey := flag.String("identity_key", "", "File the node identity key is kept in. Defaults to node_<port>.key.")
+	chainSpec := flag.String("chain_spec", "", "Chain spec file (JSON): genesis and parameters of the network.")
+	trustedNodes := flag.String("trusted_nodes", "", "Comma-separated identity keys of the nodes allowed to send signed requests.")
+	adminKeys := flag.String("admin_keys", "", "Comma-separated identity keys allowed to call admin endpoints.")
+	tlsCert := flag.String("tls_cert", "", "Certificate (PEM) enabling TLS between nodes.")
+	tlsKey := flag.String("tls_key", "", "Private key (PEM) of -tls_cert.")
+	tlsCA := flag.String("tls_ca", "", "CA (PEM) peer certificates must be signed by.")
+	tlsPins := flag.String("tls_pins", "", "Comma-separated SHA-256 pins of the peer keys to accept.")
 	flag.Parse()
-	app := NewBlockchainserver(uint16(*port))
+
+	config, err := LoadNodeConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *host != "" {
+		config.Host = *host
+	}
+	if *seeds != "" {
+		config.Seeds = SplitSeeds(*seeds)
+	}
+	if *addressBook != "" {
+		config.AddressBook = *addressBook
+	}
+	if *identityKey != "" {
+		config.IdentityKey = *identityKey
+	}
+	if *chainSpec != "" {
+		config.ChainSpec = *chainSpec
+	}
+	if *trustedNodes != "" {
+		config.TrustedNodes = splitList(*trustedNodes)
+	}
+	if *adminKeys != "" {
+		config.AdminKeys = splitList(*adminKeys)
+	}
+	if *tlsCert != "" {
+		config.TLS.CertFile = *tlsCert
+	}
+	if *tlsKey != "" {
+		config.TLS.KeyFile = *tlsKey
+	}
+	if *tlsCA != "" {
+		config.TLS.CAFile = *tlsCA
+	}
+	if *tlsPins != "" {
+		config.TLS.Pins = splitList(*tlsPins)
+	}
+	if config.AddressBook == "" {
+		config.AddressBook = fmt.Sprintf("peers_%d.json", *port)
+	}
+	if config.IdentityKey == "" {
+		config.IdentityKey = fmt.Sprintf("node_%d.key", *port)
+	}
+
+	app := NewBlockchainserver(uint16(*port), config)
 	app.Run()
 }
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"goblockchain/block"
+	"goblockchain/utils"
+	"io"
+	"log"
+	"net/http"
+)
+
+// Peers returns the peers this node knows to be reachable, what was
+// negotiated with its neighbors and the open connections (GET). A POST announces the caller,
+// which gets the list of peers back.
+func (bcs *Blockchainserver) Peers(w http.ResponseWriter, r *http.Request) {
+	bc := bcs.GetBlockchain()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		decoder := json.NewDecoder(r.Body)
+		var pr block.PeersRequest
+		err := decoder.Decode(&pr)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		if !pr.Validate() {
+			log.Println("ERROR: missing field(s)")
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		bc.AddPeer(*pr.Address)
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	pr := &block.PeersResponse{Peers: bc.KnownPeers()}
+	if r.Method == http.MethodGet {
+		pr.Neighbors = bc.NeighborInfo()
+		pr.Connections = bc.Connections()
+	}
+	m, _ := json.Marshal(pr)
+	io.WriteString(w, string(m[:]))
+}
+
+// Handshake exchanges node descriptions with a peer. Incompatible peers
+// are answered with 400.
+func (bcs *Blockchainserver) Handshake(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		bc := bcs.GetBlockchain()
+		decoder := json.NewDecoder(r.Body)
+		var h block.Handshake
+		err := decoder.Decode(&h)
+		if err != nil || !h.Validate() {
+			log.Println("ERROR: Invalid handshake")
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		if err := bc.AcceptHandshake(&h, r.RemoteAddr); err != nil {
+			log.Printf("ERROR: Rejected peer %s: %v", h.Address, err)
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		m, _ := json.Marshal(bc.Handshake())
+		io.WriteString(w, string(m[:]))
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// guard refuses requests from banned peers and from peers over their
+// rate limit.
+func (bcs *Blockchainserver) guard(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pm := bcs.GetBlockchain().PeerManager()
+		if pm.IsBanned(r.RemoteAddr) {
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		if !pm.Allow(r.RemoteAddr) {
+			w.WriteHeader(http.StatusTooManyRequests)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Bans lists the peers with a misbehavior score or a ban. Admin only.
+func (bcs *Blockchainserver) Bans(w http.ResponseWriter, r *http.Request) {
+	if !bcs.authenticateAdmin(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Add("Content-Type", "application/json")
+		m, _ := json.Marshal(struct {
+			Peers []*block.PeerStatus `json:"peers"`
+		}{
+			Peers: bcs.GetBlockchain().PeerManager().Peers(),
+		})
+		io.WriteString(w, string(m[:]))
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// Ban bans an IP, for duration_sec or the default ban length. Admin only.
+func (bcs *Blockchainserver) Ban(w http.ResponseWriter, r *http.Request) {
+	bcs.banOrUnban(w, r, true)
+}
+
+// Unban lifts the ban of an IP. Admin only.
+func (bcs *Blockchainserver) Unban(w http.ResponseWriter, r *http.Request) {
+	bcs.banOrUnban(w, r, false)
+}
+
+func (bcs *Blockchainserver) banOrUnban(w http.ResponseWriter, r *http.Request, ban bool) {
+	if !bcs.authenticateAdmin(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		decoder := json.NewDecoder(r.Body)
+		var br block.BanRequest
+		err := decoder.Decode(&br)
+		if err != nil || !br.Validate() {
+			log.Println("ERROR: missing field(s)")
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		pm := bcs.GetBlockchain().PeerManager()
+		w.Header().Add("Content-Type", "application/json")
+		if ban {
+			err = pm.Ban(*br.IP, br.Duration())
+		} else if !pm.Unban(*br.IP) {
+			err = fmt.Errorf("%s is not known", *br.IP)
+		}
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		io.WriteString(w, string(utils.JsonStatus("success")))
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// P2P upgrades the request to a persistent peer connection speaking the
+// framed message protocol.
+func (bcs *Blockchainserver) P2P(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet || r.Header.Get("Upgrade") != block.P2P_PROTOCOL {
+		log.Println("ERROR: Invalid upgrade request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return
+	}
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + block.P2P_PROTOCOL + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	go bcs.GetBlockchain().AcceptPeer(conn, rw.Reader, r.RemoteAddr)
+}
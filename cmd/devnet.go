@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"goblockchain/block"
+	"goblockchain/wallet"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	DEVNET_READY_TIMEOUT_SEC = 60
+	DEVNET_STOP_TIMEOUT_SEC  = 5
+	DEVNET_POLL_INTERVAL_MS  = 200
+)
+
+type devnetConfig struct {
+	nodes         int
+	walletServers int
+	accounts      int
+	fund          float32
+	blockInterval int
+	dir           string
+}
+
+// devnetProcess is a blockchain node or wallet server of the devnet.
+type devnetProcess struct {
+	name string
+	url  string
+	cmd  *exec.Cmd
+	done chan struct{} // Closed once the process exited
+	err  error
+}
+
+// Devnet is a local network of blockchain nodes and wallet servers whose
+// genesis block funds test accounts.
+type Devnet struct {
+	config    *devnetConfig
+	dir       string
+	temporary bool // dir is removed on Stop
+	spec      *block.ChainSpec
+	accounts  []*wallet.Wallet
+	nodes     []*devnetProcess
+	wallets   []*devnetProcess
+	exited    chan *devnetProcess
+	out       io.Writer
+	muxOut    sync.Mutex
+}
+
+// devnet runs a Devnet until it is interrupted or one of its processes
+// exits, tailing their logs. It is run from the repository root, where
+// the wallet servers find their templates:
+//
+//	go run ./cmd devnet -nodes 4 -wallet_servers 2 -accounts 5 -fund 1000
+func devnet(args []string) {
+	c := &devnetConfig{}
+	fs := flag.NewFlagSet("devnet", flag.ExitOnError)
+	fs.IntVar(&c.nodes, "nodes", 3, "Blockchain nodes.")
+	fs.IntVar(&c.walletServers, "wallet_servers", 1, "Wallet servers, using the nodes as gateways in turn.")
+	fs.IntVar(&c.accounts, "accounts", 3, "Test accounts funded by the genesis block.")
+	fund := fs.Float64("fund", 100, "Coins each test account starts with.")
+	fs.IntVar(&c.blockInterval, "block_interval", block.MINING_TIMER_SEC, "Seconds between two blocks mined by a node.")
+	fs.StringVar(&c.dir, "dir", "", "Directory for the binaries, chain spec, keys and logs. A temporary one, removed on exit, by default.")
+	fs.Parse(args)
+	c.fund = float32(*fund)
+	if c.nodes < 1 || c.walletServers < 0 || c.accounts < 0 || c.fund <= 0 || c.blockInterval < 1 {
+		log.Fatal("devnet: at least 1 node, a positive fund and block interval are needed")
+	}
+
+	dn := NewDevnet(c, os.Stdout)
+	if err := dn.Start(); err != nil {
+		dn.Stop()
+		log.Fatalf("devnet: %v", err)
+	}
+	dn.printSummary()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	failed := false
+	select {
+	case <-signals:
+		dn.printf("devnet", "stopping")
+	case p := <-dn.exited:
+		dn.printf("devnet", "%s exited (%v), stopping", p.name, p.err)
+		failed = true
+	}
+	dn.Stop()
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func NewDevnet(c *devnetConfig, out io.Writer) *Devnet {
+	return &Devnet{config: c, dir: c.dir, out: out}
+}
+
+// Start builds the servers, writes a chain spec funding fresh accounts and
+// starts the processes on free ports, returning once they are ready.
+func (dn *Devnet) Start() error {
+	if dn.dir == "" {
+		dir, err := os.MkdirTemp("", "devnet")
+		if err != nil {
+			return err
+		}
+		dn.dir = dir
+		dn.temporary = true
+	} else if err := os.MkdirAll(dn.dir, 0755); err != nil {
+		return err
+	}
+	for _, name := range []string{"blockchain_server", "wallet_server"} {
+		out, err := exec.Command("go", "build", "-o", filepath.Join(dn.dir, name), "./"+name).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("build %s: %v\n%s", name, err, out)
+		}
+	}
+	if err := dn.writeChainSpec(); err != nil {
+		return err
+	}
+
+	ports, err := freePorts(dn.config.nodes + dn.config.walletServers)
+	if err != nil {
+		return err
+	}
+	dn.exited = make(chan *devnetProcess, len(ports))
+	nodePorts, walletPorts := ports[:dn.config.nodes], ports[dn.config.nodes:]
+	for i, port := range nodePorts {
+		seeds := []string{}
+		for _, other := range nodePorts {
+			if other != port {
+				seeds = append(seeds, fmt.Sprintf("127.0.0.1:%d", other))
+			}
+		}
+		p, err := dn.start(fmt.Sprintf("node%d", i), port, "blockchain_server",
+			"-port", strconv.Itoa(port),
+			"-host", "127.0.0.1",
+			"-seeds", strings.Join(seeds, ","),
+			"-address_book", filepath.Join(dn.dir, fmt.Sprintf("peers_%d.json", port)),
+			"-identity_key", filepath.Join(dn.dir, fmt.Sprintf("node_%d.key", port)),
+			"-chain_spec", filepath.Join(dn.dir, "chain_spec.json"))
+		if err != nil {
+			return err
+		}
+		dn.nodes = append(dn.nodes, p)
+	}
+	for i, port := range walletPorts {
+		p, err := dn.start(fmt.Sprintf("wallet%d", i), port, "wallet_server",
+			"-port", strconv.Itoa(port),
+			"-gateway", dn.nodes[i%len(dn.nodes)].url)
+		if err != nil {
+			return err
+		}
+		dn.wallets = append(dn.wallets, p)
+	}
+	return dn.waitReady()
+}
+
+// writeChainSpec describes a network of its own, so that the devnet
+// nodes do not connect to nodes of other networks.
+func (dn *Devnet) writeChainSpec() error {
+	dn.spec = block.DefaultChainSpec()
+	dn.spec.NetworkID = "goblockchain-devnet"
+	dn.spec.Genesis.Timestamp = time.Now().UnixNano()
+	dn.spec.BlockIntervalSec = dn.config.blockInterval
+	for i := 0; i < dn.config.accounts; i++ {
+		w := wallet.NewWallet()
+		dn.accounts = append(dn.accounts, w)
+		dn.spec.Genesis.Allocations[w.BlockchainAddress()] = dn.config.fund
+	}
+	if err := dn.spec.Save(filepath.Join(dn.dir, "chain_spec.json")); err != nil {
+		return err
+	}
+	m, _ := json.MarshalIndent(dn.accounts, "", "  ")
+	return os.WriteFile(filepath.Join(dn.dir, "accounts.json"), m, 0600)
+}
+
+// start runs the binary name, writing its output to <name>.log in the
+// devnet directory and to the combined log.
+func (dn *Devnet) start(name string, port int, binary string, args ...string) (*devnetProcess, error) {
+	logFile, err := os.Create(filepath.Join(dn.dir, name+".log"))
+	if err != nil {
+		return nil, err
+	}
+	p := &devnetProcess{
+		name: name,
+		url:  fmt.Sprintf("http://127.0.0.1:%d", port),
+		cmd:  exec.Command(filepath.Join(dn.dir, binary), args...),
+		done: make(chan struct{}),
+	}
+	r, w := io.Pipe()
+	p.cmd.Stdout = w
+	p.cmd.Stderr = w
+	if err := p.cmd.Start(); err != nil {
+		logFile.Close()
+		return nil, err
+	}
+	go func() {
+		defer logFile.Close()
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			fmt.Fprintln(logFile, scanner.Text())
+			dn.printf(name, "%s", scanner.Text())
+		}
+	}()
+	go func() {
+		p.err = p.cmd.Wait()
+		w.Close()
+		close(p.done)
+		dn.exited <- p
+	}()
+	return p, nil
+}
+
+// waitReady waits until the nodes hold the genesis allocations and are
+// connected to each other, and the wallet servers answer.
+func (dn *Devnet) waitReady() error {
+	deadline := time.Now().Add(DEVNET_READY_TIMEOUT_SEC * time.Second)
+	wait := func(p *devnetProcess, ready func(p *devnetProcess) bool) error {
+		for !ready(p) {
+			select {
+			case <-p.done:
+				return fmt.Errorf("%s exited (%v)", p.name, p.err)
+			default:
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("timed out waiting for %s", p.name)
+			}
+			time.Sleep(DEVNET_POLL_INTERVAL_MS * time.Millisecond)
+		}
+		return nil
+	}
+	for _, p := range dn.nodes {
+		if err := wait(p, dn.nodeReady); err != nil {
+			return err
+		}
+	}
+	for _, p := range dn.wallets {
+		if err := wait(p, dn.walletReady); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dn *Devnet) nodeReady(p *devnetProcess) bool {
+	for _, w := range dn.accounts {
+		var ar block.AmountResponse
+		if !getJSON(p.url+"/amount?blockchain_address="+w.BlockchainAddress(), &ar) || ar.Amount < dn.config.fund {
+			return false
+		}
+	}
+	var pr block.PeersResponse
+	return getJSON(p.url+"/peers", &pr) && len(pr.Connections) >= len(dn.nodes)-1
+}
+
+func (dn *Devnet) walletReady(p *devnetProcess) bool {
+	resp, err := devnetClient.Get(p.url)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+var devnetClient = &http.Client{Timeout: time.Second}
+
+func getJSON(url string, v interface{}) bool {
+	resp, err := devnetClient.Get(url)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode == http.StatusOK && json.NewDecoder(resp.Body).Decode(v) == nil
+}
+
+// Stop terminates the processes, kills those still running after
+// DEVNET_STOP_TIMEOUT_SEC, and removes a temporary directory.
+func (dn *Devnet) Stop() {
+	processes := append(append([]*devnetProcess{}, dn.wallets...), dn.nodes...)
+	for _, p := range processes {
+		p.cmd.Process.Signal(syscall.SIGTERM)
+	}
+	deadline := time.NewTimer(DEVNET_STOP_TIMEOUT_SEC * time.Second)
+	defer deadline.Stop()
+	for _, p := range processes {
+		select {
+		case <-p.done:
+			continue
+		case <-deadline.C:
+		}
+		for _, p := range processes {
+			p.cmd.Process.Kill()
+		}
+		break
+	}
+	for _, p := range processes {
+		<-p.done
+	}
+	if dn.temporary {
+		os.RemoveAll(dn.dir)
+	}
+}
+
+func (dn *Devnet) printSummary() {
+	dn.printf("devnet", "directory %s", dn.dir)
+	dn.printf("devnet", "network %s, genesis %x", dn.spec.NetworkID, dn.spec.GenesisHash())
+	for _, p := range dn.nodes {
+		dn.printf("devnet", "%s %s", p.name, p.url)
+	}
+	for _, p := range dn.wallets {
+		dn.printf("devnet", "%s %s", p.name, p.url)
+	}
+	for i, w := range dn.accounts {
+		dn.printf("devnet", "account%d %s funded with %v", i, w.BlockchainAddress(), dn.config.fund)
+		dn.printf("devnet", "account%d private key %s", i, w.PrivateKeyStr())
+		dn.printf("devnet", "account%d public key %s", i, w.PublicKeyStr())
+	}
+	dn.printf("devnet", "ready, Ctrl-C to stop")
+}
+
+// printf writes a line of the combined log, prefixed with the name of the
+// process it comes from.
+func (dn *Devnet) printf(name string, format string, a ...interface{}) {
+	dn.muxOut.Lock()
+	defer dn.muxOut.Unlock()
+	fmt.Fprintf(dn.out, "%-8s | %s\n", name, fmt.Sprintf(format, a...))
+}
+
+// freePorts returns n distinct ports nothing listens on.
+func freePorts(n int) ([]int, error) {
+	ports := []int{}
+	listeners := []net.Listener{}
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, l)
+		ports = append(ports, l.Addr().(*net.TCPAddr).Port)
+	}
+	return ports, nil
+}
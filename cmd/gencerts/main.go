@@ -0,0 +1,23 @@
+package main
+
+import (
+	"flag"
+	"goblockchain/utils"
+	"log"
+	"strings"
+)
+
+// gencerts writes a CA and certificates for local TLS networks:
+//
+//	go run ./cmd/gencerts -out certs -names node5000,node5001,wallet
+func main() {
+	out := flag.String("out", "certs", "Directory the certificates are written to.")
+	names := flag.String("names", "node,wallet", "Comma-separated certificate names.")
+	hosts := flag.String("hosts", "127.0.0.1,localhost", "Comma-separated hosts the certificates are valid for.")
+	flag.Parse()
+
+	if err := utils.GenerateCertificates(*out, strings.Split(*names, ","), strings.Split(*hosts, ",")); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("certificates written to %s", *out)
+}
@@ -2,9 +2,32 @@ package main
 
 import (
 	"fmt"
-	"goblockchain/utils"
+	"os"
 )
 
+// cmd gathers the tools for working on the blockchain locally:
+//
+//	go run ./cmd devnet -nodes 3 -wallet_servers 1 -accounts 3
+//	go run ./cmd request -method DELETE http://127.0.0.1:5000/transactions
 func main() {
-	fmt.Println(utils.FindNeighbors("127.0.0.1", 5000, 0, 3, 5000, 5003))
+	if len(os.Args) < 2 {
+		usage()
+	}
+	switch os.Args[1] {
+	case "devnet":
+		devnet(os.Args[2:])
+	case "request":
+		request(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: cmd <command> [flags]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "commands:")
+	fmt.Fprintln(os.Stderr, "  devnet    run a local network of nodes and wallet servers with funded accounts")
+	fmt.Fprintln(os.Stderr, "  request   send a request signed with an identity key, e.g. to admin endpoints")
+	os.Exit(2)
 }
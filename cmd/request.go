@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"goblockchain/block"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// request sends a request signed with an identity key, as admin endpoints
+// of the nodes need:
+//
+//	go run ./cmd request -identity_key admin.key -show_key
+//	go run ./cmd request -identity_key admin.key -method DELETE http://127.0.0.1:5000/transactions
+func request(args []string) {
+	fs := flag.NewFlagSet("request", flag.ExitOnError)
+	keyPath := fs.String("identity_key", "admin.key", "File the identity key to sign with is kept in, created when missing.")
+	showKey := fs.Bool("show_key", false, "Print the public key, to list in admin_keys, and exit.")
+	method := fs.String("method", http.MethodGet, "HTTP method.")
+	data := fs.String("data", "", "Request body (JSON).")
+	fs.Parse(args)
+
+	key, err := block.LoadIdentityKey(*keyPath)
+	if err != nil {
+		log.Fatalf("request: %v", err)
+	}
+	if *showKey {
+		fmt.Println(block.IdentityKeyString(key))
+		return
+	}
+	if fs.NArg() != 1 {
+		log.Fatal("request: a URL is needed")
+	}
+
+	r, err := http.NewRequest(*method, fs.Arg(0), strings.NewReader(*data))
+	if err != nil {
+		log.Fatalf("request: %v", err)
+	}
+	if *data != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	if err := block.SignRequestWith(key, r); err != nil {
+		log.Fatalf("request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		log.Fatalf("request: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(os.Stdout, resp.Body)
+	fmt.Println()
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("request: %s", resp.Status)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"goblockchain/simnet"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// simnet runs the scenarios of package simnet, e.g.
+//
+//	go run ./cmd/simnet -scenarios partition,reorg -latency 50ms
+func main() {
+	config := simnet.DefaultConfig()
+	nodes := flag.Int("nodes", config.Nodes, "Nodes per scenario.")
+	latency := flag.Duration("latency", config.Latency, "Delay of every write between nodes.")
+	jitter := flag.Duration("jitter", config.Jitter, "Random delay added to the latency.")
+	loss := flag.Float64("loss", config.Loss, "Probability that a write is lost, which resets the connection.")
+	scenarios := flag.String("scenarios", "", "Comma-separated scenarios to run, all by default.")
+	list := flag.Bool("list", false, "List the scenarios.")
+	verbose := flag.Bool("v", false, "Show the logs of the nodes.")
+	flag.Parse()
+
+	if *list {
+		for _, s := range simnet.Scenarios {
+			fmt.Printf("%-12s %s\n", s.Name, s.Description)
+		}
+		return
+	}
+	if *nodes < 4 {
+		log.Fatal("at least 4 nodes are needed")
+	}
+	config.Nodes = *nodes
+	config.Latency = *latency
+	config.Jitter = *jitter
+	config.Loss = *loss
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	names := []string{}
+	for _, name := range strings.Split(*scenarios, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	start := time.Now()
+	failures := simnet.CheckScenarios(config, names)
+	for _, f := range failures {
+		fmt.Println("FAIL", f)
+	}
+	if len(failures) > 0 {
+		os.Exit(1)
+	}
+	fmt.Printf("ok (%s)\n", time.Since(start).Round(time.Millisecond))
+}
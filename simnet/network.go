@@ -0,0 +1,198 @@
+// Package simnet runs several nodes in one process over a simulated
+// network with latency, packet loss and partitions, and checks how the
+// nodes converge in scenarios (see CheckScenarios).
+package simnet
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Network sits between the nodes: every connection they open or accept
+// goes through it. Writes are delayed by the latency, and each one may
+// be lost. As peers talk over TCP, a lost write tears the connection
+// down rather than leaving a gap in the stream; the nodes have to
+// reconnect.
+type Network struct {
+	latency time.Duration
+	jitter  time.Duration
+	loss    float64
+	groups  map[string]int // Partition of each node address, 0 when not partitioned
+	conns   map[*simConn]bool
+	closed  bool
+	rand    *rand.Rand
+	mux     sync.Mutex
+}
+
+func NewNetwork(latency time.Duration, jitter time.Duration, loss float64) *Network {
+	return &Network{
+		latency: latency,
+		jitter:  jitter,
+		loss:    loss,
+		groups:  make(map[string]int),
+		conns:   make(map[*simConn]bool),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (n *Network) SetLatency(latency time.Duration, jitter time.Duration) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	n.latency = latency
+	n.jitter = jitter
+}
+
+func (n *Network) SetLoss(loss float64) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	n.loss = loss
+}
+
+// Partition splits the network: nodes only reach the nodes of their own
+// group. Connections across groups are cut.
+func (n *Network) Partition(groups ...[]*Node) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	n.groups = make(map[string]int)
+	for i, g := range groups {
+		for _, node := range g {
+			n.groups[node.Address()] = i + 1
+		}
+	}
+	for c := range n.conns {
+		if c.to != "" && !n.reachable(c.from, c.to) {
+			c.Close()
+		}
+	}
+}
+
+// Heal removes the partitions.
+func (n *Network) Heal() {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	n.groups = make(map[string]int)
+}
+
+// Close cuts every connection; nodes of the network cannot reach each
+// other anymore.
+func (n *Network) Close() {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	n.closed = true
+	for c := range n.conns {
+		c.Close()
+	}
+}
+
+func (n *Network) reachable(from string, to string) bool {
+	return !n.closed && n.groups[from] == n.groups[to]
+}
+
+// delay returns how long a write waits, or false when it is lost.
+func (n *Network) delay() (time.Duration, bool) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if n.rand.Float64() < n.loss {
+		return 0, false
+	}
+	d := n.latency
+	if n.jitter > 0 {
+		d += time.Duration(n.rand.Int63n(int64(n.jitter)))
+	}
+	return d, true
+}
+
+// Dialer returns how the node at from opens connections.
+func (n *Network) Dialer(from string) func(network string, address string, timeout time.Duration) (net.Conn, error) {
+	return func(network string, address string, timeout time.Duration) (net.Conn, error) {
+		n.mux.Lock()
+		ok := n.reachable(from, address)
+		n.mux.Unlock()
+		if !ok {
+			// Like a dropped SYN: the dial only fails once it times out.
+			time.Sleep(timeout)
+			return nil, fmt.Errorf("dial %s: i/o timeout", address)
+		}
+		if _, ok := n.delay(); !ok {
+			return nil, fmt.Errorf("dial %s: connection reset", address)
+		}
+		conn, err := net.DialTimeout(network, address, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return n.track(conn, from, address), nil
+	}
+}
+
+// Listen opens a listener for a node whose accepted connections go
+// through the network.
+func (n *Network) Listen() (net.Listener, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	return &simListener{l, n}, nil
+}
+
+func (n *Network) track(conn net.Conn, from string, to string) *simConn {
+	c := &simConn{Conn: conn, network: n, from: from, to: to}
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if n.closed {
+		conn.Close()
+	}
+	n.conns[c] = true
+	return c
+}
+
+func (n *Network) untrack(c *simConn) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	delete(n.conns, c)
+}
+
+type simListener struct {
+	net.Listener
+	network *Network
+}
+
+func (l *simListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	// The remote end is the ephemeral port of a dialer, not a node
+	// address; partitions are enforced by the dialing side.
+	return l.network.track(conn, l.Addr().String(), ""), nil
+}
+
+// simConn is a connection through the network.
+type simConn struct {
+	net.Conn
+	network   *Network
+	from      string
+	to        string // Empty for accepted connections
+	closeOnce sync.Once
+}
+
+func (c *simConn) Write(b []byte) (int, error) {
+	d, ok := c.network.delay()
+	if !ok {
+		c.Close()
+		return 0, fmt.Errorf("write to %s: connection reset", c.RemoteAddr())
+	}
+	time.Sleep(d)
+	return c.Conn.Write(b)
+}
+
+func (c *simConn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		err = c.Conn.Close()
+		go c.network.untrack(c)
+	})
+	return err
+}
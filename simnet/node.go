@@ -0,0 +1,165 @@
+package simnet
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"goblockchain/block"
+	"goblockchain/utils"
+	"goblockchain/wallet"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Node is a blockchain node of a simulated network. It serves the part
+// of the blockchain server API peers use.
+type Node struct {
+	bc       *block.Blockchain
+	wallet   *wallet.Wallet // Funded by the genesis block, receives the mining rewards
+	listener net.Listener
+	server   *http.Server
+}
+
+// NewNode starts a node of the chain spec on network, mining for w.
+func NewNode(network *Network, spec *block.ChainSpec, w *wallet.Wallet) (*Node, error) {
+	l, err := network.Listen()
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{wallet: w, listener: l}
+	port := l.Addr().(*net.TCPAddr).Port
+	n.bc = block.NewBlockchainWithSpec(w.BlockchainAddress(), uint16(port), spec)
+	n.bc.SetPeerConfig("127.0.0.1", nil, "")
+	n.bc.SetDialFunc(network.Dialer(n.Address()))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/handshake", n.handshake)
+	mux.HandleFunc("/peers", n.peers)
+	mux.HandleFunc("/p2p", n.p2p)
+	mux.HandleFunc("/blocks", n.blocks)
+	mux.HandleFunc("/headers", n.headers)
+	n.server = &http.Server{Handler: mux}
+	go n.server.Serve(l)
+	return n, nil
+}
+
+func (n *Node) Blockchain() *block.Blockchain {
+	return n.bc
+}
+
+func (n *Node) Wallet() *wallet.Wallet {
+	return n.wallet
+}
+
+func (n *Node) Address() string {
+	return n.bc.Address()
+}
+
+func (n *Node) Height() int {
+	return n.bc.Height()
+}
+
+// Tip is the hash of the last block of the node.
+func (n *Node) Tip() [32]byte {
+	chain := n.bc.Chain()
+	return chain[len(chain)-1].Hash()
+}
+
+// Close stops serving peers. Connections are cut by closing the network.
+func (n *Node) Close() {
+	n.server.Close()
+}
+
+func (n *Node) handshake(w http.ResponseWriter, r *http.Request) {
+	var h block.Handshake
+	if err := json.NewDecoder(r.Body).Decode(&h); err != nil || !h.Validate() {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := n.bc.AcceptHandshake(&h, r.RemoteAddr); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	m, _ := json.Marshal(n.bc.Handshake())
+	w.Write(m)
+}
+
+func (n *Node) peers(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var pr block.PeersRequest
+		if err := json.NewDecoder(r.Body).Decode(&pr); err != nil || !pr.Validate() {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		n.bc.AddPeer(*pr.Address)
+	}
+	m, _ := json.Marshal(&block.PeersResponse{Peers: n.bc.KnownPeers()})
+	w.Write(m)
+}
+
+func (n *Node) p2p(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upgrade") != block.P2P_PROTOCOL {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + block.P2P_PROTOCOL + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	go n.bc.AcceptPeer(conn, rw.Reader, r.RemoteAddr)
+}
+
+func (n *Node) blocks(w http.ResponseWriter, r *http.Request) {
+	hash, ok := decodeHash(r.URL.Query().Get("hash"))
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	b := n.bc.BlockByHash(hash)
+	if b == nil {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, string(utils.JsonStatus("fail")))
+		return
+	}
+	m, _ := b.MarshalJSON()
+	w.Write(m)
+}
+
+func (n *Node) headers(w http.ResponseWriter, r *http.Request) {
+	locator := [][32]byte{}
+	if l := r.URL.Query().Get("locator"); l != "" {
+		for _, s := range strings.Split(l, ",") {
+			hash, ok := decodeHash(s)
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			locator = append(locator, hash)
+		}
+	}
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	m, _ := json.Marshal(&block.HeadersResponse{
+		Headers: n.bc.HeadersAfter(locator, limit),
+		Height:  n.Height(),
+	})
+	w.Write(m)
+}
+
+func decodeHash(s string) ([32]byte, bool) {
+	var hash [32]byte
+	h, err := hex.DecodeString(s)
+	if err != nil || len(h) != 32 {
+		log.Printf("ERROR: Invalid block hash %q", s)
+		return hash, false
+	}
+	copy(hash[:], h)
+	return hash, true
+}
@@ -0,0 +1,385 @@
+package simnet
+
+import (
+	"fmt"
+	"goblockchain/block"
+	"goblockchain/wallet"
+	"time"
+)
+
+const (
+	CONVERGENCE_TIMEOUT_SEC = 60
+	POLL_INTERVAL_MS        = 50
+	NODE_FUND               = 10 // Coins the genesis block credits each node with
+)
+
+// Config describes the network scenarios run on.
+type Config struct {
+	Nodes   int
+	Latency time.Duration
+	Jitter  time.Duration
+	Loss    float64 // Probability that a write is lost
+}
+
+func DefaultConfig() *Config {
+	return &Config{Nodes: 4, Latency: 20 * time.Millisecond, Jitter: 10 * time.Millisecond}
+}
+
+// Scenario runs nodes through a situation and returns what went wrong,
+// nil if they behaved.
+type Scenario struct {
+	Name        string
+	Description string
+	Run         func(c *Config) error
+}
+
+var Scenarios = []Scenario{
+	{"propagation", "Blocks and transactions reach every node", scenarioPropagation},
+	{"partition", "Both sides of a partition converge on the longer chain once it heals", scenarioPartition},
+	{"reorg", "Nodes switching branch undo the blocks they leave and pool their transactions again", scenarioReorg},
+	{"lossy", "Nodes converge after connections kept breaking", scenarioLossy},
+}
+
+// CheckScenarios runs the scenarios with the given names, all of them
+// when there are none, and describes every failure.
+func CheckScenarios(c *Config, names []string) []string {
+	failures := []string{}
+	for _, s := range Scenarios {
+		if len(names) > 0 && !contains(names, s.Name) {
+			continue
+		}
+		if err := s.Run(c); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", s.Name, err))
+		}
+	}
+	for _, name := range names {
+		if !hasScenario(name) {
+			failures = append(failures, fmt.Sprintf("%s: no such scenario", name))
+		}
+	}
+	return failures
+}
+
+// Cluster is a set of nodes connected to each other over a network.
+type Cluster struct {
+	Network *Network
+	Nodes   []*Node
+}
+
+// NewCluster starts c.Nodes nodes that know and connect to each other.
+// They share a genesis block funding each of them.
+func NewCluster(c *Config) (*Cluster, error) {
+	cl := &Cluster{Network: NewNetwork(c.Latency, c.Jitter, c.Loss)}
+	spec := block.DefaultChainSpec()
+	spec.NetworkID = "goblockchain-simnet"
+	spec.Genesis.Timestamp = time.Now().UnixNano()
+	wallets := []*wallet.Wallet{}
+	for i := 0; i < c.Nodes; i++ {
+		w := wallet.NewWallet()
+		wallets = append(wallets, w)
+		spec.Genesis.Allocations[w.BlockchainAddress()] = NODE_FUND
+	}
+	for _, w := range wallets {
+		n, err := NewNode(cl.Network, spec, w)
+		if err != nil {
+			cl.Close()
+			return nil, err
+		}
+		cl.Nodes = append(cl.Nodes, n)
+	}
+	for _, n := range cl.Nodes {
+		seeds := []string{}
+		for _, other := range cl.Nodes {
+			if other != n {
+				seeds = append(seeds, other.Address())
+			}
+		}
+		n.bc.SetPeerConfig("127.0.0.1", seeds, "")
+		n.bc.SyncNeighbors()
+	}
+	cl.connect()
+	for _, n := range cl.Nodes {
+		n.bc.StartP2P()
+	}
+	if err := cl.WaitConnected(cl.Nodes); err != nil {
+		cl.Close()
+		return nil, err
+	}
+	return cl, nil
+}
+
+// connect opens the connections between nodes that are missing.
+func (cl *Cluster) connect() {
+	for i, n := range cl.Nodes {
+		for _, other := range cl.Nodes[i+1:] {
+			n.bc.ConnectPeer(other.Address())
+		}
+	}
+}
+
+func (cl *Cluster) Close() {
+	cl.Network.Close()
+	for _, n := range cl.Nodes {
+		n.Close()
+	}
+}
+
+// Heal removes the partitions and reconnects the nodes right away rather
+// than when their reconnection timers fire.
+func (cl *Cluster) Heal() {
+	cl.Network.Heal()
+	cl.connect()
+}
+
+// Mine makes n mine blocks one after the other.
+func (cl *Cluster) Mine(n *Node, blocks int) {
+	for i := 0; i < blocks; i++ {
+		n.bc.Mining()
+	}
+}
+
+// WaitConnected waits until each of nodes is connected to all others.
+func (cl *Cluster) WaitConnected(nodes []*Node) error {
+	return waitFor(func() bool {
+		for _, n := range nodes {
+			if len(n.bc.ConnectedPeers()) < len(nodes)-1 {
+				return false
+			}
+		}
+		return true
+	}, "nodes to connect")
+}
+
+// WaitConverged waits until nodes share the same tip.
+func (cl *Cluster) WaitConverged(nodes []*Node) error {
+	err := waitFor(func() bool {
+		for _, n := range nodes[1:] {
+			if n.Tip() != nodes[0].Tip() {
+				return false
+			}
+		}
+		return true
+	}, "nodes to converge")
+	if err != nil {
+		heights := []int{}
+		for _, n := range nodes {
+			heights = append(heights, n.Height())
+		}
+		return fmt.Errorf("%v, heights %v", err, heights)
+	}
+	return nil
+}
+
+func waitFor(done func() bool, what string) error {
+	deadline := time.Now().Add(CONVERGENCE_TIMEOUT_SEC * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for %s", what)
+		}
+		time.Sleep(POLL_INTERVAL_MS * time.Millisecond)
+	}
+	return nil
+}
+
+// pay sends value from the funds of from to the wallet to,
+// submitting the transaction to via.
+func pay(from *Node, to *wallet.Wallet, value float32, via *Node) error {
+	w := from.wallet
+	t := wallet.NewTransaction(w.PrivateKey(), w.PublicKey(), w.BlockchainAddress(), to.BlockchainAddress(), value, 0)
+	if !via.bc.CreateTransaction(w.BlockchainAddress(), to.BlockchainAddress(), value, 0, w.PublicKey(), t.GenerateSignature()) {
+		return fmt.Errorf("transaction refused by %s", via.Address())
+	}
+	return nil
+}
+
+func scenarioPropagation(c *Config) error {
+	cl, err := NewCluster(c)
+	if err != nil {
+		return err
+	}
+	defer cl.Close()
+	sender, relay, miner, recipient := cl.Nodes[0], cl.Nodes[1], cl.Nodes[2], cl.Nodes[len(cl.Nodes)-1]
+
+	if err := pay(sender, recipient.wallet, 0.5, relay); err != nil {
+		return err
+	}
+	err = waitFor(func() bool {
+		for _, n := range cl.Nodes {
+			if len(n.bc.TransactionPool()) != 1 {
+				return false
+			}
+		}
+		return true
+	}, "the transaction to reach every pool")
+	if err != nil {
+		return err
+	}
+	cl.Mine(miner, 1)
+	if err := cl.WaitConverged(cl.Nodes); err != nil {
+		return err
+	}
+	for _, n := range cl.Nodes {
+		if amount := n.bc.CalculateTotalAmount(recipient.wallet.BlockchainAddress()); amount != NODE_FUND+0.5 {
+			return fmt.Errorf("%s: recipient has %v, want %v", n.Address(), amount, NODE_FUND+0.5)
+		}
+		if len(n.bc.TransactionPool()) != 0 {
+			return fmt.Errorf("%s: transaction still pooled after being mined", n.Address())
+		}
+	}
+	return nil
+}
+
+// split partitions cl in two halves.
+func split(cl *Cluster) (short []*Node, long []*Node) {
+	half := len(cl.Nodes) / 2
+	short, long = cl.Nodes[:half], cl.Nodes[half:]
+	cl.Network.Partition(short, long)
+	return short, long
+}
+
+// mineBranches makes the two sides of a partition mine a short and a
+// long branch, and checks each side agrees on its own branch.
+func mineBranches(cl *Cluster, short []*Node, long []*Node) error {
+	// Each block reaches the side before the next one is mined, so that
+	// the sides do not fork themselves.
+	for i := 0; i < 2; i++ {
+		cl.Mine(short[i%len(short)], 1)
+		if err := cl.WaitConverged(short); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < 3; i++ {
+		cl.Mine(long[i%len(long)], 1)
+		if err := cl.WaitConverged(long); err != nil {
+			return err
+		}
+	}
+	if short[0].Tip() == long[0].Tip() {
+		return fmt.Errorf("both sides of the partition have the same tip")
+	}
+	return nil
+}
+
+func scenarioPartition(c *Config) error {
+	cl, err := NewCluster(c)
+	if err != nil {
+		return err
+	}
+	defer cl.Close()
+	short, long := split(cl)
+	if err := mineBranches(cl, short, long); err != nil {
+		return err
+	}
+	height := long[0].Height()
+
+	cl.Heal()
+	if err := cl.WaitConnected(cl.Nodes); err != nil {
+		return err
+	}
+	cl.Mine(long[0], 1)
+	if err := cl.WaitConverged(cl.Nodes); err != nil {
+		return err
+	}
+	if h := cl.Nodes[0].Height(); h != height+1 {
+		return fmt.Errorf("converged at height %d, want %d", h, height+1)
+	}
+	return nil
+}
+
+func scenarioReorg(c *Config) error {
+	cl, err := NewCluster(c)
+	if err != nil {
+		return err
+	}
+	defer cl.Close()
+	short, long := split(cl)
+	recipient := wallet.NewWallet()
+	if err := pay(short[0], recipient, 0.5, short[0]); err != nil {
+		return err
+	}
+	if err := mineBranches(cl, short, long); err != nil {
+		return err
+	}
+	if amount := short[0].bc.CalculateTotalAmount(recipient.BlockchainAddress()); amount != 0.5 {
+		return fmt.Errorf("payment not mined on the short branch, recipient has %v", amount)
+	}
+
+	cl.Heal()
+	if err := cl.WaitConnected(cl.Nodes); err != nil {
+		return err
+	}
+	cl.Mine(long[0], 1)
+	if err := cl.WaitConverged(cl.Nodes); err != nil {
+		return err
+	}
+	if amount := short[0].bc.CalculateTotalAmount(recipient.BlockchainAddress()); amount != 0 {
+		return fmt.Errorf("payment of the abandoned branch kept, recipient has %v", amount)
+	}
+	if amount := short[0].bc.CalculateTotalAmount(short[1].wallet.BlockchainAddress()); amount != NODE_FUND {
+		return fmt.Errorf("rewards of the abandoned branch kept: %v", amount-NODE_FUND)
+	}
+
+	// The payment went back to the pool with the abandoned branch and is
+	// mined again on the long one.
+	cl.Mine(short[0], 1)
+	if err := cl.WaitConverged(cl.Nodes); err != nil {
+		return err
+	}
+	addresses := []string{recipient.BlockchainAddress()}
+	for _, n := range cl.Nodes {
+		addresses = append(addresses, n.wallet.BlockchainAddress())
+	}
+	for _, address := range addresses {
+		want := long[0].bc.CalculateTotalAmount(address)
+		for _, n := range cl.Nodes {
+			if amount := n.bc.CalculateTotalAmount(address); amount != want {
+				return fmt.Errorf("%s: %s has %v, want %v", n.Address(), address, amount, want)
+			}
+		}
+	}
+	if amount := long[0].bc.CalculateTotalAmount(recipient.BlockchainAddress()); amount != 0.5 {
+		return fmt.Errorf("payment not mined again after the reorg, recipient has %v", amount)
+	}
+	return nil
+}
+
+func scenarioLossy(c *Config) error {
+	cl, err := NewCluster(c)
+	if err != nil {
+		return err
+	}
+	defer cl.Close()
+	cl.Network.SetLatency(50*time.Millisecond, 50*time.Millisecond)
+	cl.Network.SetLoss(0.02)
+	for i := 0; i < 8; i++ {
+		cl.Mine(cl.Nodes[i%len(cl.Nodes)], 1)
+		time.Sleep(500 * time.Millisecond)
+	}
+	cl.Network.SetLoss(0)
+	// Nodes reconnect by themselves and catch up with peers that are
+	// ahead; a last block settles branches of the same length.
+	if err := cl.WaitConnected(cl.Nodes); err != nil {
+		return err
+	}
+	time.Sleep(time.Second)
+	cl.Mine(cl.Nodes[0], 1)
+	return cl.WaitConverged(cl.Nodes)
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func hasScenario(name string) bool {
+	for _, s := range Scenarios {
+		if s.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,25 @@
+package simnet
+
+import (
+	"io"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestScenarios(t *testing.T) {
+	if testing.Short() {
+		t.Skip("scenarios take a while")
+	}
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+		defer log.SetOutput(os.Stderr)
+	}
+	for _, s := range Scenarios {
+		t.Run(s.Name, func(t *testing.T) {
+			if err := s.Run(DefaultConfig()); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
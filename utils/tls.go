@@ -0,0 +1,196 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TLSFiles names the certificate, key, CA and pinned public keys a node
+// or wallet server authenticates with. Pins are hex SHA-256 hashes of a
+// certificate's public key (see PublicKeyPin).
+type TLSFiles struct {
+	CertFile string   `json:"cert"`
+	KeyFile  string   `json:"key"`
+	CAFile   string   `json:"ca"`
+	Pins     []string `json:"pins"`
+}
+
+// Enabled reports whether a certificate is configured.
+func (f *TLSFiles) Enabled() bool {
+	return f.CertFile != "" && f.KeyFile != ""
+}
+
+// PublicKeyPin is the hex SHA-256 of the public key of cert.
+func PublicKeyPin(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(h[:])
+}
+
+func (f *TLSFiles) load() (tls.Certificate, *x509.CertPool, error) {
+	cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+	if err != nil {
+		return cert, nil, err
+	}
+	if f.CAFile == "" {
+		if len(f.Pins) == 0 {
+			return cert, nil, fmt.Errorf("tls needs a CA or pinned keys to authenticate peers")
+		}
+		return cert, nil, nil
+	}
+	pem, err := os.ReadFile(f.CAFile)
+	if err != nil {
+		return cert, nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return cert, nil, fmt.Errorf("%s: no certificates", f.CAFile)
+	}
+	return cert, pool, nil
+}
+
+// verifyPins accepts a peer whose leaf certificate carries a pinned key.
+func (f *TLSFiles) verifyPins(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(f.Pins) == 0 {
+		return nil
+	}
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("no peer certificate")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	pin := PublicKeyPin(cert)
+	for _, p := range f.Pins {
+		if strings.EqualFold(p, pin) {
+			return nil
+		}
+	}
+	return fmt.Errorf("peer key %s is not pinned", pin)
+}
+
+// ServerConfig requires clients to present a certificate signed by the
+// CA, or with a pinned key when pins are set.
+func (f *TLSFiles) ServerConfig() (*tls.Config, error) {
+	cert, pool, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	c := &tls.Config{
+		Certificates:          []tls.Certificate{cert},
+		MinVersion:            tls.VersionTLS12,
+		ClientAuth:            tls.RequireAnyClientCert,
+		VerifyPeerCertificate: f.verifyPins,
+	}
+	if pool != nil {
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+		c.ClientCAs = pool
+	}
+	return c, nil
+}
+
+// ClientConfig presents our certificate and checks the server against
+// the CA, or only against the pins when no CA is configured.
+func (f *TLSFiles) ClientConfig() (*tls.Config, error) {
+	cert, pool, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	c := &tls.Config{
+		Certificates:          []tls.Certificate{cert},
+		MinVersion:            tls.VersionTLS12,
+		RootCAs:               pool,
+		VerifyPeerCertificate: f.verifyPins,
+	}
+	if pool == nil {
+		// Self-signed peers are authenticated by their pinned key alone.
+		c.InsecureSkipVerify = true
+	}
+	return c, nil
+}
+
+// GenerateCertificates writes a CA (ca.pem, ca-key.pem) and, for each of
+// names, a certificate signed by it (<name>.pem, <name>-key.pem) valid
+// for hosts, both as server and as client. Meant for local networks.
+func GenerateCertificates(dir string, names []string, hosts []string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "goblockchain CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	if err := writePEM(dir, "ca", caDER, caKey); err != nil {
+		return err
+	}
+	for i, name := range names {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i + 2)),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().AddDate(1, 0, 0),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}
+		for _, h := range hosts {
+			if ip := net.ParseIP(h); ip != nil {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			} else {
+				template.DNSNames = append(template.DNSNames, h)
+			}
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			return err
+		}
+		if err := writePEM(dir, name, der, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writePEM(dir string, name string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0600)
+}
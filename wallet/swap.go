@@ -0,0 +1,48 @@
+package wallet
+
+// SwapInitiateRequest locks value from the sender in a hash time-locked
+// contract. Hash is optional; when omitted a random preimage is created.
+type SwapInitiateRequest struct {
+	SenderPrivateKey        *string `json:"sender_private_key"`
+	SenderPublicKey         *string `json:"sender_public_key"`
+	SenderBlockchainAddress *string `json:"sender_blockchain_address"`
+	RecipientPublicKey      *string `json:"recipient_public_key"`
+	Value                   *string `json:"value"`
+	Deadline                *string `json:"deadline"`
+	Hash                    *string `json:"hash"`
+}
+
+func (sr *SwapInitiateRequest) Validate() bool {
+	if sr.SenderPrivateKey == nil ||
+		sr.SenderPublicKey == nil ||
+		sr.SenderBlockchainAddress == nil ||
+		sr.RecipientPublicKey == nil ||
+		sr.Value == nil ||
+		sr.Deadline == nil {
+		return false
+	}
+	return true
+}
+
+// SwapClaimRequest moves the funds of a contract to RecipientBlockchainAddress,
+// either by revealing Preimage (redeem) or after the deadline (refund).
+// The keys are those of the party claiming.
+type SwapClaimRequest struct {
+	PrivateKey                 *string `json:"private_key"`
+	PublicKey                  *string `json:"public_key"`
+	RecipientBlockchainAddress *string `json:"recipient_blockchain_address"`
+	Script                     *string `json:"script"`
+	Value                      *string `json:"value"`
+	Preimage                   *string `json:"preimage"`
+}
+
+func (sr *SwapClaimRequest) Validate() bool {
+	if sr.PrivateKey == nil ||
+		sr.PublicKey == nil ||
+		sr.RecipientBlockchainAddress == nil ||
+		sr.Script == nil ||
+		sr.Value == nil {
+		return false
+	}
+	return true
+}
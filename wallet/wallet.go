@@ -5,6 +5,7 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 
@@ -86,11 +87,25 @@ type Transaction struct {
 	senderBlockchainAddress    string
 	recipientBlockchainAddress string
 	value                      float32
+	lockTime                   int64
+	data                       []byte
+	gasLimit                   uint64
+	gasPrice                   float32
 }
 
+// NewTransaction builds a payment. A non-zero lockTime is either a block
+// height or a unix timestamp (see block.LOCKTIME_THRESHOLD) before which
+// the payment cannot be mined.
 func NewTransaction(privateKey *ecdsa.PrivateKey, publicKey *ecdsa.PublicKey,
-	sender string, recipient string, value float32) *Transaction {
-	return &Transaction{privateKey, publicKey, sender, recipient, value}
+	sender string, recipient string, value float32, lockTime int64) *Transaction {
+	return &Transaction{privateKey, publicKey, sender, recipient, value, lockTime, nil, 0, 0}
+}
+
+// NewContractTransaction deploys data as contract code when recipient is
+// empty, otherwise it calls the contract at recipient with data as input.
+func NewContractTransaction(privateKey *ecdsa.PrivateKey, publicKey *ecdsa.PublicKey,
+	sender string, recipient string, value float32, data []byte, gasLimit uint64, gasPrice float32) *Transaction {
+	return &Transaction{privateKey, publicKey, sender, recipient, value, 0, data, gasLimit, gasPrice}
 }
 
 func (t *Transaction) GenerateSignature() *utils.Signature {
@@ -105,10 +120,18 @@ func (t *Transaction) MarshalJSON() ([]byte, error) {
 		Sender    string  `json:"sender_blockchain_address"`
 		Recipient string  `json:"recipient_blockchain_address"`
 		Value     float32 `json:"value"`
+		LockTime  int64   `json:"lock_time"`
+		Data      string  `json:"data,omitempty"`
+		GasLimit  uint64  `json:"gas_limit,omitempty"`
+		GasPrice  float32 `json:"gas_price,omitempty"`
 	}{
 		Sender:    t.senderBlockchainAddress,
 		Recipient: t.recipientBlockchainAddress,
 		Value:     t.value,
+		LockTime:  t.lockTime,
+		Data:      hex.EncodeToString(t.data),
+		GasLimit:  t.gasLimit,
+		GasPrice:  t.gasPrice,
 	})
 }
 
@@ -130,6 +153,11 @@ type TransactionRequest struct {
 	RecipientBlockchainAddress *string `json:"recipient_blockchain_address"`
 	SenderPublicKey            *string `json:"sender_public_key"`
 	Value                      *string `json:"value"`
+	LockTime                   *string `json:"lock_time"`
+	Data                       *string `json:"data"`      // Hex contract code or call input
+	Input                      *string `json:"input"`     // Comma separated call arguments, instead of data
+	GasLimit                   *string `json:"gas_limit"` // Set for contract transactions
+	GasPrice                   *string `json:"gas_price"`
 }
 
 func (tr *TransactionRequest) Validate() bool {
@@ -2,7 +2,9 @@ package main
 
 import (
 	"flag"
+	"goblockchain/utils"
 	"log"
+	"strings"
 )
 
 func init() {
@@ -11,9 +13,24 @@ func init() {
 
 func main() {
 	port := flag.Uint("port", 8080, "TCP Port Number for Wallet Server")
-	gateway := flag.String("gateway", "http://127.0.0.1:5000", "Blockchain Gateway")
+	gateway := flag.String("gateway", "http://127.0.0.1:5000", "Blockchain Gateway, http:// or https://")
+	tlsCert := flag.String("tls_cert", "", "Client certificate (PEM) for an https gateway")
+	tlsKey := flag.String("tls_key", "", "Private key (PEM) of -tls_cert")
+	tlsCA := flag.String("tls_ca", "", "CA (PEM) the gateway certificate must be signed by")
+	tlsPins := flag.String("tls_pins", "", "Comma-separated SHA-256 pins of the gateway keys to accept")
 	flag.Parse()
 
 	app := NewWalletServer(uint16(*port), *gateway)
+	if strings.HasPrefix(*gateway, "https://") {
+		files := &utils.TLSFiles{CertFile: *tlsCert, KeyFile: *tlsKey, CAFile: *tlsCA}
+		if *tlsPins != "" {
+			files.Pins = strings.Split(*tlsPins, ",")
+		}
+		config, err := files.ClientConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		app.SetGatewayTLS(config)
+	}
 	app.Run()
 }
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"goblockchain/block"
+	"goblockchain/utils"
+	"goblockchain/wallet"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// SwapInitiate sends value from the sender to a new hash time-locked contract.
+func (ws *WalletServer) SwapInitiate(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		decoder := json.NewDecoder(r.Body)
+		var t wallet.SwapInitiateRequest
+		err := decoder.Decode(&t)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		if !t.Validate() {
+			log.Println("ERROR: missing field(s)")
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+
+		value, err1 := strconv.ParseFloat(*t.Value, 32)
+		deadline, err2 := strconv.ParseInt(*t.Deadline, 10, 64)
+		recipientKey, err3 := hex.DecodeString(*t.RecipientPublicKey)
+		senderKey, err4 := hex.DecodeString(*t.SenderPublicKey)
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil || deadline <= 0 {
+			log.Println("ERROR: parse error")
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		value32 := float32(value)
+
+		var preimage []byte
+		htlc := &block.HTLC{RecipientPublicKey: recipientKey, SenderPublicKey: senderKey, Deadline: deadline}
+		if t.Hash != nil && *t.Hash != "" {
+			hash, err := hex.DecodeString(*t.Hash)
+			if err != nil || len(hash) != 32 {
+				log.Println("ERROR: invalid hash")
+				io.WriteString(w, string(utils.JsonStatus("fail")))
+				return
+			}
+			copy(htlc.Hash[:], hash)
+		} else {
+			preimage = make([]byte, 32)
+			rand.Read(preimage)
+			htlc.Hash = sha256.Sum256(preimage)
+		}
+		address := htlc.Address()
+
+		publicKey := utils.PublicKeyFromString(*t.SenderPublicKey)
+		privateKey := utils.PrivateKeyFromString(*t.SenderPrivateKey, publicKey)
+		transaction := wallet.NewTransaction(privateKey, publicKey, *t.SenderBlockchainAddress, address, value32, 0)
+		signatureStr := transaction.GenerateSignature().String()
+		var lockTime int64
+		bt := &block.TransactionRequest{
+			SenderBlockchainAddress:    t.SenderBlockchainAddress,
+			RecipientBlockchainAddress: &address,
+			SenderPublicKey:            t.SenderPublicKey,
+			Value:                      &value32,
+			Signature:                  &signatureStr,
+			LockTime:                   &lockTime,
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		if !ws.postTransaction(bt) {
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		m, _ := json.Marshal(struct {
+			Message  string `json:"message"`
+			Address  string `json:"htlc_address"`
+			Script   string `json:"script"`
+			Hash     string `json:"hash"`
+			Preimage string `json:"preimage,omitempty"`
+			Deadline int64  `json:"deadline"`
+		}{
+			Message:  "success",
+			Address:  address,
+			Script:   hex.EncodeToString(htlc.Script()),
+			Hash:     hex.EncodeToString(htlc.Hash[:]),
+			Preimage: hex.EncodeToString(preimage),
+			Deadline: deadline,
+		})
+		io.WriteString(w, string(m[:]))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("ERROR: Invalid HTTP Method")
+	}
+}
+
+// SwapRedeem claims the contract funds for the recipient with the preimage.
+func (ws *WalletServer) SwapRedeem(w http.ResponseWriter, r *http.Request) {
+	ws.swapClaim(w, r, true)
+}
+
+// SwapRefund returns the contract funds to the sender after the deadline.
+func (ws *WalletServer) SwapRefund(w http.ResponseWriter, r *http.Request) {
+	ws.swapClaim(w, r, false)
+}
+
+func (ws *WalletServer) swapClaim(w http.ResponseWriter, r *http.Request, redeem bool) {
+	switch r.Method {
+	case http.MethodPost:
+		decoder := json.NewDecoder(r.Body)
+		var t wallet.SwapClaimRequest
+		err := decoder.Decode(&t)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		if !t.Validate() || (redeem && t.Preimage == nil) {
+			log.Println("ERROR: missing field(s)")
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+
+		script, err := hex.DecodeString(*t.Script)
+		if err != nil {
+			log.Println("ERROR: parse error")
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		htlc, ok := block.ParseHTLC(script)
+		if !ok {
+			log.Println("ERROR: not a hash time-locked contract")
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		value, err := strconv.ParseFloat(*t.Value, 32)
+		if err != nil {
+			log.Println("ERROR: parse error")
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		value32 := float32(value)
+
+		// A refund may only be mined once the deadline has passed.
+		var lockTime int64
+		if !redeem {
+			lockTime = htlc.Deadline
+		}
+		address := htlc.Address()
+		publicKey := utils.PublicKeyFromString(*t.PublicKey)
+		privateKey := utils.PrivateKeyFromString(*t.PrivateKey, publicKey)
+		transaction := wallet.NewTransaction(privateKey, publicKey, address, *t.RecipientBlockchainAddress, value32, lockTime)
+		signature, _ := hex.DecodeString(transaction.GenerateSignature().String())
+
+		var witness [][]byte
+		if redeem {
+			preimage, err := hex.DecodeString(*t.Preimage)
+			if err != nil || sha256.Sum256(preimage) != htlc.Hash {
+				log.Println("ERROR: preimage does not match hash")
+				io.WriteString(w, string(utils.JsonStatus("fail")))
+				return
+			}
+			witness = htlc.RedeemWitness(signature, preimage)
+		} else {
+			witness = htlc.RefundWitness(signature)
+		}
+		witnessStr := make([]string, len(witness))
+		for i, wi := range witness {
+			witnessStr[i] = hex.EncodeToString(wi)
+		}
+
+		bt := &block.TransactionRequest{
+			SenderBlockchainAddress:    &address,
+			RecipientBlockchainAddress: t.RecipientBlockchainAddress,
+			Value:                      &value32,
+			LockTime:                   &lockTime,
+			Script:                     t.Script,
+			Witness:                    &witnessStr,
+		}
+		w.Header().Add("Content-Type", "application/json")
+		if ws.postTransaction(bt) {
+			io.WriteString(w, string(utils.JsonStatus("success")))
+			return
+		}
+		io.WriteString(w, string(utils.JsonStatus("fail")))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("ERROR: Invalid HTTP Method")
+	}
+}
+
+// SwapPreimage finds the preimage a redeem of the contract revealed on chain,
+// which lets the other side of the swap redeem on its own chain.
+func (ws *WalletServer) SwapPreimage(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		script, err := hex.DecodeString(r.URL.Query().Get("script"))
+		if err != nil {
+			log.Println("ERROR: parse error")
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		htlc, ok := block.ParseHTLC(script)
+		if !ok {
+			log.Println("ERROR: not a hash time-locked contract")
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+
+		resp, err := ws.client.Get(fmt.Sprintf("%s/chain", ws.Gateway()))
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		defer resp.Body.Close()
+		var bc block.Blockchain
+		if err := json.NewDecoder(resp.Body).Decode(&bc); err != nil {
+			log.Printf("ERROR: %v", err)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		preimage, found := block.FindHTLCPreimage(bc.Chain(), htlc)
+		if !found {
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		m, _ := json.Marshal(struct {
+			Message  string `json:"message"`
+			Preimage string `json:"preimage"`
+		}{
+			Message:  "success",
+			Preimage: hex.EncodeToString(preimage),
+		})
+		io.WriteString(w, string(m[:]))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		log.Println("ERROR: Invalid HTTP Method")
+	}
+}
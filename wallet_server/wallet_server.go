@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"goblockchain/block"
@@ -13,6 +15,7 @@ import (
 	"net/http"
 	"path"
 	"strconv"
+	"strings"
 )
 
 const tempDir = "wallet_server/templates"
@@ -20,10 +23,17 @@ const tempDir = "wallet_server/templates"
 type WalletServer struct {
 	port    uint16
 	gateway string
+	client  *http.Client // Talks to the gateway
 }
 
 func NewWalletServer(port uint16, gateway string) *WalletServer {
-	return &WalletServer{port, gateway}
+	return &WalletServer{port, gateway, &http.Client{}}
+}
+
+// SetGatewayTLS presents the client certificate of config to an https
+// gateway and checks the gateway against it.
+func (ws *WalletServer) SetGatewayTLS(config *tls.Config) {
+	ws.client = &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
 }
 
 func (ws *WalletServer) Port() uint16 {
@@ -83,24 +93,36 @@ func (ws *WalletServer) CreateTransaction(w http.ResponseWriter, r *http.Request
 		}
 		value32 := float32(value)
 
+		var lockTime int64
+		if t.LockTime != nil && *t.LockTime != "" {
+			lockTime, err = strconv.ParseInt(*t.LockTime, 10, 64)
+			if err != nil || lockTime < 0 {
+				log.Println("ERROR: parse error")
+				io.WriteString(w, string(utils.JsonStatus("fail")))
+				return
+			}
+		}
+
 		w.Header().Add("Content-Type", "application/json")
 
-		transaction := wallet.NewTransaction(privateKey, publicKey, *t.SenderBlockchainAddress, *t.RecipientBlockchainAddress, value32)
+		if t.GasLimit != nil && *t.GasLimit != "" {
+			ws.createContractTransaction(w, &t, value32)
+			return
+		}
+
+		transaction := wallet.NewTransaction(privateKey, publicKey, *t.SenderBlockchainAddress, *t.RecipientBlockchainAddress, value32, lockTime)
 		signature := transaction.GenerateSignature()
 		signatureStr := signature.String()
 
 		bt := &block.TransactionRequest{
-			t.SenderBlockchainAddress,
-			t.RecipientBlockchainAddress,
-			t.SenderPublicKey,
-			&value32,
-			&signatureStr,
+			SenderBlockchainAddress:    t.SenderBlockchainAddress,
+			RecipientBlockchainAddress: t.RecipientBlockchainAddress,
+			SenderPublicKey:            t.SenderPublicKey,
+			Value:                      &value32,
+			Signature:                  &signatureStr,
+			LockTime:                   &lockTime,
 		}
-		m, _ := json.Marshal(bt)
-		buf := bytes.NewBuffer(m)
-
-		resp, _ := http.Post(ws.Gateway()+"/transactions", "application/json", buf)
-		if resp.StatusCode == 201 {
+		if ws.postTransaction(bt) {
 			io.WriteString(w, string(utils.JsonStatus("success")))
 			return
 		}
@@ -112,19 +134,107 @@ func (ws *WalletServer) CreateTransaction(w http.ResponseWriter, r *http.Request
 	}
 }
 
+// createContractTransaction signs a contract deploy (empty recipient) or
+// call and submits it to the gateway.
+func (ws *WalletServer) createContractTransaction(w http.ResponseWriter, t *wallet.TransactionRequest, value float32) {
+	gasLimit, err := strconv.ParseUint(*t.GasLimit, 10, 64)
+	if err != nil {
+		log.Println("ERROR: parse error")
+		io.WriteString(w, string(utils.JsonStatus("fail")))
+		return
+	}
+	var gasPrice float64
+	if t.GasPrice != nil && *t.GasPrice != "" {
+		if gasPrice, err = strconv.ParseFloat(*t.GasPrice, 32); err != nil {
+			log.Println("ERROR: parse error")
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+	}
+	gasPrice32 := float32(gasPrice)
+
+	var data []byte
+	switch {
+	case t.Data != nil && *t.Data != "":
+		data, err = hex.DecodeString(*t.Data)
+	case t.Input != nil && *t.Input != "":
+		input := []int64{}
+		for _, a := range strings.Split(*t.Input, ",") {
+			v, e := strconv.ParseInt(strings.TrimSpace(a), 10, 64)
+			if e != nil {
+				err = e
+				break
+			}
+			input = append(input, v)
+		}
+		data = block.EncodeCallInput(input)
+	}
+	if err != nil {
+		log.Println("ERROR: parse error")
+		io.WriteString(w, string(utils.JsonStatus("fail")))
+		return
+	}
+
+	publicKey := utils.PublicKeyFromString(*t.SenderPublicKey)
+	privateKey := utils.PrivateKeyFromString(*t.SenderPrivateKey, publicKey)
+	transaction := wallet.NewContractTransaction(privateKey, publicKey, *t.SenderBlockchainAddress, *t.RecipientBlockchainAddress, value, data, gasLimit, gasPrice32)
+	signatureStr := transaction.GenerateSignature().String()
+	dataStr := hex.EncodeToString(data)
+
+	bt := &block.TransactionRequest{
+		SenderBlockchainAddress:    t.SenderBlockchainAddress,
+		RecipientBlockchainAddress: t.RecipientBlockchainAddress,
+		SenderPublicKey:            t.SenderPublicKey,
+		Value:                      &value,
+		Signature:                  &signatureStr,
+		Data:                       &dataStr,
+		GasLimit:                   &gasLimit,
+		GasPrice:                   &gasPrice32,
+	}
+	if !ws.postTransaction(bt) {
+		io.WriteString(w, string(utils.JsonStatus("fail")))
+		return
+	}
+	var contractAddress string
+	if *t.RecipientBlockchainAddress == "" {
+		contractAddress = block.NewContractTransaction(*t.SenderBlockchainAddress, "", value, data, gasLimit, gasPrice32).ContractAddress()
+	}
+	m, _ := json.Marshal(struct {
+		Message         string `json:"message"`
+		ContractAddress string `json:"contract_address,omitempty"`
+	}{
+		Message:         "success",
+		ContractAddress: contractAddress,
+	})
+	io.WriteString(w, string(m))
+}
+
+// postTransaction submits bt to the gateway and reports whether it was accepted.
+func (ws *WalletServer) postTransaction(bt *block.TransactionRequest) bool {
+	m, _ := json.Marshal(bt)
+	buf := bytes.NewBuffer(m)
+
+	resp, err := ws.client.Post(ws.Gateway()+"/transactions", "application/json", buf)
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return false
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode == 201
+}
+
 func (ws *WalletServer) WalletAmount(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
 		blockchainAddress := r.URL.Query().Get("blockchain_address") // From UI
 		endPoint := fmt.Sprintf("%s/amount", ws.Gateway())
 
-		client := &http.Client{}
 		bcsReq, _ := http.NewRequest("GET", endPoint, nil)
 		q := bcsReq.URL.Query()
 		q.Add("blockchain_address", blockchainAddress)
 		bcsReq.URL.RawQuery = q.Encode()
 
-		bcsResp, err := client.Do(bcsReq)
+		bcsResp, err := ws.client.Do(bcsReq)
 		if err != nil {
 			log.Printf("ERROR: %v", err)
 			io.WriteString(w, string(utils.JsonStatus("fail")))
@@ -144,11 +254,13 @@ func (ws *WalletServer) WalletAmount(w http.ResponseWriter, r *http.Request) {
 			}
 
 			m, _ := json.Marshal(struct {
-				Message string  `json:"message"`
-				Amount  float32 `json:"amount"`
+				Message  string  `json:"message"`
+				Amount   float32 `json:"amount"`
+				Immature float32 `json:"immature_amount"`
 			}{
-				Message: "success",
-				Amount:  bar.Amount,
+				Message:  "success",
+				Amount:   bar.Amount,
+				Immature: bar.Immature,
 			})
 			io.WriteString(w, string(m[:]))
 		} else {
@@ -165,5 +277,9 @@ func (ws *WalletServer) Run() {
 	http.HandleFunc("/wallet", ws.Wallet)
 	http.HandleFunc("/wallet/amount", ws.WalletAmount)
 	http.HandleFunc("/transaction", ws.CreateTransaction)
+	http.HandleFunc("/swap/initiate", ws.SwapInitiate)
+	http.HandleFunc("/swap/redeem", ws.SwapRedeem)
+	http.HandleFunc("/swap/refund", ws.SwapRefund)
+	http.HandleFunc("/swap/preimage", ws.SwapPreimage)
 	log.Fatal(http.ListenAndServe("0.0.0.0:"+strconv.Itoa(int(ws.Port())), nil))
 }